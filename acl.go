@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// redactedSecret replaces the secret id of tokens in ACL exports made without --include-secrets.
+const redactedSecret = "<redacted>"
+
+// aclExport is the ACL state of the cluster, stored as {snapshot}.acl.json so policies, roles,
+// tokens and auth methods can be read and recreated one by one rather than only restored whole
+// with the snapshot.
+type aclExport struct {
+	Policies     []*consul.ACLPolicy      `json:"policies"`
+	Roles        []*consul.ACLRole        `json:"roles"`
+	Tokens       []*consul.ACLToken       `json:"tokens"`
+	AuthMethods  []*consul.ACLAuthMethod  `json:"auth_methods"`
+	BindingRules []*consul.ACLBindingRule `json:"binding_rules"`
+}
+
+// isACLDisabled reports whether a consul api error is from ACLs being disabled on the cluster.
+func isACLDisabled(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ACL support disabled")
+}
+
+// exportACLs fetches the ACL policies, roles, tokens, auth methods and binding rules of the cluster
+// as JSON. The secret ids of tokens are redacted unless includeSecrets is set.
+func exportACLs(client *consul.Client, includeSecrets bool) ([]byte, error) {
+	export, err := readACLs(client, includeSecrets)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(export, "", "  ")
+}
+
+// readACLs fetches the ACL policies, roles, tokens, auth methods and binding rules of the cluster.
+// The secret ids of tokens are redacted unless includeSecrets is set.
+func readACLs(client *consul.Client, includeSecrets bool) (*aclExport, error) {
+	acl := client.ACL()
+	export := &aclExport{}
+
+	policies, _, err := acl.PolicyList(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list acl policies: %s", err)
+	}
+
+	// Listing leaves out the rules of policies and the policies, roles and details of tokens, so
+	// each is read in full.
+	for _, entry := range policies {
+		policy, _, err := acl.PolicyRead(entry.ID, nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read acl policy %s: %s", entry.Name, err)
+		}
+
+		export.Policies = append(export.Policies, policy)
+	}
+
+	export.Roles, _, err = acl.RoleList(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list acl roles: %s", err)
+	}
+
+	tokens, _, err := acl.TokenList(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list acl tokens: %s", err)
+	}
+
+	for _, entry := range tokens {
+		token, _, err := acl.TokenRead(entry.AccessorID, nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read acl token %s: %s", entry.AccessorID, err)
+		}
+
+		if !includeSecrets {
+			token.SecretID = redactedSecret
+		}
+
+		export.Tokens = append(export.Tokens, token)
+	}
+
+	methods, _, err := acl.AuthMethodList(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list acl auth methods: %s", err)
+	}
+
+	for _, entry := range methods {
+		method, _, err := acl.AuthMethodRead(entry.Name, nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read acl auth method %s: %s", entry.Name, err)
+		}
+
+		export.AuthMethods = append(export.AuthMethods, method)
+	}
+
+	export.BindingRules, _, err = acl.BindingRuleList("", nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list acl binding rules: %s", err)
+	}
+
+	return export, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	oldLogger "log"
+	"net"
+	"strings"
+	"time"
+
+	consulServer "github.com/hashicorp/consul/agent"
+	consulServerConfig "github.com/hashicorp/consul/agent/config"
+	consul "github.com/hashicorp/consul/api"
+	consulVersionInfo "github.com/hashicorp/consul/version"
+	version "github.com/hashicorp/go-version"
+	log "github.com/sirupsen/logrus"
+)
+
+// AgentConfig is the configuration of the dummy consul agent snapshots are restored into.
+type AgentConfig struct {
+	// EphemeralPorts binds the agent's listeners to free loopback ports instead of the consul
+	// defaults, so verification can't conflict with a consul agent or anything else on the host.
+	EphemeralPorts bool
+	// Addr is the host:port the agent's http api listens on instead of a free loopback port, or
+	// localhost:8500 without ephemeral ports, when set.
+	Addr string
+	// ACLs enables ACLs on the agent, bootstrapped with a random master token, so restoring a
+	// snapshot exercises the ACL subsystem rather than skipping the ACL state it holds.
+	ACLs bool
+	// ReadyTimeout is how long to wait for the agent to elect itself leader.
+	ReadyTimeout time.Duration
+}
+
+// dummyAgentConfig is the dummy agent configuration the flags set, shared by the subcommands.
+var dummyAgentConfig = AgentConfig{
+	EphemeralPorts: true,
+	ReadyTimeout:   time.Second * 30,
+}
+
+// startDummyAgent starts the embedded dev mode consul agent snapshots are restored into, returning
+// a client for it.
+func startDummyAgent(cfg AgentConfig) (*consulServer.Agent, *consul.Client, error) {
+	httpAddr := "localhost:8500"
+	var extraHCL []string
+
+	if cfg.Addr != "" {
+		host, port, err := net.SplitHostPort(strings.TrimPrefix(cfg.Addr, "http://"))
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid dummy agent address '%s': %s", cfg.Addr, err)
+		}
+
+		extraHCL = append(extraHCL,
+			fmt.Sprintf(`client_addr = %q`, host),
+			fmt.Sprintf(`ports { http = %s }`, port),
+		)
+		httpAddr = net.JoinHostPort(host, port)
+	}
+
+	if cfg.EphemeralPorts {
+		ports, err := freeLoopbackPorts(3)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		extraHCL = append(extraHCL,
+			`bind_addr = "127.0.0.1"`,
+			fmt.Sprintf(`ports { server = %d serf_lan = %d }`, ports[1], ports[2]),
+		)
+
+		// The http api takes a free port too unless it's been given an address.
+		if cfg.Addr == "" {
+			extraHCL = append(extraHCL,
+				`client_addr = "127.0.0.1"`,
+				fmt.Sprintf(`ports { http = %d }`, ports[0]),
+			)
+			httpAddr = fmt.Sprintf("127.0.0.1:%d", ports[0])
+		}
+	}
+
+	log.Debugf("starting dummy consul agent with its http api on %s", httpAddr)
+
+	var token string
+
+	if cfg.ACLs {
+		var err error
+		token, err = randomUUID()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The leader recreates the master token after every restore, so the token keeps working when
+		// the snapshot's ACL state replaces the agent's.
+		extraHCL = append(extraHCL, fmt.Sprintf(`acl { enabled = true default_policy = "deny" tokens { master = %q agent = %q } }`, token, token))
+	}
+
+	consulAgent, err := getConsulAgent(extraHCL...)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = consulAgent.Start()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dummyConsulClient, err := consul.NewClient(&consul.Config{
+		Address: "http://" + httpAddr,
+		Token:   token,
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Info("waiting for consul server to become ready")
+
+	if err := waitForLeader(dummyConsulClient, cfg.ReadyTimeout); err != nil {
+		return nil, nil, err
+	}
+
+	return consulAgent, dummyConsulClient, nil
+}
+
+// waitForLeader polls the agent until it reports a raft leader, giving up after the timeout.
+func waitForLeader(client *consul.Client, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		leader, err := client.Status().Leader()
+
+		if err == nil && leader != "" {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("no leader elected")
+			}
+
+			return fmt.Errorf("dummy consul agent not ready after %s: %s", timeout, err)
+		}
+
+		time.Sleep(time.Millisecond * 200)
+	}
+}
+
+// restoreSnapshot restores the snapshot using the given client, timing out after the given duration
+// when it's non zero.
+func restoreSnapshot(client *consul.Client, snapshot []byte, timeout time.Duration) error {
+	return restoreSnapshotStream(client, bytes.NewReader(snapshot), timeout)
+}
+
+// restoreSnapshotStream restores the snapshot read from the reader, as with restoreSnapshot.
+func restoreSnapshotStream(client *consul.Client, snapshot io.Reader, timeout time.Duration) error {
+	restoreOptions := &consul.WriteOptions{}
+
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		restoreOptions = restoreOptions.WithContext(ctx)
+	}
+
+	return client.Snapshot().Restore(restoreOptions, snapshot)
+}
+
+func getConsulAgent(extraHCL ...string) (*consulServer.Agent, error) {
+	devMode := true
+	builder, err := consulServerConfig.NewBuilder(consulServerConfig.Flags{
+		DevMode: &devMode,
+		HCL: append([]string{
+			// Snapshots from ACL enabled clusters carry their ACL state with them, keep ACLs
+			// disabled on the dummy agent so the restored KV can always be listed.
+			`acl { enabled = false default_policy = "allow" }`,
+			// Verification only needs to restore and list the KV, so the dns server, grpc, serf
+			// wan, connect CA and ui dev mode turns on are switched back off to keep the agent's
+			// footprint down.
+			`ports { dns = -1 grpc = -1 serf_wan = -1 }`,
+			`connect { enabled = false }`,
+			`ui = false`,
+		}, extraHCL...),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	rt, err := builder.Build()
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := oldLogger.New(ioutil.Discard, "", 0)
+
+	return consulServer.New(&rt, l)
+}
+
+// freeLoopbackPorts finds the given number of distinct free tcp ports on the loopback interface.
+func freeLoopbackPorts(count int) ([]int, error) {
+	var ports []int
+
+	for i := 0; i < count; i++ {
+		// Keep each listener open until all ports are found so the same port isn't handed out twice.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer listener.Close()
+
+		ports = append(ports, listener.Addr().(*net.TCPAddr).Port)
+	}
+
+	return ports, nil
+}
+
+// dummyAgentVersion returns the consul version of the embedded agent, as this binary was built with.
+func dummyAgentVersion() *version.Version {
+	return version.Must(version.NewVersion(consulVersionInfo.Version))
+}
+
+// significantVersionChange reports whether two consul versions differ in their major or minor
+// version, between which the snapshot format and state store can change.
+func significantVersionChange(a *version.Version, b *version.Version) bool {
+	as, bs := a.Segments(), b.Segments()
+
+	return as[0] != bs[0] || as[1] != bs[1]
+}
+
+// randomUUID returns a random version 4 uuid, the format consul expects of tokens.
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
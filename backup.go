@@ -0,0 +1,951 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"consul_backup_tool/pkg/target"
+	consulServer "github.com/hashicorp/consul/agent"
+	consul "github.com/hashicorp/consul/api"
+	version "github.com/hashicorp/go-version"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+// Config is the configuration of a backup. Settings shared with the subcommands for connecting to
+// consul and the targets, such as tls and s3 encryption, are set through their package variables
+// instead.
+type Config struct {
+	// Context bounds the backup, which stops and fails once it's cancelled. Defaults to a context
+	// that's never cancelled.
+	Context context.Context
+
+	// ConsulAddrs are tried in order until one provides a snapshot.
+	ConsulAddrs         []string
+	ConsulTLSSkipVerify bool
+	ConsulWaitRetries   int
+	ConsulWaitDelay     time.Duration
+	OnlyLeader          bool
+	LockKey             string
+
+	VersionConstraint   version.Constraints
+	ConsulVersionPolicy string
+	AgentVersionPolicy  string
+
+	Stale                 bool
+	SnapshotFromNode      string
+	SnapshotTimeout       time.Duration
+	MaxStaleness          time.Duration
+	StalenessPolicy       string
+	IndexRegressionPolicy string
+
+	StreamDirect bool
+	// RestoreDuringDownload overlaps the verification restore with the download. The snapshot is
+	// still held in full until it's verified, so it doesn't lower memory use like SpoolDir.
+	RestoreDuringDownload bool
+	// SpoolDir is where to spool the snapshot to disk rather than hold it in memory, when set.
+	SpoolDir      string
+	Inspect       bool
+	InspectReport bool
+	ClusterConfig bool
+	KVExport      bool
+	ACLExport     bool
+	// ACLExportSecrets keeps the secret ids of tokens in the ACL export rather than redacting them.
+	ACLExportSecrets bool
+	// KVPrefixes switches the backup to an export of the KV under them, rather than a snapshot.
+	KVPrefixes []string
+	// Incremental only exports the KV modified since the previous export under the prefixes,
+	// taking a full export once the last is FullExportInterval old.
+	Incremental        bool
+	FullExportInterval time.Duration
+
+	// VerifyMode is one of full, inspect, restore-only or none, Agent configuring the dummy agent
+	// the snapshot is restored into to verify it.
+	VerifyMode            string
+	Agent                 AgentConfig
+	VerifyMaxProcs        int
+	RestoreTimeout        time.Duration
+	VerifyByPrefix        bool
+	VerifyConcurrency     int
+	VerifyTolerance       int
+	VerifySkipPrefixes    []string
+	VerifySamplePercent   float64
+	VerifySampleSeed      int64
+	VerifySessionsQueries bool
+	ExpectKeyPrefixes     []string
+	// VerifyMismatchPolicy is what to do when the snapshot's kv doesn't match the live kv, one of
+	// fail, warn or retry, which takes a fresh snapshot up to VerifyMismatchRetries times.
+	VerifyMismatchPolicy  string
+	VerifyMismatchRetries int
+
+	// Targets are the parsed TargetURIs, in the same order, TargetQuorum of which need to store the
+	// snapshot for the run to succeed.
+	Targets           []*Target
+	TargetURIs        []string
+	TargetQuorum      int
+	SigningKey        *openpgp.Entity
+	DailyPrefix       string
+	Retain            int
+	RetainDaily       int
+	RetainAge         time.Duration
+	RetentionDryRun   bool
+	CurrentPointerKey string
+	SuccessMarkerKey  string
+	AuditEvent        string
+	UploadTimeout     time.Duration
+	// TargetTimeout bounds each upload to a target, within the UploadTimeout of them all.
+	TargetTimeout time.Duration
+}
+
+// verifyMismatchError is returned when the snapshot's kv doesn't match the live kv.
+type verifyMismatchError struct {
+	Missing    int
+	Mismatched int
+}
+
+func (e *verifyMismatchError) Error() string {
+	return fmt.Sprintf("snapshot does not match the live kv, %d keys missing and %d keys with different values", e.Missing, e.Mismatched)
+}
+
+// Backup takes a snapshot from the first consul agent able to provide one, verifies it and stores
+// it to the targets, returning the result of the run. The result is also returned with the error
+// when the backup fails, recording the phase it failed in.
+func Backup(cfg Config) (*RunResult, error) {
+	startRun(cfg)
+
+	for {
+		_, err := backup(cfg)
+
+		// On busy clusters keys written while the snapshot is taken are often the cause, which a
+		// fresh snapshot doesn't share.
+		if _, ok := err.(*verifyMismatchError); ok && cfg.VerifyMismatchPolicy == "retry" && result.VerifyRetries < cfg.VerifyMismatchRetries {
+			result.VerifyRetries++
+			log.Warnf("%s, taking a fresh snapshot, retry %d of %d", err, result.VerifyRetries, cfg.VerifyMismatchRetries)
+			continue
+		}
+
+		if err != nil {
+			result.FailedPhase = currentPhase
+			result.Error = err.Error()
+		}
+
+		return result, err
+	}
+}
+
+// startRun starts the state of a backup afresh from its config, with a new result, and the context
+// and timeout the requests to consul and the targets are made within.
+func startRun(cfg Config) {
+	result = &RunResult{
+		Status:     "failure",
+		Target:     strings.Join(cfg.TargetURIs, ","),
+		VerifyMode: cfg.VerifyMode,
+		Durations:  map[string]float64{},
+	}
+
+	currentPhase = "setup"
+	runContext = cfg.Context
+
+	if runContext == nil {
+		runContext = context.Background()
+	}
+
+	target.Context = runContext
+	target.Timeout = cfg.TargetTimeout
+}
+
+// backup makes a single attempt at the backup, shutting down the dummy consul agent before
+// returning so another attempt can start its own.
+func backup(cfg Config) (*RunResult, error) {
+	var err error
+
+	if cfg.ConsulWaitRetries > 0 {
+		waitClient, err := newConsulClient(cfg.ConsulAddrs[0], cfg.ConsulTLSSkipVerify)
+
+		if err != nil {
+			return result, fmt.Errorf("error creating consul client: %s", err)
+		}
+
+		if err := waitForConsul(waitClient, cfg.ConsulWaitRetries, cfg.ConsulWaitDelay); err != nil {
+			return result, fmt.Errorf("consul at %s did not become ready: %s", cfg.ConsulAddrs[0], err)
+		}
+	}
+
+	if cfg.OnlyLeader {
+		leaderClient, err := newConsulClient(cfg.ConsulAddrs[0], cfg.ConsulTLSSkipVerify)
+
+		if err != nil {
+			return result, fmt.Errorf("error creating consul client: %s", err)
+		}
+
+		leader, err := isLeader(leaderClient)
+
+		if err != nil {
+			return result, fmt.Errorf("error checking consul leadership: %s", err)
+		}
+
+		if !leader {
+			log.Infof("%s is not the raft leader, skipping backup", cfg.ConsulAddrs[0])
+			result.Status = "skipped"
+			return result, nil
+		}
+	}
+
+	if cfg.LockKey != "" {
+		lockClient, err := newConsulClient(cfg.ConsulAddrs[0], cfg.ConsulTLSSkipVerify)
+
+		if err != nil {
+			return result, fmt.Errorf("error creating consul client: %s", err)
+		}
+
+		lock, err := acquireBackupLock(lockClient, cfg.LockKey)
+
+		if err != nil {
+			return result, fmt.Errorf("error acquiring backup lock %s: %s", cfg.LockKey, err)
+		}
+
+		if lock == nil {
+			log.Infof("backup lock %s is held or was taken by another instance, skipping backup", cfg.LockKey)
+			result.Status = "skipped"
+			return result, nil
+		}
+
+		defer func() {
+			if err := lock.Unlock(); err != nil {
+				log.Warnf("error releasing backup lock %s: %s", cfg.LockKey, err)
+			}
+		}()
+	}
+
+	if len(cfg.KVPrefixes) > 0 {
+		return result, backupKVPrefixes(cfg)
+	}
+
+	var consulClient *consul.Client
+	var data io.ReadCloser
+	var snapshotMeta *consul.QueryMeta
+
+	snapshotStart := time.Now()
+	currentPhase = "snapshot"
+
+	// The snapshot is read from the response after it's returned, so the context lasts the attempt.
+	snapshotCtx, cancelSnapshot := phaseContext(cfg.SnapshotTimeout)
+	defer cancelSnapshot()
+
+	_, err = retryBackoff("fetching consul snapshot", isRetryableConsulError, func() error {
+		consulClient, data, snapshotMeta, err = takeSnapshot(snapshotCtx, cfg)
+		return err
+	})
+
+	if err != nil {
+		return result, fmt.Errorf("error fetching consul snapshot, no consul host could provide one: %s", err)
+	}
+
+	// Closing the response ends the request to consul, however much of the snapshot was read.
+	defer data.Close()
+
+	result.ConsulVersion, result.Datacenter, err = consulClusterInfo(consulClient)
+
+	if err != nil {
+		log.Warnf("error fetching the consul version and datacenter to record with the snapshot: %s", err)
+	}
+
+	if cfg.Stale {
+		log.Infof("snapshot last contact with the leader was %s ago, known leader: %t", snapshotMeta.LastContact, snapshotMeta.KnownLeader)
+
+		if cfg.MaxStaleness > 0 && snapshotMeta.LastContact > cfg.MaxStaleness {
+			if cfg.StalenessPolicy == "fail" {
+				return result, fmt.Errorf("snapshot staleness of %s exceeds the maximum of %s", snapshotMeta.LastContact, cfg.MaxStaleness)
+			}
+
+			log.Warnf("snapshot staleness of %s exceeds the maximum of %s", snapshotMeta.LastContact, cfg.MaxStaleness)
+		}
+	}
+
+	// Only verification restores the snapshot into the embedded agent, inspect reads the archive
+	// without it.
+	if cfg.AgentVersionPolicy != "ignore" && cfg.VerifyMode != "none" && cfg.VerifyMode != "inspect" && !cfg.StreamDirect {
+		v, err := consulVersion(consulClient)
+
+		if err != nil {
+			log.Warnf("error fetching consul version to compare with the embedded agent: %s", err)
+		} else if agentVersion := dummyAgentVersion(); significantVersionChange(v, agentVersion) {
+			if cfg.AgentVersionPolicy == "fail" {
+				return result, fmt.Errorf("live consul version %s differs from the embedded agent version %s used for verification", v, agentVersion)
+			}
+
+			log.Warnf("live consul version %s differs from the embedded agent version %s used for verification, which may not restore the snapshot faithfully", v, agentVersion)
+		}
+	}
+
+	if cfg.StreamDirect {
+		uploadStart := time.Now()
+		currentPhase = "upload"
+
+		snapshotKey, err := snapshotName()
+
+		if err != nil {
+			return result, err
+		}
+
+		result.SnapshotKey = snapshotKey
+
+		log.Infof("streaming snapshot to %s", cfg.Targets[0].Type)
+
+		// The streamed snapshot is stored like any other, writing the current pointer and applying
+		// retention once it's uploaded.
+		_, err = storeToTargets(cfg, snapshotKey, func(target *Target) error {
+			return streamSnapshot(target, snapshotKey, data)
+		})
+
+		if err != nil {
+			return result, err
+		}
+
+		recordDuration("upload", uploadStart)
+
+		if cfg.SuccessMarkerKey != "" {
+			writeSuccessMarker(cfg.Targets[0], cfg.SuccessMarkerKey)
+		}
+
+		if cfg.AuditEvent != "" {
+			recordAuditEvent(consulClient, cfg.AuditEvent, snapshotMeta.LastIndex)
+		}
+
+		result.Status = "success"
+
+		return result, nil
+	}
+
+	defaultMaxProcs := 0
+
+	if cfg.VerifyMaxProcs > 0 {
+		log.Infof("limiting verification to %d cpus", cfg.VerifyMaxProcs)
+		defaultMaxProcs = runtime.GOMAXPROCS(cfg.VerifyMaxProcs)
+
+		defer runtime.GOMAXPROCS(defaultMaxProcs)
+	}
+
+	var snapshot []byte
+	// spooled is the path of the snapshot when it's spooled to disk rather than held in memory.
+	var spooled string
+	var dummyAgent *consulServer.Agent
+	var dummyConsulClient *consul.Client
+
+	defer func() {
+		if dummyAgent != nil {
+			if err := dummyAgent.ShutdownAgent(); err != nil {
+				log.Warnf("error shutting down dummy consul agent: %s", err)
+			}
+
+			dummyAgent.ShutdownEndpoints()
+		}
+	}()
+	var verifyDuration time.Duration
+
+	if cfg.RestoreDuringDownload {
+		// Restore the snapshot as it's downloaded, keeping a copy of what's read, so the download
+		// and the verification restore happen together rather than one after the other. Compression
+		// and the uploads deliberately aren't fed from the same stream: nothing is stored before the
+		// snapshot is verified, and the uploads carry the verification result in their metadata. So
+		// they work from the copy afterwards, which holds the whole snapshot in memory as usual.
+		verifyStart := time.Now()
+		currentPhase = "verify"
+
+		log.Info("verifying snapshot by restoring to dummy consul server as it's downloaded")
+
+		dummyAgent, dummyConsulClient, err = startDummyAgent(cfg.Agent)
+
+		if err != nil {
+			return result, fmt.Errorf("error starting dummy consul agent to test snapshot: %s", err)
+		}
+
+		var buffer bytes.Buffer
+
+		err = restoreSnapshotStream(dummyConsulClient, io.TeeReader(data, &buffer), cfg.RestoreTimeout)
+
+		if err != nil {
+			return result, fmt.Errorf("error restoring snapshot to dummy consul agent: %s", err)
+		}
+
+		if _, err := io.Copy(&buffer, data); err != nil {
+			return result, fmt.Errorf("error reading consul snapshot: %s", err)
+		}
+
+		snapshot = buffer.Bytes()
+		verifyDuration = time.Since(verifyStart)
+	} else if cfg.SpoolDir != "" {
+		spoolPath, size, digest, err := spoolSnapshot(cfg.SpoolDir, data)
+
+		if err != nil {
+			return result, fmt.Errorf("error spooling consul snapshot to %s: %s", cfg.SpoolDir, err)
+		}
+
+		defer os.Remove(spoolPath)
+
+		spooled = spoolPath
+		result.SnapshotBytes = int(size)
+		result.SnapshotSHA256 = digest
+	} else {
+		snapshot, err = ioutil.ReadAll(data)
+
+		if err != nil {
+			return result, fmt.Errorf("error reading consul snapshot: %s", err)
+		}
+	}
+
+	if spooled == "" {
+		result.SnapshotBytes = len(snapshot)
+	}
+
+	snapshotLog := log.WithFields(log.Fields{
+		"snapshot_size": result.SnapshotBytes,
+		"duration_ms":   int64(time.Since(snapshotStart) / time.Millisecond),
+	})
+
+	if spooled != "" {
+		snapshotLog.Infof("spooled snapshot of %d bytes to %s", result.SnapshotBytes, spooled)
+	} else {
+		snapshotLog.Infof("got snapshot of %d bytes", len(snapshot))
+	}
+
+	recordDuration("snapshot", snapshotStart)
+
+	sidecars := map[string][]byte{}
+
+	if cfg.Inspect || cfg.InspectReport {
+		info, err := inspectSnapshot(snapshot)
+
+		if err != nil {
+			return result, fmt.Errorf("error inspecting consul snapshot: %s", err)
+		}
+
+		if cfg.Inspect {
+			logSnapshotInfo(info)
+		}
+
+		if cfg.InspectReport {
+			sidecars["inspect.txt"] = formatSnapshotInfo(info)
+		}
+	}
+
+	if cfg.IndexRegressionPolicy != "" {
+		var previousIndex uint64
+		var found bool
+		var readErrors []string
+
+		// Each target may have missed backups while it was unavailable, so the newest index across
+		// them is the one to compare with.
+		for i, target := range cfg.Targets {
+			index, ok, err := previousSnapshotIndex(target)
+
+			if err != nil {
+				log.Warnf("error reading the index of the previous snapshot from %s: %s", cfg.TargetURIs[i], err)
+				readErrors = append(readErrors, fmt.Sprintf("%s: %s", cfg.TargetURIs[i], err))
+				continue
+			}
+
+			if ok && index > previousIndex {
+				previousIndex = index
+				found = true
+			}
+		}
+
+		if len(readErrors) == len(cfg.Targets) {
+			return result, fmt.Errorf("error reading the index of the previous snapshot: %s", strings.Join(readErrors, "; "))
+		}
+
+		if found && snapshotMeta.LastIndex < previousIndex {
+			if cfg.IndexRegressionPolicy == "fail" {
+				return result, fmt.Errorf("snapshot index %d is behind the previous snapshot's index %d", snapshotMeta.LastIndex, previousIndex)
+			}
+
+			log.Warnf("snapshot index %d is behind the previous snapshot's index %d", snapshotMeta.LastIndex, previousIndex)
+		}
+
+		sidecars["index"] = []byte(strconv.FormatUint(snapshotMeta.LastIndex, 10))
+	}
+
+	if cfg.ClusterConfig {
+		configs, err := clusterConfigSidecars(consulClient)
+
+		if err != nil {
+			return result, fmt.Errorf("error fetching cluster configuration: %s", err)
+		}
+
+		for suffix, data := range configs {
+			sidecars[suffix] = data
+		}
+	}
+
+	if cfg.ACLExport {
+		export, err := exportACLs(consulClient, cfg.ACLExportSecrets)
+
+		if isACLDisabled(err) {
+			log.Warn("acls are disabled on the cluster, so there are none to export")
+		} else if err != nil {
+			if isPermissionDenied(err) {
+				log.Warnf("exporting acls requires a token with acl = \"read\", or acl = \"write\" with --include-secrets, the request used %s", configuredToken())
+			}
+
+			return result, fmt.Errorf("error exporting acls: %s", err)
+		} else if cfg.ACLExportSecrets && encryptionEnabled() {
+			// Secrets are only kept when asked for, and then encrypted along with the snapshot.
+			encrypted, err := encryptStoredSnapshot(export)
+
+			if err != nil {
+				return result, fmt.Errorf("error encrypting the acl export: %s", err)
+			}
+
+			sidecars["acl.json.enc"] = encrypted
+		} else {
+			sidecars["acl.json"] = export
+		}
+	}
+
+	if err := runCancelled(); err != nil {
+		return result, err
+	}
+
+	verifyStart := time.Now().Add(-verifyDuration)
+	currentPhase = "verify"
+
+	// offline is the snapshot's state read from its archive when verifying without the dummy agent.
+	var offline *snapshotState
+
+	if cfg.VerifyMode == "inspect" {
+		log.Info("verifying snapshot by reading its archive")
+
+		source := bytesSource(snapshot)
+
+		if spooled != "" {
+			source = fileSource(spooled)
+		}
+
+		offline, err = readSnapshotState(source)
+
+		if err != nil {
+			return result, fmt.Errorf("error reading consul snapshot archive: %s", err)
+		}
+	} else if dummyConsulClient == nil && cfg.VerifyMode != "none" {
+		log.Info("verifying snapshot by restoring to dummy consul server")
+
+		dummyAgent, dummyConsulClient, err = startDummyAgent(cfg.Agent)
+
+		if err != nil {
+			return result, fmt.Errorf("error starting dummy consul agent to test snapshot: %s", err)
+		}
+
+		if spooled != "" {
+			err = restoreSpooledSnapshot(dummyConsulClient, spooled, cfg.RestoreTimeout)
+		} else {
+			err = restoreSnapshot(dummyConsulClient, snapshot, cfg.RestoreTimeout)
+		}
+
+		if err != nil {
+			return result, fmt.Errorf("error restoring snapshot to dummy consul agent: %s", err)
+		}
+	}
+
+	switch cfg.VerifyMode {
+	case "full", "inspect":
+		verification := &kvVerification{
+			SnapshotIndex: snapshotMeta.LastIndex,
+			SamplePercent: cfg.VerifySamplePercent,
+			SampleSeed:    cfg.VerifySampleSeed,
+			SkipPrefixes:  cfg.VerifySkipPrefixes,
+		}
+
+		if cfg.VerifySamplePercent > 0 && cfg.VerifySamplePercent < 100 {
+			if verification.SampleSeed == 0 {
+				verification.SampleSeed = rand.New(rand.NewSource(time.Now().UnixNano())).Int63()
+			}
+
+			log.Infof("spot checking %g%% of keys with seed %d, pass --verify-sample-seed %d to check the same keys again", verification.SamplePercent, verification.SampleSeed, verification.SampleSeed)
+		}
+
+		// The empty prefix lists the whole KV. The api trims a leading / from the prefix, so "/"
+		// would too, but "" doesn't rely on it.
+		chunks := []string{""}
+
+		if cfg.VerifyByPrefix {
+			chunks, err = listKVChunks(dummyConsulClient, consulClient)
+
+			if err != nil {
+				return result, fmt.Errorf("error listing top level consul keys: %s", err)
+			}
+
+			log.Infof("comparing keys in %d chunks, %d at once", len(chunks), cfg.VerifyConcurrency)
+		}
+
+		listSnapshot := func(chunk string) (consul.KVPairs, error) {
+			if offline != nil {
+				return offline.KVs, nil
+			}
+
+			return listKVChunk(dummyConsulClient, chunk)
+		}
+
+		listLive := func(chunk string) (consul.KVPairs, error) {
+			return listKVChunk(consulClient, chunk)
+		}
+
+		if err := verification.compareChunks(chunks, cfg.VerifyConcurrency, listSnapshot, listLive); err != nil {
+			return result, err
+		}
+
+		log.Infof("listed %d keys from the snapshot and %d from the live cluster", verification.SnapshotKeys, verification.LiveKeys)
+
+		if verification.SkippedKeys > 0 {
+			log.Infof("skipped %d keys under %s", verification.SkippedKeys, strings.Join(cfg.VerifySkipPrefixes, ", "))
+		}
+
+		if verification.ModifiedSinceSnapshot > 0 {
+			log.Infof("skipped %d keys modified after the snapshot index %d", verification.ModifiedSinceSnapshot, snapshotMeta.LastIndex)
+		}
+
+		result.SnapshotOnlyKeys = verification.SnapshotOnlyKeys
+
+		if result.SnapshotOnlyKeys > 0 {
+			log.Infof("%d keys in the snapshot have since been deleted from the live cluster", result.SnapshotOnlyKeys)
+		}
+
+		differing := len(verification.MissingKeys) + len(verification.MismatchedKeys)
+
+		// Differences within the tolerance are expected churn rather than errors.
+		logDifference := log.Errorf
+
+		if differing <= cfg.VerifyTolerance {
+			logDifference = log.Warnf
+		}
+
+		for _, key := range sortedStrings(verification.MissingKeys) {
+			logDifference("key %s was not found in the snapshot", key)
+		}
+
+		for _, key := range sortedStrings(verification.MismatchedKeys) {
+			logDifference("key %s has a different value in the snapshot", key)
+		}
+
+		if differing > 0 && differing <= cfg.VerifyTolerance {
+			log.Warnf("%d keys differ from the snapshot, within the --verify-tolerance of %d", differing, cfg.VerifyTolerance)
+		} else if differing > 0 {
+			err := &verifyMismatchError{Missing: len(verification.MissingKeys), Mismatched: len(verification.MismatchedKeys)}
+
+			if cfg.VerifyMismatchPolicy != "warn" {
+				return result, err
+			}
+
+			log.Warnf("%s, storing it anyway", err)
+		} else if cfg.VerifySamplePercent > 0 && cfg.VerifySamplePercent < 100 {
+			log.Infof("verified %d sampled keys match the snapshot, got %d keys", verification.SampledKeys, verification.SnapshotKeys)
+		} else {
+			log.Infof("verified all keys match the snapshot, got %d keys", verification.SnapshotKeys)
+		}
+
+		result.SnapshotKeys = verification.SnapshotKeys
+
+		if cfg.VerifySessionsQueries {
+			var snapshotSessions, snapshotQueries int
+
+			if offline != nil {
+				snapshotSessions, snapshotQueries = offline.countSessions(snapshotMeta.LastIndex), offline.Queries
+			} else {
+				snapshotSessions, snapshotQueries, err = countSessionsAndQueries(dummyConsulClient, snapshotMeta.LastIndex)
+
+				if err != nil {
+					return result, fmt.Errorf("error counting sessions and prepared queries restored to dummy consul agent: %s", err)
+				}
+			}
+
+			liveSessions, liveQueries, err := countSessionsAndQueries(consulClient, snapshotMeta.LastIndex)
+
+			if err != nil {
+				return result, fmt.Errorf("error counting live sessions and prepared queries: %s", err)
+			}
+
+			// Sessions and queries destroyed since the snapshot was taken only leave the snapshot
+			// with more, fewer means some were never captured.
+			if snapshotSessions < liveSessions {
+				return result, fmt.Errorf("snapshot is missing sessions, got %d expected %d", snapshotSessions, liveSessions)
+			}
+
+			if snapshotQueries < liveQueries {
+				return result, fmt.Errorf("snapshot is missing prepared queries, got %d expected %d", snapshotQueries, liveQueries)
+			}
+
+			log.Infof("verified snapshot contains %d sessions and %d prepared queries", snapshotSessions, snapshotQueries)
+		}
+	case "restore-only":
+		log.Info("verified snapshot restores, skipping the kv comparison")
+	case "none":
+		log.Warn("skipping snapshot verification")
+	}
+
+	if len(cfg.ExpectKeyPrefixes) > 0 && cfg.VerifyMode != "none" {
+		var missing []string
+
+		if offline != nil {
+			missing = offline.missingKeyPrefixes(cfg.ExpectKeyPrefixes)
+		} else {
+			missing, err = missingKeyPrefixes(dummyConsulClient, cfg.ExpectKeyPrefixes)
+
+			if err != nil {
+				return result, fmt.Errorf("error listing keys restored to dummy consul agent: %s", err)
+			}
+		}
+
+		if len(missing) > 0 {
+			return result, fmt.Errorf("snapshot has no keys under the expected prefixes: %s", strings.Join(missing, ", "))
+		}
+
+		log.Infof("verified snapshot has keys under all %d expected prefixes", len(cfg.ExpectKeyPrefixes))
+	}
+
+	recordDuration("verify", verifyStart)
+
+	if cfg.KVExport {
+		// The export is read from the snapshot rather than the live cluster so it's of the same point
+		// in time.
+		if offline == nil {
+			source := bytesSource(snapshot)
+
+			if spooled != "" {
+				source = fileSource(spooled)
+			}
+
+			offline, err = readSnapshotState(source)
+
+			if err != nil {
+				return result, fmt.Errorf("error reading consul snapshot archive for the kv export: %s", err)
+			}
+		}
+
+		export, err := kvExport(offline.KVs)
+
+		if err != nil {
+			return result, fmt.Errorf("error exporting the kv: %s", err)
+		}
+
+		// The export holds every value in the clear, so it's encrypted along with the snapshot.
+		if encryptionEnabled() {
+			encrypted, err := encryptStoredSnapshot(export)
+
+			if err != nil {
+				return result, fmt.Errorf("error encrypting the kv export: %s", err)
+			}
+
+			sidecars["kv.json.enc"] = encrypted
+		} else {
+			sidecars["kv.json"] = export
+		}
+
+		log.Infof("exported %d keys from the snapshot", len(offline.KVs))
+	}
+
+	if defaultMaxProcs > 0 {
+		runtime.GOMAXPROCS(defaultMaxProcs)
+	}
+
+	if err := runCancelled(); err != nil {
+		return result, err
+	}
+
+	uploadStart := time.Now()
+	currentPhase = "upload"
+
+	var snapshotKey string
+	var stored []byte
+
+	// A spooled snapshot is uploaded as it was taken, its digest already known from spooling it.
+	if spooled != "" {
+		snapshotKey, err = snapshotName()
+
+		if err != nil {
+			return result, err
+		}
+
+		result.SnapshotKey = snapshotKey
+	} else {
+		snapshotKey, stored, err = prepareSnapshot(snapshot)
+
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// The snapshot is verified once above, however many targets there are, and each target is sent
+	// the same prepared bytes, so nothing here touches the dummy agent.
+	storeErrors, err := storeToTargets(cfg, snapshotKey, func(target *Target) error {
+		if spooled != "" {
+			return sendSpooledSnapshot(target, snapshotKey, spooled, sidecars)
+		}
+
+		return sendSnapshot(target, snapshotKey, stored, cfg.SigningKey, sidecars, cfg.DailyPrefix)
+	})
+
+	if err != nil {
+		return result, err
+	}
+
+	recordDuration("upload", uploadStart)
+
+	// Unverified snapshots and partial failures don't count as a success.
+	if cfg.SuccessMarkerKey != "" && cfg.VerifyMode != "none" && len(storeErrors) == 0 {
+		for _, target := range cfg.Targets {
+			writeSuccessMarker(target, cfg.SuccessMarkerKey)
+		}
+	}
+
+	if cfg.AuditEvent != "" {
+		recordAuditEvent(consulClient, cfg.AuditEvent, snapshotMeta.LastIndex)
+	}
+
+	result.Status = "success"
+
+	return result, nil
+}
+
+// storeToTargets stores the snapshot to each target with send, writing the current pointer and
+// applying retention to the snapshots and daily snapshots of the targets it's stored to. A target
+// failing doesn't stop the snapshot being stored to the others, the errors of those that failed
+// are returned and only fewer than the quorum storing it is an error.
+func storeToTargets(cfg Config, snapshotKey string, send func(target *Target) error) ([]string, error) {
+	var storeErrors []string
+	var cancel context.CancelFunc
+
+	// Uploads are bounded to --upload-timeout, within the run.
+	target.Context, cancel = phaseContext(cfg.UploadTimeout)
+	defer cancel()
+
+	for i, target := range cfg.Targets {
+		if err := runCancelled(); err != nil {
+			return storeErrors, err
+		}
+
+		targetLog := log.WithField("target", cfg.TargetURIs[i])
+		targetLog.Infof("uploading snapshot to %s", target.Type)
+
+		start := time.Now()
+		endSpan := startSpan("store", "consul_backup.target", cfg.TargetURIs[i])
+		err := send(target)
+		endSpan(err)
+
+		if err != nil {
+			targetLog.WithField("duration_ms", int64(time.Since(start)/time.Millisecond)).Warnf("error storing snapshot to %s: %s", cfg.TargetURIs[i], err)
+			storeErrors = append(storeErrors, fmt.Sprintf("%s: %s", cfg.TargetURIs[i], err))
+			result.FailedTargets = append(result.FailedTargets, cfg.TargetURIs[i])
+			continue
+		}
+
+		targetLog.WithFields(log.Fields{
+			"snapshot_key":  snapshotKey,
+			"snapshot_size": result.SnapshotBytes,
+			"duration_ms":   int64(time.Since(start) / time.Millisecond),
+		}).Infof("stored snapshot %s to %s", snapshotKey, target.Type)
+
+		if cfg.CurrentPointerKey != "" {
+			writeSnapshotPointer(target, cfg.CurrentPointerKey, snapshotKey)
+		}
+
+		if cfg.Retain > 0 || cfg.RetainAge > 0 {
+			endSpan := startSpan("retention", "consul_backup.target", cfg.TargetURIs[i])
+			summary, err := applyRetention(target, "", cfg.Retain, cfg.RetainAge, cfg.RetentionDryRun)
+			endSpan(err)
+
+			if err != nil {
+				log.Warnf("error applying retention to %s: %s", target.Type, err)
+			} else {
+				recordRetention(cfg.TargetURIs[i], false, summary)
+			}
+		}
+
+		if cfg.RetainDaily > 0 {
+			endSpan := startSpan("retention", "consul_backup.target", cfg.TargetURIs[i])
+			summary, err := applyRetention(target, cfg.DailyPrefix, cfg.RetainDaily, 0, cfg.RetentionDryRun)
+			endSpan(err)
+
+			if err != nil {
+				log.Warnf("error applying retention to the daily snapshots of %s: %s", target.Type, err)
+			} else {
+				recordRetention(cfg.TargetURIs[i], true, summary)
+			}
+		}
+	}
+
+	if stored := len(cfg.Targets) - len(storeErrors); stored < cfg.TargetQuorum {
+		if stored == 0 {
+			return storeErrors, fmt.Errorf("error storing snapshot: %s", strings.Join(storeErrors, "; "))
+		}
+
+		return storeErrors, fmt.Errorf("error storing snapshot, only %d of the %d targets needed stored it: %s", stored, cfg.TargetQuorum, strings.Join(storeErrors, "; "))
+	}
+
+	return storeErrors, nil
+}
+
+// takeSnapshot takes a snapshot from the first consul agent able to provide one, returning the
+// client of the agent that did. The error of the last agent tried is returned when none could. The
+// caller reads the snapshot from the returned reader and closes it.
+func takeSnapshot(ctx context.Context, cfg Config) (*consul.Client, io.ReadCloser, *consul.QueryMeta, error) {
+	var lastErr error
+
+	for _, addr := range cfg.ConsulAddrs {
+		client, err := newConsulClient(addr, cfg.ConsulTLSSkipVerify)
+
+		if err != nil {
+			log.Warnf("error creating consul client for %s: %s", addr, err)
+			lastErr = err
+			continue
+		}
+
+		if cfg.VersionConstraint != nil {
+			v, err := consulVersion(client)
+
+			if err != nil {
+				log.Warnf("error fetching consul version from %s: %s", addr, err)
+				lastErr = err
+				continue
+			}
+
+			if !cfg.VersionConstraint.Check(v) {
+				if cfg.ConsulVersionPolicy == "fail" {
+					return nil, nil, nil, fmt.Errorf("consul version %s of %s does not satisfy %s", v, addr, cfg.VersionConstraint)
+				}
+
+				log.Warnf("consul version %s of %s does not satisfy %s", v, addr, cfg.VersionConstraint)
+			}
+		}
+
+		data, snapshotMeta, err := client.Snapshot().Save((&consul.QueryOptions{
+			AllowStale: cfg.Stale,
+			Near:       cfg.SnapshotFromNode,
+		}).WithContext(ctx))
+
+		if err != nil {
+			log.Warnf("error fetching consul snapshot from %s: %s", addr, err)
+
+			if isPermissionDenied(err) {
+				log.Warnf("taking a snapshot requires a management token or one with acl = \"write\", the request used %s", configuredToken())
+			}
+
+			lastErr = err
+			continue
+		}
+
+		log.Infof("fetched snapshot at index %d from %s", snapshotMeta.LastIndex, addr)
+
+		return client, data, snapshotMeta, nil
+	}
+
+	return nil, nil, nil, lastErr
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"consul_backup_tool/pkg/target"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+)
+
+// testSnapshot builds a consul snapshot archive at the index holding the KV pairs, laid out the way
+// consul writes them, with the checksums verification reads.
+func testSnapshot(t *testing.T, index uint64, pairs consul.KVPairs) []byte {
+	var state bytes.Buffer
+	enc := codec.NewEncoder(&state, &codec.MsgpackHandle{})
+
+	if err := enc.Encode(struct{ LastIndex uint64 }{index}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kv := range pairs {
+		// 2 is consul's KVS message type.
+		state.WriteByte(2)
+
+		if err := enc.Encode(kv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	meta, err := json.Marshal(raft.SnapshotMeta{ID: "test", Index: index, Term: 1, Version: 1, Size: int64(state.Len())})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sums bytes.Buffer
+	files := []struct {
+		name string
+		data []byte
+	}{{"meta.json", meta}, {"state.bin", state.Bytes()}}
+
+	for _, file := range files {
+		fmt.Fprintf(&sums, "%x  %s\n", sha256.Sum256(file.data), file.name)
+	}
+
+	files = append(files, struct {
+		name string
+		data []byte
+	}{"SHA256SUMS", sums.Bytes()})
+
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0600, Size: int64(len(file.data))}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write(file.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return archive.Bytes()
+}
+
+// fakeConsul serves a snapshot of the KV pairs and the live KV, counting the requests listing the
+// whole live KV, which verification makes once for each comparison.
+func fakeConsul(t *testing.T, pairs consul.KVPairs) (string, *int32) {
+	snapshot := testSnapshot(t, 10, pairs)
+	var kvLists int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/snapshot":
+			w.Header().Set("X-Consul-Index", "10")
+			w.Header().Set("X-Consul-KnownLeader", "true")
+			w.Header().Set("X-Consul-LastContact", "0")
+			w.Write(snapshot)
+		case r.URL.Path == "/v1/agent/self":
+			fmt.Fprint(w, `{"Config": {"Datacenter": "dc1", "Version": "1.6.0"}}`)
+		case r.URL.Path == "/v1/kv/" && r.URL.Query().Has("recurse"):
+			atomic.AddInt32(&kvLists, 1)
+			json.NewEncoder(w).Encode(pairs)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server.URL, &kvLists
+}
+
+// recordingProvider keeps the objects put to it in memory, or fails to store them with err when set.
+type recordingProvider struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	err     error
+}
+
+func (p *recordingProvider) Put(target *Target, key string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+
+	p.objects[key] = data
+
+	return nil
+}
+
+func (p *recordingProvider) Get(target *Target) ([]byte, error) {
+	return nil, fmt.Errorf("not found")
+}
+
+func (p *recordingProvider) List(target *Target, prefix string) ([]string, error) {
+	return nil, nil
+}
+
+func (p *recordingProvider) Delete(target *Target, key string) error {
+	return nil
+}
+
+func (p *recordingProvider) Stat(target *Target) ([]objectInfo, error) {
+	return nil, nil
+}
+
+// recordingTarget registers a recording provider for the target type, removing it once the test
+// is done.
+func recordingTarget(t *testing.T, targetType string) (*Target, *recordingProvider) {
+	provider := &recordingProvider{objects: map[string][]byte{}}
+	target.Register(targetType, provider)
+
+	t.Cleanup(func() {
+		delete(providers, targetType)
+	})
+
+	return &Target{Type: targetType}, provider
+}
+
+func TestBackupVerifiesOnceForAllTargets(t *testing.T) {
+	addr, kvLists := fakeConsul(t, consul.KVPairs{
+		{Key: "a", Value: []byte("1"), CreateIndex: 5, ModifyIndex: 5},
+		{Key: "b/c", Value: []byte("2"), CreateIndex: 6, ModifyIndex: 6},
+	})
+
+	first, firstProvider := recordingTarget(t, "first")
+	second, secondProvider := recordingTarget(t, "second")
+
+	r, err := Backup(Config{
+		ConsulAddrs:        []string{addr},
+		AgentVersionPolicy: "ignore",
+		VerifyMode:         "inspect",
+		Targets:            []*Target{first, second},
+		TargetURIs:         []string{"first://", "second://"},
+		TargetQuorum:       2,
+	})
+
+	if err != nil {
+		t.Fatalf("error backing up: %s", err)
+	}
+
+	if r.SnapshotKeys != 2 {
+		t.Errorf("expected the snapshot's 2 keys to be verified, got %d", r.SnapshotKeys)
+	}
+
+	if lists := atomic.LoadInt32(kvLists); lists != 1 {
+		t.Errorf("expected the snapshot to be verified once for both targets, the live kv was listed %d times", lists)
+	}
+
+	for name, provider := range map[string]*recordingProvider{"first": firstProvider, "second": secondProvider} {
+		if _, ok := provider.objects[r.SnapshotKey]; !ok {
+			t.Errorf("expected the snapshot %s to be stored to the %s target, got %d objects", r.SnapshotKey, name, len(provider.objects))
+		}
+	}
+}
+
+func TestBackupReturnsFailedPhase(t *testing.T) {
+	addr, _ := fakeConsul(t, consul.KVPairs{{Key: "a", Value: []byte("1"), CreateIndex: 5, ModifyIndex: 5}})
+	failing, provider := recordingTarget(t, "failing")
+	provider.err = errors.New("access denied")
+
+	cfg := Config{
+		ConsulAddrs:  []string{addr},
+		VerifyMode:   "inspect",
+		Targets:      []*Target{failing},
+		TargetURIs:   []string{"failing://"},
+		TargetQuorum: 1,
+	}
+
+	r, err := Backup(cfg)
+
+	if err == nil || r.Status != "failure" || r.FailedPhase != "upload" || r.Error != err.Error() {
+		t.Errorf("expected the backup to fail uploading, got status %s, phase %s and error %v", r.Status, r.FailedPhase, err)
+	}
+
+	if len(r.FailedTargets) != 1 || r.FailedTargets[0] != "failing://" {
+		t.Errorf("expected the failing target to be recorded, got %v", r.FailedTargets)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cfg.Context = ctx
+
+	// Each backup starts a fresh result, rather than carrying on from the last.
+	cancelled, err := Backup(cfg)
+
+	if err == nil || cancelled == r || cancelled.FailedPhase != "snapshot" || len(cancelled.FailedTargets) != 0 {
+		t.Errorf("expected the cancelled backup to fail taking the snapshot with a fresh result, got phase %s, failed targets %v and error %v", cancelled.FailedPhase, cancelled.FailedTargets, err)
+	}
+}
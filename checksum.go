@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sha256Hex returns the hex encoded sha256 digest of the data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// toolVersion is the version of consul-backup recorded in snapshot manifests, set at build time with
+// -ldflags "-X main.toolVersion=v1.2.3".
+var toolVersion = "dev"
+
+// SnapshotManifest is stored as {key}.meta.json alongside each snapshot, describing where it came
+// from and recording its checksum and size as stored.
+type SnapshotManifest struct {
+	SHA256        string `json:"sha256"`
+	Size          int    `json:"size"`
+	ConsulVersion string `json:"consul_version,omitempty"`
+	Datacenter    string `json:"datacenter,omitempty"`
+	// Namespace and Partition are the consul enterprise namespace and partition the KV was
+	// verified or exported from, when set.
+	Namespace string `json:"namespace,omitempty"`
+	Partition string `json:"partition,omitempty"`
+	// KeyCount is only recorded when verification compared the snapshot's keys, or they were
+	// exported with --kv-prefix.
+	KeyCount    *int      `json:"key_count,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	ToolVersion string    `json:"tool_version"`
+	// KVPrefixes and ModifyIndex are recorded for exports with --kv-prefix, ModifyIndex being the
+	// highest ModifyIndex of the keys under the prefixes, which the next --incremental export
+	// carries on from.
+	KVPrefixes  []string `json:"kv_prefixes,omitempty"`
+	ModifyIndex uint64   `json:"modify_index,omitempty"`
+	// IncrementalSince is recorded for --incremental exports, which only hold the keys modified
+	// after it, to be imported after the full export IncrementalBase and those between them.
+	IncrementalSince uint64 `json:"incremental_since,omitempty"`
+	IncrementalBase  string `json:"incremental_base,omitempty"`
+}
+
+// sendSnapshotChecksum uploads the hex sha256 digest of the snapshot as stored, before any split,
+// to {key}.sha256 and the snapshot's manifest to {key}.meta.json, for auditing the integrity of
+// stored snapshots and checking them before use.
+func sendSnapshotChecksum(target *Target, snapshotKey string, digest string, size int) error {
+	if err := sendObject(target, snapshotKey+".sha256", []byte(digest+"\n")); err != nil {
+		return fmt.Errorf("error uploading snapshot checksum to %s: %s", target.Type, err)
+	}
+
+	manifest := SnapshotManifest{
+		SHA256:        digest,
+		Size:          size,
+		ConsulVersion: result.ConsulVersion,
+		Datacenter:    result.Datacenter,
+		Namespace:     consulNamespace,
+		Partition:     consulPartition,
+		Timestamp:     time.Now().UTC(),
+		ToolVersion:   toolVersion,
+	}
+
+	if result.KVModifyIndex > 0 {
+		manifest.KVPrefixes = result.KVPrefixes
+		manifest.ModifyIndex = result.KVModifyIndex
+		manifest.IncrementalSince = result.IncrementalSince
+		manifest.IncrementalBase = result.IncrementalBase
+	}
+
+	if taken, ok := snapshotTime(snapshotKey); ok {
+		manifest.Timestamp = taken.UTC()
+	}
+
+	// Keys are only counted when they're compared with the live cluster or exported.
+	if result.VerifyMode == "full" || result.VerifyMode == "inspect" || result.SnapshotKeys > 0 {
+		manifest.KeyCount = &result.SnapshotKeys
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if err := sendObject(target, snapshotKey+".meta.json", append(data, '\n')); err != nil {
+		return fmt.Errorf("error uploading snapshot manifest to %s: %s", target.Type, err)
+	}
+
+	return nil
+}
+
+// verifySnapshotChecksum checks the snapshot object against its {key}.meta.json manifest, or its
+// {key}.sha256 sidecar when it was stored before manifests were. Snapshots stored without either,
+// such as daily copies and those from before checksums were recorded, are used as they are.
+func verifySnapshotChecksum(source *Target, snapshot []byte) error {
+	snapshotKey := path.Base(source.Path)
+	manifestKey := snapshotKey + ".meta.json"
+	checksumKey := snapshotKey + ".sha256"
+
+	parent := *source
+	parent.Path = path.Dir(source.Path)
+
+	keys, err := providers[source.Type].List(&parent, snapshotKey+".")
+
+	if err != nil {
+		return fmt.Errorf("error looking for the checksum of snapshot %s: %s", snapshotKey, err)
+	}
+
+	found := map[string]bool{}
+
+	for _, key := range keys {
+		found[key] = true
+	}
+
+	sidecar := func(key string) ([]byte, error) {
+		sidecarSource := *source
+		sidecarSource.Path = path.Join(parent.Path, key)
+
+		return providers[source.Type].Get(&sidecarSource)
+	}
+
+	var expected string
+
+	switch {
+	case found[manifestKey]:
+		data, err := sidecar(manifestKey)
+
+		if err != nil {
+			return fmt.Errorf("error fetching the manifest of snapshot %s: %s", snapshotKey, err)
+		}
+
+		var manifest SnapshotManifest
+
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("error reading the manifest of snapshot %s: %s", snapshotKey, err)
+		}
+
+		if len(snapshot) != manifest.Size {
+			return fmt.Errorf("snapshot %s is %d bytes, but its manifest records %d", snapshotKey, len(snapshot), manifest.Size)
+		}
+
+		expected = manifest.SHA256
+	case found[checksumKey]:
+		data, err := sidecar(checksumKey)
+
+		if err != nil {
+			return fmt.Errorf("error fetching the checksum of snapshot %s: %s", snapshotKey, err)
+		}
+
+		expected = strings.TrimSpace(string(data))
+	default:
+		log.Warnf("snapshot %s has no checksum to verify against", snapshotKey)
+		return nil
+	}
+
+	if digest := sha256Hex(snapshot); digest != expected {
+		return fmt.Errorf("snapshot %s has sha256 %s, but its checksum is %s", snapshotKey, digest, expected)
+	}
+
+	log.Infof("verified snapshot %s against its checksum", snapshotKey)
+
+	return nil
+}
+
+// fetchSnapshotManifest returns the {key}.meta.json manifest of the snapshot, or nil when it was
+// stored without one.
+func fetchSnapshotManifest(source *Target) (*SnapshotManifest, error) {
+	snapshotKey := path.Base(source.Path)
+
+	parent := *source
+	parent.Path = path.Dir(source.Path)
+
+	keys, err := providers[source.Type].List(&parent, snapshotKey+".meta.json")
+
+	if err != nil {
+		return nil, fmt.Errorf("error looking for the manifest of snapshot %s: %s", snapshotKey, err)
+	}
+
+	for _, key := range keys {
+		if key != snapshotKey+".meta.json" {
+			continue
+		}
+
+		manifestSource := *source
+		manifestSource.Path = path.Join(parent.Path, key)
+
+		data, err := providers[source.Type].Get(&manifestSource)
+
+		if err != nil {
+			return nil, fmt.Errorf("error fetching the manifest of snapshot %s: %s", snapshotKey, err)
+		}
+
+		var manifest SnapshotManifest
+
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("error reading the manifest of snapshot %s: %s", snapshotKey, err)
+		}
+
+		return &manifest, nil
+	}
+
+	return nil, nil
+}
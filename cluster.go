@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// clusterConfigSidecars fetches the raft peer and autopilot configuration of the cluster as JSON,
+// keyed by the suffix they're stored under alongside the snapshot. Neither is readable from the
+// snapshot itself, but both are needed to rebuild the cluster topology during recovery.
+func clusterConfigSidecars(client *consul.Client) (map[string][]byte, error) {
+	raftConfig, err := client.Operator().RaftGetConfiguration(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch raft configuration: %s", err)
+	}
+
+	autopilotConfig, err := client.Operator().AutopilotGetConfiguration(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch autopilot configuration: %s", err)
+	}
+
+	sidecars := map[string][]byte{}
+
+	for suffix, config := range map[string]interface{}{"raft.json": raftConfig, "autopilot.json": autopilotConfig} {
+		data, err := json.MarshalIndent(config, "", "  ")
+
+		if err != nil {
+			return nil, err
+		}
+
+		sidecars[suffix] = data
+	}
+
+	return sidecars, nil
+}
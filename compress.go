@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdDictMagic starts every zstd dictionary, followed by its little endian id.
+const zstdDictMagic = 0xEC30A437
+
+// compressionDict is the zstd dictionary snapshots are compressed with before upload, as
+// {key}.zst, when set. Snapshots are gzip archives, which hide the similarity between consecutive
+// snapshots, so the gzip layer is removed and added back again on fetch.
+var compressionDict []byte
+
+// compression is how snapshots are compressed before upload, either zstd, stored as {key}.zst, or
+// gzip, stored as {key}.gz, when set. Snapshots are already gzip archives, so gzip recompresses
+// them at the best level, leaving a snapshot consul can restore as it is.
+var compression string
+
+// compressionDictID identifies the compression dictionary, recorded with each snapshot so it's
+// known which dictionary is needed to decompress it.
+var compressionDictID uint32
+
+// setCompression configures compression from a --compress value, either zstd, gzip or none. A
+// compression dictionary implies zstd.
+func setCompression(value string) error {
+	switch value {
+	case "", "none":
+		if compressionDict != nil && value == "none" {
+			return fmt.Errorf("--compress-dict compresses with zstd, so can't be combined with --compress none")
+		}
+	case "zstd":
+		compression = value
+	case "gzip":
+		if compressionDict != nil {
+			return fmt.Errorf("--compress-dict compresses with zstd, so can't be combined with --compress gzip")
+		}
+
+		compression = value
+	default:
+		return fmt.Errorf("invalid compress '%s', expected zstd, gzip or none", value)
+	}
+
+	return nil
+}
+
+// compressionExtension returns the suffix of compressed snapshot keys.
+func compressionExtension() string {
+	if compression == "gzip" {
+		return ".gz"
+	}
+
+	return ".zst"
+}
+
+// setCompressionDict loads a zstd dictionary, as trained by zstd --train on earlier uncompressed
+// snapshots, from the path when given.
+func setCompressionDict(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	dict, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return fmt.Errorf("error reading compression dictionary: %s", err)
+	}
+
+	if len(dict) < 8 || binary.LittleEndian.Uint32(dict) != zstdDictMagic {
+		return fmt.Errorf("compression dictionary %s is not a zstd dictionary", path)
+	}
+
+	compressionDict = dict
+	compressionDictID = binary.LittleEndian.Uint32(dict[4:])
+	compression = "zstd"
+
+	return nil
+}
+
+// compressionMetadata records how a snapshot was compressed, and with which dictionary, for
+// providers to store on the snapshot object.
+func compressionMetadata() map[string]string {
+	if compression == "" {
+		return nil
+	}
+
+	metadata := map[string]string{
+		"compression": compression,
+	}
+
+	if compressionDict != nil {
+		metadata["compression-dict"] = strconv.FormatUint(uint64(compressionDictID), 10)
+	}
+
+	return metadata
+}
+
+// compressSnapshot replaces the gzip compression of the snapshot with zstd, using the dictionary
+// when given, or recompresses it with gzip at the best level.
+func compressSnapshot(snapshot []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(snapshot))
+
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := ioutil.ReadAll(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if compression == "gzip" {
+		var compressed bytes.Buffer
+		writer, err := gzip.NewWriterLevel(&compressed, gzip.BestCompression)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := writer.Write(archive); err != nil {
+			return nil, err
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		return compressed.Bytes(), nil
+	}
+
+	options := []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedDefault)}
+
+	if compressionDict != nil {
+		options = append(options, zstd.WithEncoderDict(compressionDict))
+	}
+
+	encoder, err := zstd.NewWriter(nil, options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return encoder.EncodeAll(archive, nil), nil
+}
+
+// decompressSnapshot turns a snapshot compressed with zstd, with or without the dictionary, back
+// into the gzip archive consul expects. The archive's own checksums are of its contents, so they
+// still hold.
+func decompressSnapshot(data []byte) ([]byte, error) {
+	var options []zstd.DOption
+
+	if compressionDict != nil {
+		options = append(options, zstd.WithDecoderDicts(compressionDict))
+	}
+
+	decoder, err := zstd.NewReader(nil, options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer decoder.Close()
+
+	archive, err := decoder.DecodeAll(data, nil)
+
+	if err != nil && compressionDict == nil {
+		return nil, fmt.Errorf("error decompressing snapshot, it may need the compression dictionary it was compressed with: %s", err)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing snapshot, check it was compressed with dictionary %d: %s", compressionDictID, err)
+	}
+
+	var snapshot bytes.Buffer
+	writer := gzip.NewWriter(&snapshot)
+
+	if _, err := writer.Write(archive); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return snapshot.Bytes(), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// defaultConfigFile is the name of the config file read from the working directory, or else the
+// home directory, when --config isn't given.
+const defaultConfigFile = ".consul-backup.yaml"
+
+// flagEnvVars are the environment variables flags default to when not given.
+var flagEnvVars = map[string]string{
+	"consul-addr":            "CONSUL_ADDR",
+	"consul-ca-file":         "CONSUL_CACERT",
+	"consul-client-cert":     "CONSUL_CLIENT_CERT",
+	"consul-client-key":      "CONSUL_CLIENT_KEY",
+	"consul-tls-server-name": "CONSUL_TLS_SERVER_NAME",
+	"consul-http-auth":       "CONSUL_HTTP_AUTH",
+	"consul-token":           "CONSUL_HTTP_TOKEN",
+	"consul-token-file":      "CONSUL_HTTP_TOKEN_FILE",
+	"consul-namespace":       "CONSUL_NAMESPACE",
+	"consul-partition":       "CONSUL_PARTITION",
+	"target":                 "TARGET_URI",
+	"encryption-key":         "ENCRYPTION_KEY",
+	"sftp-key":               "SFTP_KEY_PATH",
+	"sftp-known-hosts":       "SFTP_KNOWN_HOSTS",
+	"cloudwatch-region":      "AWS_REGION",
+	"pagerduty-routing-key":  "PAGERDUTY_ROUTING_KEY",
+	"no-color":               "NO_COLOR",
+}
+
+// findConfigFile returns the path of the default config file in the working directory, or else the
+// home directory, or "" when neither has one.
+func findConfigFile() string {
+	var dirs []string
+
+	if dir, err := os.Getwd(); err == nil {
+		dirs = append(dirs, dir)
+	}
+
+	if dir, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, dir)
+	}
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, defaultConfigFile)
+
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// loadConfigFile sets the flags that weren't given on the command line from a yaml config file,
+// whose settings are named after the flags, eg consul-addr: http://consul:8500. Settings for flags
+// that can be given multiple times, such as target, take a list. With envOverrides, as for the
+// default config file, the environment variables flags default to override the file too.
+func loadConfigFile(flags *flag.FlagSet, path string, envOverrides bool) error {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return fmt.Errorf("error reading config file: %s", err)
+	}
+
+	settings := map[string]interface{}{}
+
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("error parsing config file %s: %s", path, err)
+	}
+
+	given := map[string]bool{}
+
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for name, value := range settings {
+		if flags.Lookup(name) == nil || name == "config" || name == "no-config-file" {
+			return fmt.Errorf("unknown setting '%s' in config file %s", name, path)
+		}
+
+		// Flags on the command line override the file.
+		if given[name] {
+			continue
+		}
+
+		if env, ok := flagEnvVars[name]; ok && envOverrides && os.Getenv(env) != "" {
+			continue
+		}
+
+		values, ok := value.([]interface{})
+
+		if !ok {
+			values = []interface{}{value}
+		}
+
+		for _, v := range values {
+			if _, ok := v.(map[interface{}]interface{}); ok {
+				return fmt.Errorf("invalid setting '%s' in config file %s, expected a value or list of values", name, path)
+			}
+
+			if err := flags.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("invalid setting '%s' in config file %s: %s", name, path, err)
+			}
+		}
+	}
+
+	return nil
+}
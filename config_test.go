@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), defaultConfigFile)
+	config := "consul-addr: http://file:8500\nconsul-token: from-file\nretain: 3\ntarget:\n  - s3://a/b\n  - file:///c\n"
+
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Setenv("CONSUL_HTTP_TOKEN", os.Getenv("CONSUL_HTTP_TOKEN"))
+	os.Setenv("CONSUL_HTTP_TOKEN", "from-env")
+
+	for _, envOverrides := range []bool{false, true} {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		consulAddr := flags.String("consul-addr", "", "")
+		consulToken := flags.String("consul-token", "", "")
+		retain := flags.Int("retain", 0, "")
+		var targets stringsFlag
+		flags.Var(&targets, "target", "")
+
+		if err := flags.Parse([]string{"-retain", "5"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := loadConfigFile(flags, path, envOverrides); err != nil {
+			t.Fatalf("error loading config file: %s", err)
+		}
+
+		if *consulAddr != "http://file:8500" || *retain != 5 || len(targets) != 2 {
+			t.Errorf("expected the file's settings apart from those on the command line, got consul-addr %s, retain %d and targets %v", *consulAddr, *retain, targets)
+		}
+
+		// The token is left for the environment to give when it overrides the file.
+		if expected := map[bool]string{false: "from-file", true: ""}[envOverrides]; *consulToken != expected {
+			t.Errorf("expected the consul-token '%s' with envOverrides %t, got '%s'", expected, envOverrides, *consulToken)
+		}
+	}
+}
+
+func TestFindConfigFile(t *testing.T) {
+	workDir, homeDir := t.TempDir(), t.TempDir()
+
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", homeDir)
+
+	wd, err := os.Getwd()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Chdir(wd)
+
+	if err := os.Chdir(workDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if path := findConfigFile(); path != "" {
+		t.Errorf("expected no config file, got %s", path)
+	}
+
+	for _, dir := range []string{homeDir, workDir} {
+		if err := ioutil.WriteFile(filepath.Join(dir, defaultConfigFile), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// The working directory's file is preferred to the home directory's.
+		if path := findConfigFile(); path != filepath.Join(dir, defaultConfigFile) {
+			t.Errorf("expected the config file in %s, got %s", dir, path)
+		}
+	}
+}
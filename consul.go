@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	osuser "os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	version "github.com/hashicorp/go-version"
+	log "github.com/sirupsen/logrus"
+)
+
+// consulToken is the acl token to use with the live cluster, overriding CONSUL_HTTP_TOKEN when set.
+var consulToken string
+
+// consulTokenFile is the path of a file holding the acl token to use with the live cluster, eg
+// written by vault agent, overriding CONSUL_HTTP_TOKEN_FILE when set.
+var consulTokenFile string
+
+// consulDatacenter is the datacenter of the live cluster to use, rather than that of the agent the
+// client connects to, when set.
+var consulDatacenter string
+
+// consulCAFile is the path of a ca certificate to verify the live cluster's certificate with,
+// overriding CONSUL_CACERT when set.
+var consulCAFile string
+
+// consulClientCert and consulClientKey are the paths of the certificate and key to authenticate to
+// the live cluster with when it requires mutual tls, overriding CONSUL_CLIENT_CERT and
+// CONSUL_CLIENT_KEY when set.
+var consulClientCert string
+var consulClientKey string
+
+// consulTLSServerName is the name to verify the live cluster's certificate against, rather than the
+// host of its address, overriding CONSUL_TLS_SERVER_NAME when set.
+var consulTLSServerName string
+
+// consulHTTPAuth is the user:pass to authenticate to the live cluster with using http basic auth,
+// overriding CONSUL_HTTP_AUTH when set.
+var consulHTTPAuth string
+
+// consulNamespace and consulPartition are the consul enterprise namespace and admin partition of
+// the live cluster to use, rather than the token's defaults, when set.
+var consulNamespace string
+var consulPartition string
+
+// defaultConsulScope defaults the namespace and partition to CONSUL_NAMESPACE and CONSUL_PARTITION,
+// as with the consul cli.
+func defaultConsulScope() {
+	if consulNamespace == "" {
+		consulNamespace = os.Getenv("CONSUL_NAMESPACE")
+	}
+
+	if consulPartition == "" {
+		consulPartition = os.Getenv("CONSUL_PARTITION")
+	}
+}
+
+// consulTransport adds the namespace and partition to each request's query, as the api client
+// predates both so requests can't otherwise carry them. Requests made without a context are made
+// with runContext, so they're cancelled with the run.
+type consulTransport struct {
+	base      http.RoundTripper
+	namespace string
+	partition string
+}
+
+func (t *consulTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context() == context.Background() {
+		req = req.WithContext(runContext)
+	}
+
+	scoped := *req
+	u := *req.URL
+	scoped.URL = &u
+
+	query := u.Query()
+
+	if t.namespace != "" && query.Get("ns") == "" {
+		query.Set("ns", t.namespace)
+	}
+
+	if t.partition != "" && query.Get("partition") == "" {
+		query.Set("partition", t.partition)
+	}
+
+	u.RawQuery = query.Encode()
+
+	return t.base.RoundTrip(&scoped)
+}
+
+// validateConsulConnection checks the token file, ca file, client certificate and http auth of the live cluster's connection, so
+// mistakes in them are reported at startup rather than as connection failures.
+func validateConsulConnection() error {
+	if consulToken != "" && consulTokenFile != "" {
+		return fmt.Errorf("--consul-token and --consul-token-file can't be used together")
+	}
+
+	if consulTokenFile != "" {
+		token, err := ioutil.ReadFile(consulTokenFile)
+
+		if err != nil {
+			return fmt.Errorf("error reading consul token file: %s", err)
+		}
+
+		if strings.TrimSpace(string(token)) == "" {
+			return fmt.Errorf("consul token file %s is empty", consulTokenFile)
+		}
+	}
+
+	if consulCAFile != "" {
+		pem, err := ioutil.ReadFile(consulCAFile)
+
+		if err != nil {
+			return fmt.Errorf("error reading consul ca file: %s", err)
+		}
+
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return fmt.Errorf("consul ca file %s contains no pem encoded certificates", consulCAFile)
+		}
+	}
+
+	if consulClientCert != "" || consulClientKey != "" {
+		config := consul.DefaultConfig()
+
+		if consulClientCert != "" {
+			config.TLSConfig.CertFile = consulClientCert
+		}
+
+		if consulClientKey != "" {
+			config.TLSConfig.KeyFile = consulClientKey
+		}
+
+		if config.TLSConfig.CertFile == "" || config.TLSConfig.KeyFile == "" {
+			return fmt.Errorf("a consul client certificate needs both --consul-client-cert and --consul-client-key")
+		}
+
+		if _, err := tls.LoadX509KeyPair(config.TLSConfig.CertFile, config.TLSConfig.KeyFile); err != nil {
+			return fmt.Errorf("error loading consul client certificate: %s", err)
+		}
+	}
+
+	if consulHTTPAuth != "" && !strings.Contains(consulHTTPAuth, ":") {
+		return fmt.Errorf("invalid consul http auth, expected user:pass")
+	}
+
+	return nil
+}
+
+// newConsulClient creates a client for the live cluster. The config starts from the consul api
+// defaults so the standard CONSUL_CACERT, CONSUL_CAPATH, CONSUL_CLIENT_CERT, CONSUL_CLIENT_KEY,
+// CONSUL_TLS_SERVER_NAME, CONSUL_HTTP_AUTH and CONSUL_HTTP_SSL_VERIFY env vars apply, just like the
+// consul cli.
+func newConsulClient(addr string, tlsSkipVerify bool) (*consul.Client, error) {
+	config := consul.DefaultConfig()
+	config.Address = addr
+
+	// The api reads the token file over any token, so the file from the env is dropped when a token
+	// is given.
+	if consulToken != "" {
+		config.Token = consulToken
+		config.TokenFile = ""
+	} else if consulTokenFile != "" {
+		config.TokenFile = consulTokenFile
+	}
+
+	config.Datacenter = consulDatacenter
+
+	if consulHTTPAuth != "" {
+		parts := strings.SplitN(consulHTTPAuth, ":", 2)
+		config.HttpAuth = &consul.HttpBasicAuth{Username: parts[0], Password: parts[1]}
+	}
+
+	// A ca to verify the server with takes precedence over skipping verification.
+	if consulCAFile != "" {
+		config.TLSConfig.CAFile = consulCAFile
+		config.TLSConfig.CAPath = ""
+		config.TLSConfig.InsecureSkipVerify = false
+	} else if tlsSkipVerify {
+		config.TLSConfig.InsecureSkipVerify = true
+	}
+
+	if consulClientCert != "" {
+		config.TLSConfig.CertFile = consulClientCert
+	}
+
+	if consulClientKey != "" {
+		config.TLSConfig.KeyFile = consulClientKey
+	}
+
+	if consulTLSServerName != "" {
+		config.TLSConfig.Address = consulTLSServerName
+	}
+
+	httpClient, err := consul.NewHttpClient(config.Transport, config.TLSConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient.Transport = &consulTransport{base: httpClient.Transport, namespace: consulNamespace, partition: consulPartition}
+	config.HttpClient = httpClient
+
+	return consul.NewClient(config)
+}
+
+// consulAddrURL validates the address of a consul agent, returning it with its scheme. Addresses
+// without one use https when CONSUL_HTTP_SSL is true and http otherwise, as with the consul cli.
+func consulAddrURL(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+
+	if !strings.Contains(addr, "://") {
+		scheme := "http"
+
+		if ssl, _ := strconv.ParseBool(os.Getenv("CONSUL_HTTP_SSL")); ssl {
+			scheme = "https"
+		}
+
+		addr = scheme + "://" + addr
+	}
+
+	parsedConsulAddr, err := url.ParseRequestURI(addr)
+
+	if err != nil || parsedConsulAddr.Hostname() == "" {
+		return "", fmt.Errorf("provided consul url is invalid, got '%s'", addr)
+	}
+
+	return addr, nil
+}
+
+// waitForConsul waits for the agent the client is connected to to accept requests and know of a
+// leader, retrying up to the given number of times.
+func waitForConsul(client *consul.Client, retries int, delay time.Duration) error {
+	return retry("waiting for consul", retries, delay, func() error {
+		_, err := client.Status().Leader()
+		return err
+	})
+}
+
+// isLeader reports whether the agent the client is connected to is the current raft leader.
+func isLeader(client *consul.Client) (bool, error) {
+	leader, err := client.Status().Leader()
+
+	if err != nil {
+		return false, err
+	}
+
+	self, err := client.Agent().Self()
+
+	if err != nil {
+		return false, err
+	}
+
+	addr, _ := self["Member"]["Addr"].(string)
+	tags, _ := self["Member"]["Tags"].(map[string]interface{})
+	port, isServer := tags["port"].(string)
+
+	if addr == "" {
+		return false, fmt.Errorf("agent did not report its member address")
+	}
+
+	// Only servers advertise a raft port, a client agent can never be the leader.
+	if !isServer {
+		return false, nil
+	}
+
+	return leader == net.JoinHostPort(addr, port), nil
+}
+
+// consulVersion returns the consul version of the agent the client is connected to.
+func consulVersion(client *consul.Client) (*version.Version, error) {
+	self, err := client.Agent().Self()
+
+	if err != nil {
+		return nil, err
+	}
+
+	v, _ := self["Config"]["Version"].(string)
+
+	return version.NewVersion(v)
+}
+
+// consulClusterInfo returns the version of the consul agent and the datacenter snapshots are taken
+// from, which is the one given with --consul-datacenter or otherwise the agent's own.
+func consulClusterInfo(client *consul.Client) (string, string, error) {
+	self, err := client.Agent().Self()
+
+	if err != nil {
+		return "", "", err
+	}
+
+	v, _ := self["Config"]["Version"].(string)
+	datacenter, _ := self["Config"]["Datacenter"].(string)
+
+	if consulDatacenter != "" {
+		datacenter = consulDatacenter
+	}
+
+	return v, datacenter, nil
+}
+
+// isPermissionDenied reports whether a consul api error is a 403. The api only surfaces the
+// status code within the error message, so that's what is matched on.
+func isPermissionDenied(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Unexpected response code: 403")
+}
+
+// isRetryableConsulError reports whether a request to consul failing with the error could succeed if
+// retried, which is when it's throttled, a server error or didn't get a response.
+func isRetryableConsulError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	// The api client only reports the status code in the message.
+	message := err.Error()
+
+	return strings.Contains(message, "Unexpected response code: 5") || strings.Contains(message, "Unexpected response code: 429") || strings.Contains(message, "EOF")
+}
+
+// configuredToken describes where the consul token in use comes from, without revealing it.
+func configuredToken() string {
+	config := consul.DefaultConfig()
+
+	switch {
+	case consulToken != "":
+		return "the token given with --consul-token"
+	case consulTokenFile != "":
+		return fmt.Sprintf("the token in --consul-token-file (%s)", consulTokenFile)
+	case config.TokenFile != "":
+		return fmt.Sprintf("the token in CONSUL_HTTP_TOKEN_FILE (%s)", config.TokenFile)
+	case config.Token != "":
+		return "the token in CONSUL_HTTP_TOKEN"
+	default:
+		return "no token, so the agent's default token"
+	}
+}
+
+// auditEvent is the payload of the user event fired after a backup.
+type auditEvent struct {
+	Host          string `json:"host"`
+	User          string `json:"user"`
+	Target        string `json:"target"`
+	SnapshotKey   string `json:"snapshot_key"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+	Time          string `json:"time"`
+}
+
+// recordAuditEvent fires a user event attributing the backup to this host and user. Failing to
+// record it is logged rather than failing a backup that has already been stored.
+func recordAuditEvent(client *consul.Client, name string, snapshotIndex uint64) {
+	host, _ := os.Hostname()
+	user := os.Getenv("USER")
+
+	if current, err := osuser.Current(); err == nil {
+		user = current.Username
+	}
+
+	payload, err := json.Marshal(auditEvent{
+		Host:          host,
+		User:          user,
+		Target:        result.Target,
+		SnapshotKey:   result.SnapshotKey,
+		SnapshotIndex: snapshotIndex,
+		Time:          time.Now().UTC().Format(time.RFC3339),
+	})
+
+	if err != nil {
+		log.Warnf("error encoding audit event: %s", err)
+		return
+	}
+
+	id, _, err := client.Event().Fire(&consul.UserEvent{Name: name, Payload: payload}, nil)
+
+	if err != nil {
+		log.Warnf("error firing audit event %s: %s", name, err)
+		return
+	}
+
+	log.Infof("fired audit event %s with id %s", name, id)
+}
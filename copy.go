@@ -0,0 +1,257 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"consul_backup_tool/pkg/target"
+	log "github.com/sirupsen/logrus"
+)
+
+// runCopy replicates the snapshots stored in one target to another, along with their sidecar
+// objects such as manifests and signatures, for keeping offsite copies. Each snapshot is checked
+// against its checksum before it's copied, and the copy against the original once it's stored.
+func runCopy(args []string) {
+	flags := flag.NewFlagSet("copy", flag.ExitOnError)
+	fromURI := flags.String("from", "", "The target to copy the snapshots of, eg s3://primary-bucket/consul-snapshots.")
+	toURI := flags.String("to", "", "The target to copy the snapshots to, eg gcs://dr-bucket/consul-snapshots.")
+	since := flags.Duration("since", 0, "Only copy snapshots taken within this long, eg 168h. 0 copies them all.")
+	dryRun := flags.Bool("dry-run", false, "Only log the snapshots that would be copied.")
+	nameTemplateText := flags.String("name-template", defaultNameTemplate, "The --name-template the snapshots were stored with, for finding them under the target.")
+	uploadBandwidthLimit := flags.String("upload-bandwidth-limit", "", "Limit the rate the copies are uploaded at, eg 10MiB/s, 500KB/s or a number of bytes per second. Empty means no limit.")
+	flags.BoolVar(&target.S3CreateBucket, "create-bucket", false, "Create the s3 bucket copied to in the configured region if it doesn't exist.")
+	flags.StringVar(&target.SFTPKeyPath, "sftp-key", "", "Private key to authenticate to sftp targets with. Defaults to SFTP_KEY_PATH, with SFTP_KEY_PASSPHRASE unlocking an encrypted key.")
+	flags.StringVar(&target.SFTPKnownHosts, "sftp-known-hosts", "", "known_hosts file to verify the host keys of sftp targets against. Defaults to SFTP_KNOWN_HOSTS, then ~/.ssh/known_hosts.")
+	flags.DurationVar(&target.Timeout, "target-timeout", 0, "Maximum time to allow for each upload to the target copied to. 0 means no limit.")
+	flags.IntVar(&target.Retries, "upload-retries", 3, "How many times to retry a failed upload to the target copied to. Errors retrying can't fix, such as access denied or a missing bucket, fail straight away.")
+	flags.DurationVar(&target.Backoff, "upload-backoff", time.Second*5, "How long to wait before the first upload retry, doubling for each retry after it, with jitter.")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s copy --from {target_uri} --to {target_uri} [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if *fromURI == "" || *toURI == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := parseNameTemplate(*nameTemplateText); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setUploadBandwidthLimit(*uploadBandwidthLimit); err != nil {
+		fatalf("%s", err)
+	}
+
+	var targets []*Target
+
+	for _, uri := range []string{*fromURI, *toURI} {
+		target, err := parseTarget(uri)
+
+		if err != nil {
+			fatalf("%s", err)
+		}
+
+		if err := validateTarget(target); err != nil {
+			fatalf("%s", err)
+		}
+
+		targets = append(targets, target)
+	}
+
+	from, to := targets[0], targets[1]
+
+	if from.Type == to.Type && from.Base == to.Base && strings.Trim(from.Path, "/") == strings.Trim(to.Path, "/") {
+		fatalf("--from and --to are the same target")
+	}
+
+	// The bucket is listed for what's already copied before anything is uploaded to create it.
+	if to.Type == "s3" && target.S3CreateBucket {
+		if err := target.EnsureS3Bucket(to); err != nil {
+			fatalf("%s", err)
+		}
+	}
+
+	copied, skipped, failed, err := copySnapshots(from, to, *since, *dryRun)
+
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	if *dryRun {
+		log.Infof("would copy %d snapshots, %d already copied", copied, skipped)
+		return
+	}
+
+	log.Infof("copied %d snapshots, %d already copied", copied, skipped)
+
+	if len(failed) > 0 {
+		fatalf("failed to copy %d snapshots: %s", len(failed), strings.Join(failed, ", "))
+	}
+}
+
+// copySnapshots copies the snapshots taken within since, or all of them when it's 0, that aren't
+// already stored in full in the target copied to, returning how many were copied and skipped and
+// the keys of those that failed. A snapshot failing to copy doesn't stop the others being copied.
+func copySnapshots(from *Target, to *Target, since time.Duration, dryRun bool) (int, int, []string, error) {
+	snapshots, err := listStoredSnapshots(from)
+
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("error listing snapshots to copy: %s", err)
+	}
+
+	fromObjects, err := providers[from.Type].Stat(from)
+
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("error listing objects to copy: %s", err)
+	}
+
+	toObjects, err := providers[to.Type].Stat(to)
+
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("error listing objects already copied: %s", err)
+	}
+
+	stored := map[string]int64{}
+
+	for _, object := range toObjects {
+		stored[object.Key] = object.Size
+	}
+
+	copied, skipped := 0, 0
+	var failed []string
+
+	// Oldest first, so an interrupted copy leaves the destination without gaps in between.
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := snapshots[i]
+
+		if since > 0 && time.Since(snapshot.Timestamp) > since {
+			continue
+		}
+
+		objects := snapshotObjects(snapshot.Key, fromObjects)
+		complete := true
+
+		for _, object := range objects {
+			if size, ok := stored[object.Key]; !ok || size != object.Size {
+				complete = false
+			}
+		}
+
+		if complete {
+			log.Debugf("snapshot %s already copied", snapshot.Key)
+			skipped++
+			continue
+		}
+
+		if dryRun {
+			log.Infof("would copy snapshot %s, %d objects", snapshot.Key, len(objects))
+			copied++
+			continue
+		}
+
+		if err := copySnapshot(from, to, snapshot.Key, objects); err != nil {
+			log.Errorf("error copying snapshot %s: %s", snapshot.Key, err)
+			failed = append(failed, snapshot.Key)
+			continue
+		}
+
+		copied++
+	}
+
+	return copied, skipped, failed, nil
+}
+
+// snapshotObjects returns the objects stored for the snapshot, its parts when split and its
+// sidecars, with the parts first, then the snapshot, then the sidecars. Copying them in that order
+// means the copy's manifest and checksum are only stored once the snapshot they describe is.
+func snapshotObjects(snapshotKey string, objects []objectInfo) []objectInfo {
+	var found []objectInfo
+
+	for _, object := range objects {
+		if object.Key == snapshotKey || strings.HasPrefix(object.Key, snapshotKey+".") {
+			found = append(found, object)
+		}
+	}
+
+	rank := func(key string) int {
+		switch {
+		case strings.HasPrefix(key, snapshotKey+".part"):
+			return 0
+		case key == snapshotKey:
+			return 1
+		default:
+			return 2
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		if rank(found[i].Key) != rank(found[j].Key) {
+			return rank(found[i].Key) < rank(found[j].Key)
+		}
+
+		return found[i].Key < found[j].Key
+	})
+
+	return found
+}
+
+// copySnapshot copies the objects of the snapshot as they're stored, after checking the snapshot
+// against its checksum, then checks the copy matches the original.
+func copySnapshot(from *Target, to *Target, snapshotKey string, objects []objectInfo) error {
+	source := *from
+	source.Path = path.Join(from.Path, snapshotKey)
+
+	snapshot, err := fetchSnapshotObject(&source)
+
+	if err != nil {
+		return err
+	}
+
+	// A corrupt snapshot is better left out than replicated as if it were sound.
+	if err := verifySnapshotChecksum(&source, snapshot); err != nil {
+		return err
+	}
+
+	digest := sha256Hex(snapshot)
+
+	for _, object := range objects {
+		objectSource := *from
+		objectSource.Path = path.Join(from.Path, object.Key)
+
+		data, err := providers[from.Type].Get(&objectSource)
+
+		if err != nil {
+			return fmt.Errorf("error fetching %s: %s", object.Key, err)
+		}
+
+		if err := providers[to.Type].Put(to, object.Key, data); err != nil {
+			return fmt.Errorf("error storing %s: %s", object.Key, err)
+		}
+	}
+
+	copySource := *to
+	copySource.Path = path.Join(to.Path, snapshotKey)
+
+	copied, err := fetchSnapshotObject(&copySource)
+
+	if err != nil {
+		return fmt.Errorf("error fetching the copy to check it: %s", err)
+	}
+
+	if copiedDigest := sha256Hex(copied); copiedDigest != digest {
+		return fmt.Errorf("the copy has sha256 %s, but the original has %s", copiedDigest, digest)
+	}
+
+	log.Infof("copied snapshot %s, %d objects, checked against sha256 %s", snapshotKey, len(objects), digest)
+
+	return nil
+}
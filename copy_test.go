@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopySnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-backup-copy")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"from", "to"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	recent := fmt.Sprintf("%d.snap", now.Add(-time.Hour).Unix())
+	old := fmt.Sprintf("%d.snap", now.Add(-time.Hour*48).Unix())
+	snapshot := []byte("snapshot")
+
+	for name, data := range map[string][]byte{
+		recent:             snapshot,
+		recent + ".sha256": []byte(sha256Hex(snapshot)),
+		recent + ".sig":    []byte("signature"),
+		old:                snapshot,
+		old + ".sha256":    []byte(sha256Hex([]byte("another snapshot"))),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "from", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from, _ := parseTarget("file://" + filepath.Join(dir, "from"))
+	to, _ := parseTarget("file://" + filepath.Join(dir, "to"))
+
+	if copied, _, _, err := copySnapshots(from, to, 0, true); err != nil || copied != 2 {
+		t.Errorf("expected a dry run to count 2 snapshots to copy, got %d and %v", copied, err)
+	}
+
+	if copied, skipped, _, _ := copySnapshots(from, to, time.Hour*24, false); copied != 1 || skipped != 0 {
+		t.Errorf("expected only the snapshot taken within a day to be copied, got %d copied and %d skipped", copied, skipped)
+	}
+
+	for _, name := range []string{recent, recent + ".sha256", recent + ".sig"} {
+		if _, err := os.Stat(filepath.Join(dir, "to", name)); err != nil {
+			t.Errorf("expected %s to be copied, got %s", name, err)
+		}
+	}
+
+	copied, skipped, failed, err := copySnapshots(from, to, 0, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if copied != 0 || skipped != 1 {
+		t.Errorf("expected the snapshot already copied to be skipped, got %d copied and %d skipped", copied, skipped)
+	}
+
+	if strings.Join(failed, ",") != old {
+		t.Errorf("expected the snapshot not matching its checksum to fail, got %v", failed)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "to", old)); !os.IsNotExist(err) {
+		t.Errorf("expected the snapshot not matching its checksum not to be copied, got %v", err)
+	}
+}
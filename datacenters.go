@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"consul_backup_tool/pkg/target"
+	log "github.com/sirupsen/logrus"
+)
+
+// listDatacenters returns the datacenters known to the cluster, its own and those joined over the
+// wan, trying each of the addresses in turn.
+func listDatacenters(consulAddrs []string, tlsSkipVerify bool) ([]string, error) {
+	var lastErr error
+
+	for _, addr := range consulAddrs {
+		client, err := newConsulClient(addr, tlsSkipVerify)
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		datacenters, err := client.Catalog().Datacenters()
+
+		if err != nil {
+			log.Warnf("error listing datacenters from %s: %s", addr, err)
+			lastErr = err
+			continue
+		}
+
+		return datacenters, nil
+	}
+
+	return nil, lastErr
+}
+
+// subTargetURI returns the target uri with the directory appended to its path, eg so each
+// datacenter's snapshots are stored under {prefix}/{dc}/.
+func subTargetURI(uri string, dir string) string {
+	query := ""
+
+	if i := strings.Index(uri, "?"); i >= 0 {
+		uri, query = uri[:i], uri[i:]
+	}
+
+	return strings.TrimRight(uri, "/") + "/" + dir + query
+}
+
+// runDatacenterBackups backs up each of the datacenters at once, each in a child process with the
+// same arguments, pointed at the datacenter with --consul-datacenter and at {target}/{dc} for each
+// target. The children leave notifying to this process, which reports on them all together.
+func runDatacenterBackups(datacenters []string, uris []string) error {
+	executable, err := os.Executable()
+
+	if err != nil {
+		return fmt.Errorf("error finding executable for datacenter backups: %s", err)
+	}
+
+	args := withoutArgs(os.Args[1:], "all-datacenters", "datacenter", "consul-datacenter", "target", "result-file", "metrics-addr", "health-addr", "webhook-url", "notify-url", "slack-webhook-url", "pagerduty-routing-key", "pushgateway-url", "cloudwatch-namespace", "upload-bandwidth-limit")
+
+	// Clearing them explicitly stops a config file giving them to the children too.
+	args = append(args, "-all-datacenters=false", "-datacenter=", "-metrics-addr=", "-health-addr=", "-webhook-url=", "-notify-url=", "-slack-webhook-url=", "-pagerduty-routing-key=", "-pushgateway-url=", "-cloudwatch-namespace=", "-upload-bandwidth-limit=")
+
+	// The datacenters are backed up at once, so they share the bandwidth limit between them.
+	if limit := target.BandwidthLimit(); limit > 0 {
+		share := limit / int64(len(datacenters))
+
+		if share < 1 {
+			share = 1
+		}
+
+		args = append(args, fmt.Sprintf("-upload-bandwidth-limit=%d", share))
+	}
+
+	var env []string
+
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "PAGERDUTY_ROUTING_KEY=") && !strings.HasPrefix(v, "TRACEPARENT=") {
+			env = append(env, v)
+		}
+	}
+
+	// Each datacenter's backup is traced as part of this run.
+	if parent := traceParent(); parent != "" {
+		env = append(env, "TRACEPARENT="+parent)
+	}
+
+	results := make([]*RunResult, len(datacenters))
+	var wg sync.WaitGroup
+
+	for i, datacenter := range datacenters {
+		dcArgs := append(append([]string{}, args...), "-consul-datacenter="+datacenter)
+
+		for _, uri := range uris {
+			dcArgs = append(dcArgs, "-target="+subTargetURI(uri, datacenter))
+		}
+
+		file, err := ioutil.TempFile("", "consul-backup-result")
+
+		if err != nil {
+			return fmt.Errorf("error creating result file for datacenter backups: %s", err)
+		}
+
+		file.Close()
+		defer os.Remove(file.Name())
+
+		dcArgs = append(dcArgs, "-result-file", file.Name())
+
+		wg.Add(1)
+
+		go func(i int, datacenter string, args []string, resultPath string) {
+			defer wg.Done()
+
+			cmd := exec.Command(executable, args...)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			cmd.Env = env
+
+			if err := cmd.Run(); err != nil {
+				log.Errorf("backup of datacenter %s failed: %s", datacenter, err)
+			}
+
+			dcResult := &RunResult{}
+			data, err := ioutil.ReadFile(resultPath)
+
+			if err == nil {
+				err = json.Unmarshal(data, dcResult)
+			}
+
+			if err != nil {
+				log.Warnf("error reading the result of the backup of datacenter %s: %s", datacenter, err)
+				dcResult = &RunResult{Status: "failure", FailedPhase: "unknown", Target: strings.Join(uris, ",")}
+			}
+
+			results[i] = dcResult
+		}(i, datacenter, dcArgs, file.Name())
+	}
+
+	wg.Wait()
+
+	var failed []string
+
+	for i, dcResult := range results {
+		result.SnapshotBytes += dcResult.SnapshotBytes
+		result.SnapshotKeys += dcResult.SnapshotKeys
+		result.UploadRetries += dcResult.UploadRetries
+		result.VerifyRetries += dcResult.VerifyRetries
+		result.FailedTargets = append(result.FailedTargets, dcResult.FailedTargets...)
+
+		if dcResult.Status != "success" && dcResult.Status != "skipped" {
+			failed = append(failed, datacenters[i])
+			currentPhase = dcResult.FailedPhase
+
+			if dcResult.Error != "" {
+				log.Errorf("backup of datacenter %s failed in the %s phase: %s", datacenters[i], dcResult.FailedPhase, dcResult.Error)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("backups of %d of the %d datacenters failed: %s", len(failed), len(datacenters), strings.Join(failed, ", "))
+	}
+
+	log.Infof("backed up %d datacenters: %s", len(datacenters), strings.Join(datacenters, ", "))
+
+	result.Status = "success"
+
+	return nil
+}
+
+// uniqueDatacenters returns the datacenters in order without blanks or repeats, as blanks clear the
+// list for the children of runDatacenterBackups.
+func uniqueDatacenters(datacenters []string) []string {
+	var unique []string
+	seen := map[string]bool{}
+
+	for _, datacenter := range datacenters {
+		if datacenter != "" && !seen[datacenter] {
+			seen[datacenter] = true
+			unique = append(unique, datacenter)
+		}
+	}
+
+	return unique
+}
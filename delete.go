@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runDelete deletes a stored snapshot along with its sidecar objects, such as its signature.
+func runDelete(args []string) {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	confirm := flags.Bool("confirm", false, "Confirm the snapshot and its sidecar objects should be deleted.")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s delete --confirm {snapshot_uri}\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	source, err := parseTarget(flags.Arg(0))
+
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	provider, ok := providers[source.Type]
+
+	if !ok {
+		fatalf("target type of %s is not supported, expected one of: %s", source.Type, strings.Join(supportedTargetTypes(), ", "))
+	}
+
+	snapshotKey := path.Base(source.Path)
+	parent := *source
+	parent.Path = path.Dir(source.Path)
+
+	keys, err := provider.List(&parent, snapshotKey)
+
+	if err != nil {
+		fatalf("error listing objects of snapshot %s: %s", snapshotKey, err)
+	}
+
+	var objects []string
+
+	for _, key := range keys {
+		if key == snapshotKey || strings.HasPrefix(key, snapshotKey+".") {
+			objects = append(objects, key)
+		}
+	}
+
+	if len(objects) == 0 {
+		fatalf("snapshot %s was not found", flags.Arg(0))
+	}
+
+	if !*confirm {
+		for _, key := range objects {
+			log.Infof("would delete %s", key)
+		}
+
+		fatalf("refusing to delete %d objects without --confirm", len(objects))
+	}
+
+	for _, key := range objects {
+		if err := provider.Delete(&parent, key); err != nil {
+			fatalf("error deleting %s: %s", key, err)
+		}
+
+		log.Infof("deleted %s", key)
+	}
+}
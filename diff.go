@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// diffState is what diff compares of a snapshot or the live cluster, each keyed by what identifies
+// it. Services and ACLs are nil when they can't be read, such as from a KV export, and are then left
+// out of the comparison.
+type diffState struct {
+	KV       map[string][]byte
+	Services map[string][]byte
+	ACLs     map[string][]byte
+}
+
+// runDiff reports how the KV, registered services and ACL objects of two stored snapshots differ,
+// or of a snapshot and the live cluster with --against live. The KV of snapshots is read by
+// restoring them into the dummy agent in turn, their services and ACL objects from their archive.
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	against := flags.String("against", "", "Compare the snapshot against the live cluster with live, rather than against a second snapshot.")
+	consulAddr := flags.String("consul-addr", "", "The address of the consul server to compare against with --against live. Without a protocol https is used when CONSUL_HTTP_SSL is true, http otherwise. Defaults to CONSUL_ADDR.")
+	flags.StringVar(&consulDatacenter, "consul-datacenter", "", "Datacenter to compare against with --against live, forwarded to by the consul agent, when not the agent's own.")
+	flags.StringVar(&consulCAFile, "consul-ca-file", "", "Path to a pem encoded ca certificate to verify the consul server's certificate with, taking precedence over --consul-tls-skip-verify. Defaults to CONSUL_CACERT.")
+	flags.StringVar(&consulClientCert, "consul-client-cert", "", "Path to a pem encoded client certificate to authenticate to consul with when it requires mutual tls. Defaults to CONSUL_CLIENT_CERT.")
+	flags.StringVar(&consulClientKey, "consul-client-key", "", "Path to the pem encoded key of --consul-client-cert. Defaults to CONSUL_CLIENT_KEY.")
+	flags.StringVar(&consulTLSServerName, "consul-tls-server-name", "", "Name to verify the consul server's certificate against, rather than the host of its address. Defaults to CONSUL_TLS_SERVER_NAME.")
+	flags.StringVar(&consulHTTPAuth, "consul-http-auth", "", "Credentials as user:pass to authenticate to consul with using http basic auth, eg when behind an authenticating proxy. Defaults to CONSUL_HTTP_AUTH.")
+	flags.StringVar(&consulToken, "consul-token", "", "ACL token to use with consul, which needs acl = \"read\" for ACL objects to be compared. Defaults to CONSUL_HTTP_TOKEN.")
+	flags.StringVar(&consulTokenFile, "consul-token-file", "", "Path of a file holding the ACL token to use with consul, eg written by vault agent. Defaults to CONSUL_HTTP_TOKEN_FILE.")
+	consulTLSSkipVerify := flags.Bool("consul-tls-skip-verify", false, "Skip verifying the consul tls connection.")
+	restoreTimeout := flags.Duration("restore-timeout", 0, "Maximum time to allow for restoring each snapshot to the dummy consul agent. 0 means no limit.")
+	encryptionKeyValue := flags.String("encryption-key", "", "Base64 encoded 32 byte key to decrypt .enc snapshots with. Defaults to ENCRYPTION_KEY.")
+	ageIdentity := flags.String("age-identity", "", "Path of an age identity file to decrypt snapshots encrypted with --encrypt age:{recipient}. Defaults to AGE_IDENTITY_FILE.")
+	compressDictPath := flags.String("compress-dict", "", "Path to the zstd dictionary to decompress .zst snapshots compressed with --compress-dict.")
+	flags.DurationVar(&dummyAgentConfig.ReadyTimeout, "agent-ready-timeout", time.Second*30, "Maximum time to wait for the dummy consul agent used for verification to become ready.")
+	flags.BoolVar(&dummyAgentConfig.EphemeralPorts, "verify-ephemeral-ports", dummyAgentConfig.EphemeralPorts, "Bind the dummy consul agent used for verification to free loopback ports instead of the consul defaults, avoiding conflicts with services on the host. Pass --verify-ephemeral-ports=false for the defaults.")
+	flags.BoolVar(&dummyAgentConfig.ACLs, "verify-acls", false, "Enable ACLs on the dummy consul agent used for verification, bootstrapped with a random token, so restoring the snapshot exercises its ACL state.")
+	flags.StringVar(&dummyAgentConfig.Addr, "verify-addr", "", "Address for the http api of the dummy consul agent used for verification, eg 127.0.0.1:18500, rather than a free loopback port.")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s diff [options] {from_snapshot_uri} {to_snapshot_uri}\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s diff --against live --consul-addr {consul_addr} [options] {snapshot_uri}\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if *against != "" && *against != "live" {
+		fatalf("invalid value '%s' for --against, expected live", *against)
+	}
+
+	if (*against == "" && flags.NArg() != 2) || (*against == "live" && flags.NArg() != 1) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *against == "live" {
+		if *consulAddr == "" {
+			*consulAddr = os.Getenv("CONSUL_ADDR")
+		}
+
+		normalizedConsulAddr, err := consulAddrURL(*consulAddr)
+
+		if err != nil {
+			fatalf("%s", err)
+		}
+
+		*consulAddr = normalizedConsulAddr
+
+		if err := validateConsulConnection(); err != nil {
+			fatalf("%s", err)
+		}
+	}
+
+	if err := setEncryptionKey(*encryptionKeyValue); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setAgeIdentities(*ageIdentity); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setCompressionDict(*compressDictPath); err != nil {
+		fatalf("%s", err)
+	}
+
+	var snapshots [][]byte
+
+	for _, uri := range flags.Args() {
+		source, err := parseTarget(uri)
+
+		if err != nil {
+			fatalf("%s", err)
+		}
+
+		if _, ok := providers[source.Type]; !ok {
+			fatalf("target type of %s is not supported, expected one of: %s", source.Type, strings.Join(supportedTargetTypes(), ", "))
+		}
+
+		log.Infof("downloading snapshot %s", uri)
+
+		snapshot, err := fetchSnapshot(source)
+
+		if err != nil {
+			fatalf("error downloading snapshot %s: %s", uri, err)
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	var states []*diffState
+	var dummyConsulClient *consul.Client
+
+	for i, snapshot := range snapshots {
+		if isKVExport(snapshot) {
+			pairs, err := parseKVExport(snapshot)
+
+			if err != nil {
+				fatalf("error reading kv export %s: %s", flags.Arg(i), err)
+			}
+
+			states = append(states, &diffState{KV: kvValues(pairs)})
+			continue
+		}
+
+		state, err := readSnapshotDiffState(snapshot)
+
+		if err != nil {
+			fatalf("error reading snapshot %s: %s", flags.Arg(i), err)
+		}
+
+		if dummyConsulClient == nil {
+			_, dummyConsulClient, err = startDummyAgent(dummyAgentConfig)
+
+			if err != nil {
+				fatalf("error starting dummy consul agent: %s", err)
+			}
+		}
+
+		if err := restoreSnapshot(dummyConsulClient, snapshot, *restoreTimeout); err != nil {
+			fatalf("error restoring snapshot %s to dummy consul agent: %s", flags.Arg(i), err)
+		}
+
+		pairs, _, err := dummyConsulClient.KV().List("/", nil)
+
+		if err != nil {
+			fatalf("error listing keys of snapshot %s: %s", flags.Arg(i), err)
+		}
+
+		state.KV = kvValues(pairs)
+		states = append(states, state)
+	}
+
+	if *against == "live" {
+		consulClient, err := newConsulClient(*consulAddr, *consulTLSSkipVerify)
+
+		if err != nil {
+			fatalf("error creating consul client: %s", err)
+		}
+
+		state, err := readLiveDiffState(consulClient)
+
+		if err != nil {
+			fatalf("error reading the live state of %s: %s", *consulAddr, err)
+		}
+
+		states = append(states, state)
+	}
+
+	added, removed, changed := diffKVs(states[0].KV, states[1].KV)
+
+	for _, key := range added {
+		fmt.Printf("+ %s\n", key)
+	}
+
+	for _, key := range removed {
+		fmt.Printf("- %s\n", key)
+	}
+
+	for _, key := range changed {
+		fmt.Printf("~ %s\n", key)
+	}
+
+	log.Infof("%d keys added, %d keys removed, %d keys changed", len(added), len(removed), len(changed))
+
+	for _, category := range []struct {
+		name string
+		from map[string][]byte
+		to   map[string][]byte
+	}{
+		{"service", states[0].Services, states[1].Services},
+		{"acl", states[0].ACLs, states[1].ACLs},
+	} {
+		if category.from == nil || category.to == nil {
+			continue
+		}
+
+		added, removed, changed := diffKVs(category.from, category.to)
+
+		for _, key := range added {
+			fmt.Printf("+ %s %s\n", category.name, key)
+		}
+
+		for _, key := range removed {
+			fmt.Printf("- %s %s\n", category.name, key)
+		}
+
+		for _, key := range changed {
+			fmt.Printf("~ %s %s\n", category.name, key)
+		}
+
+		log.Infof("%d %s objects added, %d removed, %d changed", len(added), category.name, len(removed), len(changed))
+	}
+}
+
+// diffKVs returns the sorted keys added to, removed from and changed between two sets of KV values.
+func diffKVs(from map[string][]byte, to map[string][]byte) (added []string, removed []string, changed []string) {
+	for key, value := range to {
+		previous, ok := from[key]
+
+		if !ok {
+			added = append(added, key)
+		} else if !bytes.Equal(previous, value) {
+			changed = append(changed, key)
+		}
+	}
+
+	for key := range from {
+		if _, ok := to[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	return added, removed, changed
+}
+
+// kvValues maps the keys of the pairs to their values.
+func kvValues(pairs consul.KVPairs) map[string][]byte {
+	values := make(map[string][]byte, len(pairs))
+
+	for _, kv := range pairs {
+		values[kv.Key] = kv.Value
+	}
+
+	return values
+}
+
+// diffService is what's compared of a service instance, keyed by {node}/{service_id}.
+type diffService struct {
+	Service string   `json:"service"`
+	Tags    []string `json:"tags"`
+	Address string   `json:"address"`
+	Port    int      `json:"port"`
+}
+
+// diffACLLink is a link from a token or role to a policy or role, compared by id as names can be
+// left out of stored links.
+type diffACLLink struct {
+	ID string
+}
+
+// The ACL objects are compared without their raft indexes, hashes and token secrets, keyed by
+// policy/{name}, role/{name}, token/{accessor_id}, auth-method/{name} and binding-rule/{id}.
+type diffACLPolicy struct {
+	Description string   `json:"description"`
+	Rules       string   `json:"rules"`
+	Datacenters []string `json:"datacenters"`
+}
+
+type diffACLRole struct {
+	Description string   `json:"description"`
+	Policies    []string `json:"policies"`
+}
+
+type diffACLToken struct {
+	Description string   `json:"description"`
+	Policies    []string `json:"policies"`
+	Roles       []string `json:"roles"`
+	Local       bool     `json:"local"`
+}
+
+type diffACLAuthMethod struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+type diffACLBindingRule struct {
+	Description string `json:"description"`
+	AuthMethod  string `json:"auth_method"`
+	Selector    string `json:"selector"`
+	BindType    string `json:"bind_type"`
+	BindName    string `json:"bind_name"`
+}
+
+// diffLinkIDs returns the sorted ids of the links.
+func diffLinkIDs(links []diffACLLink) []string {
+	var ids []string
+
+	for _, link := range links {
+		ids = append(ids, link.ID)
+	}
+
+	return sortedStrings(ids)
+}
+
+// addDiffObject adds the object to the objects as JSON under the key. The objects are plain structs,
+// which always marshal.
+func addDiffObject(objects map[string][]byte, key string, object interface{}) {
+	data, _ := json.Marshal(object)
+	objects[key] = data
+}
+
+// readSnapshotDiffState reads the services and ACL objects of a snapshot from its archive. The
+// consul service is left out, as it's the servers themselves.
+func readSnapshotDiffState(snapshot []byte) (*diffState, error) {
+	state := &diffState{Services: map[string][]byte{}, ACLs: map[string][]byte{}}
+
+	_, _, err := walkSnapshotState(bytesSource(snapshot), func(msgType uint8, decode func(v interface{}) (int64, error)) error {
+		var err error
+
+		switch messageTypeNames[msgType] {
+		case "Register":
+			var register struct {
+				Node    string
+				Service *struct {
+					ID      string
+					Service string
+					Tags    []string
+					Address string
+					Port    int
+				}
+			}
+
+			if _, err = decode(&register); err == nil && register.Service != nil && register.Service.Service != "consul" {
+				s := register.Service
+				addDiffObject(state.Services, register.Node+"/"+s.ID, diffService{Service: s.Service, Tags: sortedStrings(s.Tags), Address: s.Address, Port: s.Port})
+			}
+		case "ACLPolicySet":
+			var policy struct {
+				Name        string
+				Description string
+				Rules       string
+				Datacenters []string
+			}
+
+			if _, err = decode(&policy); err == nil {
+				addDiffObject(state.ACLs, "policy/"+policy.Name, diffACLPolicy{Description: policy.Description, Rules: policy.Rules, Datacenters: sortedStrings(policy.Datacenters)})
+			}
+		case "ACLRoleSet":
+			var role struct {
+				Name        string
+				Description string
+				Policies    []diffACLLink
+			}
+
+			if _, err = decode(&role); err == nil {
+				addDiffObject(state.ACLs, "role/"+role.Name, diffACLRole{Description: role.Description, Policies: diffLinkIDs(role.Policies)})
+			}
+		case "ACLTokenSet":
+			var token struct {
+				AccessorID  string
+				Description string
+				Policies    []diffACLLink
+				Roles       []diffACLLink
+				Local       bool
+			}
+
+			if _, err = decode(&token); err == nil {
+				addDiffObject(state.ACLs, "token/"+token.AccessorID, diffACLToken{Description: token.Description, Policies: diffLinkIDs(token.Policies), Roles: diffLinkIDs(token.Roles), Local: token.Local})
+			}
+		case "ACLAuthMethodSet":
+			var method struct {
+				Name        string
+				Type        string
+				Description string
+			}
+
+			if _, err = decode(&method); err == nil {
+				addDiffObject(state.ACLs, "auth-method/"+method.Name, diffACLAuthMethod{Type: method.Type, Description: method.Description})
+			}
+		case "ACLBindingRuleSet":
+			var rule struct {
+				ID          string
+				Description string
+				AuthMethod  string
+				Selector    string
+				BindType    string
+				BindName    string
+			}
+
+			if _, err = decode(&rule); err == nil {
+				addDiffObject(state.ACLs, "binding-rule/"+rule.ID, diffACLBindingRule{Description: rule.Description, AuthMethod: rule.AuthMethod, Selector: rule.Selector, BindType: rule.BindType, BindName: rule.BindName})
+			}
+		default:
+			var record interface{}
+
+			_, err = decode(&record)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to decode snapshot %s record: %s", messageTypeNames[msgType], err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// readLiveDiffState reads the KV, services and ACL objects of the live cluster. ACL objects are left
+// out of the comparison when ACLs are disabled or the token can't read them.
+func readLiveDiffState(client *consul.Client) (*diffState, error) {
+	pairs, err := listKVChunk(client, "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	state := &diffState{KV: kvValues(pairs), Services: map[string][]byte{}}
+
+	services, _, err := client.Catalog().Services(nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %s", err)
+	}
+
+	for name := range services {
+		if name == "consul" {
+			continue
+		}
+
+		instances, _, err := client.Catalog().Service(name, "", nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service %s: %s", name, err)
+		}
+
+		for _, s := range instances {
+			addDiffObject(state.Services, s.Node+"/"+s.ServiceID, diffService{Service: s.ServiceName, Tags: sortedStrings(s.ServiceTags), Address: s.ServiceAddress, Port: s.ServicePort})
+		}
+	}
+
+	export, err := readACLs(client, false)
+
+	if isACLDisabled(err) || isPermissionDenied(err) {
+		log.Warnf("not comparing acl objects, they can't be read from the live cluster: %s", err)
+		return state, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	state.ACLs = map[string][]byte{}
+
+	for _, policy := range export.Policies {
+		addDiffObject(state.ACLs, "policy/"+policy.Name, diffACLPolicy{Description: policy.Description, Rules: policy.Rules, Datacenters: sortedStrings(policy.Datacenters)})
+	}
+
+	for _, role := range export.Roles {
+		var policies []string
+
+		for _, link := range role.Policies {
+			policies = append(policies, link.ID)
+		}
+
+		addDiffObject(state.ACLs, "role/"+role.Name, diffACLRole{Description: role.Description, Policies: sortedStrings(policies)})
+	}
+
+	for _, token := range export.Tokens {
+		var policies, roles []string
+
+		for _, link := range token.Policies {
+			policies = append(policies, link.ID)
+		}
+
+		for _, link := range token.Roles {
+			roles = append(roles, link.ID)
+		}
+
+		addDiffObject(state.ACLs, "token/"+token.AccessorID, diffACLToken{Description: token.Description, Policies: sortedStrings(policies), Roles: sortedStrings(roles), Local: token.Local})
+	}
+
+	for _, method := range export.AuthMethods {
+		addDiffObject(state.ACLs, "auth-method/"+method.Name, diffACLAuthMethod{Type: method.Type, Description: method.Description})
+	}
+
+	for _, rule := range export.BindingRules {
+		addDiffObject(state.ACLs, "binding-rule/"+rule.ID, diffACLBindingRule{Description: rule.Description, AuthMethod: rule.AuthMethod, Selector: rule.Selector, BindType: string(rule.BindType), BindName: rule.BindName})
+	}
+
+	return state, nil
+}
+
+// sortedStrings returns a sorted copy of the strings, never nil so empty lists compare equal.
+func sortedStrings(values []string) []string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+
+	return sorted
+}
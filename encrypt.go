@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// encryptionKey is the AES-256 key snapshots are encrypted with before upload, as {key}.enc, when
+// set.
+var encryptionKey []byte
+
+// ageRecipients are the age recipients snapshots are encrypted to before upload, as {key}.enc, when
+// set instead of an encryption key.
+var ageRecipients []age.Recipient
+
+// ageIdentities are the age identities snapshots encrypted to age recipients are decrypted with.
+var ageIdentities []age.Identity
+
+// ageHeader starts every age encrypted file, telling them apart from AES-256-GCM encrypted ones.
+var ageHeader = []byte("age-encryption.org/")
+
+// loadEncryptionKey decodes a base64 encoded 32 byte AES-256 key.
+func loadEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not valid base64: %s", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+
+	return key, nil
+}
+
+// setEncryptionKey loads the encryption key from the flag value, falling back to ENCRYPTION_KEY.
+func setEncryptionKey(value string) error {
+	if value == "" {
+		value = os.Getenv("ENCRYPTION_KEY")
+	}
+
+	if value == "" {
+		return nil
+	}
+
+	key, err := loadEncryptionKey(value)
+
+	if err != nil {
+		return err
+	}
+
+	encryptionKey = key
+
+	return nil
+}
+
+// setEncryption configures encryption from an --encrypt value, either age:{recipient} with one or
+// more comma separated age recipients, or aes256:{keyfile} with a file holding a base64 encoded or
+// raw 32 byte key.
+func setEncryption(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	if encryptionKey != nil {
+		return fmt.Errorf("--encrypt and --encryption-key can't be used together")
+	}
+
+	parts := strings.SplitN(value, ":", 2)
+
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("invalid encrypt '%s', expected age:{recipient} or aes256:{keyfile}", value)
+	}
+
+	switch parts[0] {
+	case "age":
+		for _, r := range strings.Split(parts[1], ",") {
+			recipient, err := age.ParseX25519Recipient(strings.TrimSpace(r))
+
+			if err != nil {
+				return fmt.Errorf("invalid age recipient: %s", err)
+			}
+
+			ageRecipients = append(ageRecipients, recipient)
+		}
+	case "aes256":
+		data, err := ioutil.ReadFile(parts[1])
+
+		if err != nil {
+			return fmt.Errorf("error reading encryption key file: %s", err)
+		}
+
+		if len(data) == 32 {
+			encryptionKey = data
+			return nil
+		}
+
+		key, err := loadEncryptionKey(strings.TrimSpace(string(data)))
+
+		if err != nil {
+			return fmt.Errorf("%s: %s", parts[1], err)
+		}
+
+		encryptionKey = key
+	default:
+		return fmt.Errorf("invalid encrypt '%s', expected age:{recipient} or aes256:{keyfile}", value)
+	}
+
+	return nil
+}
+
+// setAgeIdentities loads the age identities to decrypt snapshots with from the file at the path,
+// falling back to AGE_IDENTITY_FILE.
+func setAgeIdentities(path string) error {
+	if path == "" {
+		path = os.Getenv("AGE_IDENTITY_FILE")
+	}
+
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return fmt.Errorf("error reading age identity file: %s", err)
+	}
+
+	defer file.Close()
+
+	identities, err := age.ParseIdentities(file)
+
+	if err != nil {
+		return fmt.Errorf("error parsing age identity file %s: %s", path, err)
+	}
+
+	ageIdentities = identities
+
+	return nil
+}
+
+// encryptionEnabled reports whether snapshots are encrypted before upload.
+func encryptionEnabled() bool {
+	return encryptionKey != nil || len(ageRecipients) > 0
+}
+
+// encryptStoredSnapshot encrypts the snapshot to the age recipients when given, otherwise with the
+// encryption key.
+func encryptStoredSnapshot(snapshot []byte) ([]byte, error) {
+	if len(ageRecipients) == 0 {
+		return encryptSnapshot(encryptionKey, snapshot)
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, ageRecipients...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(snapshot); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decryptStoredSnapshot reverses encryptStoredSnapshot, telling age encrypted snapshots apart by
+// their header.
+func decryptStoredSnapshot(encrypted []byte) ([]byte, error) {
+	if !bytes.HasPrefix(encrypted, ageHeader) {
+		if encryptionKey == nil {
+			return nil, fmt.Errorf("snapshot is encrypted but no encryption key was given")
+		}
+
+		return decryptSnapshot(encryptionKey, encrypted)
+	}
+
+	if len(ageIdentities) == 0 {
+		return nil, fmt.Errorf("snapshot is encrypted with age but no age identity was given")
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(encrypted), ageIdentities...)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt snapshot, the age identity may be wrong: %s", err)
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// encryptSnapshot encrypts the snapshot with AES-256-GCM, prepending the random nonce to the
+// ciphertext.
+func encryptSnapshot(key []byte, snapshot []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, snapshot, nil), nil
+}
+
+// decryptSnapshot reverses encryptSnapshot.
+func decryptSnapshot(key []byte, encrypted []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(encrypted) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted snapshot is too short")
+	}
+
+	nonce, ciphertext := encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():]
+
+	snapshot, err := gcm.Open(nil, nonce, ciphertext, nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt snapshot, the encryption key may be wrong: %s", err)
+	}
+
+	return snapshot, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
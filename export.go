@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// kvExportEntry is a KV pair in the format written by `consul kv export` and read by
+// `consul kv import`.
+type kvExportEntry struct {
+	Key   string `json:"key"`
+	Flags uint64 `json:"flags"`
+	Value string `json:"value"`
+}
+
+// kvExport renders the pairs as `consul kv export` does, sorted by key with base64 encoded values,
+// so single keys can be restored from it or the KV imported into a cluster of another version.
+func kvExport(pairs consul.KVPairs) ([]byte, error) {
+	entries := make([]kvExportEntry, 0, len(pairs))
+
+	for _, kv := range pairs {
+		entries = append(entries, kvExportEntry{
+			Key:   kv.Key,
+			Flags: kv.Flags,
+			Value: base64.StdEncoding.EncodeToString(kv.Value),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return json.MarshalIndent(entries, "", "\t")
+}
+
+// backupKVPrefixes exports the KV under the configured prefixes from the live cluster and stores it
+// to the targets as {unix_timestamp}.kv.json, or as named by the name template, for teams owning part of the keyspace who only need,
+// or only have access to, their own keys rather than a whole snapshot.
+func backupKVPrefixes(cfg Config) error {
+	currentPhase = "snapshot"
+	result.VerifyMode = "none"
+	exportStart := time.Now()
+
+	var consulClient *consul.Client
+	var pairs consul.KVPairs
+
+	for _, addr := range cfg.ConsulAddrs {
+		client, err := newConsulClient(addr, cfg.ConsulTLSSkipVerify)
+
+		if err != nil {
+			log.Warnf("error creating consul client for %s: %s", addr, err)
+			continue
+		}
+
+		pairs, err = listKVPrefixes(client, cfg.KVPrefixes)
+
+		if err != nil {
+			log.Warnf("error exporting consul kv from %s: %s", addr, err)
+
+			if isPermissionDenied(err) {
+				log.Warnf("exporting the kv requires a token with key_prefix read on the prefixes, the request used %s", configuredToken())
+			}
+
+			continue
+		}
+
+		consulClient = client
+		break
+	}
+
+	if consulClient == nil {
+		return fmt.Errorf("error exporting consul kv, no consul host could provide it")
+	}
+
+	var err error
+
+	result.ConsulVersion, result.Datacenter, err = consulClusterInfo(consulClient)
+
+	if err != nil {
+		log.Warnf("error fetching the consul version and datacenter to record with the export: %s", err)
+	}
+
+	result.KVPrefixes = cfg.KVPrefixes
+
+	for _, kv := range pairs {
+		if kv.ModifyIndex > result.KVModifyIndex {
+			result.KVModifyIndex = kv.ModifyIndex
+		}
+	}
+
+	if cfg.Incremental {
+		since, base := incrementalExportBase(cfg, result.KVModifyIndex)
+
+		if base != "" {
+			pairs = modifiedSince(pairs, since)
+			result.IncrementalSince = since
+			result.IncrementalBase = base
+
+			log.Infof("exporting only the keys modified since index %d, on top of the full export %s", since, base)
+		}
+	}
+
+	export, err := kvExport(pairs)
+
+	if err != nil {
+		return fmt.Errorf("error exporting the kv: %s", err)
+	}
+
+	log.Infof("exported %d keys under %s", len(pairs), strings.Join(cfg.KVPrefixes, ", "))
+
+	result.SnapshotKeys = len(pairs)
+	result.SnapshotBytes = len(export)
+	recordDuration("snapshot", exportStart)
+
+	uploadStart := time.Now()
+	currentPhase = "upload"
+
+	exportKey, err := snapshotName()
+
+	if err != nil {
+		return err
+	}
+
+	exportKey = strings.TrimSuffix(exportKey, ".snap") + ".kv.json"
+
+	if encryptionEnabled() {
+		export, err = encryptStoredSnapshot(export)
+
+		if err != nil {
+			return fmt.Errorf("error encrypting the kv export: %s", err)
+		}
+
+		exportKey += ".enc"
+	}
+
+	result.SnapshotKey = exportKey
+	result.SnapshotSHA256 = sha256Hex(export)
+
+	_, err = storeToTargets(cfg, exportKey, func(target *Target) error {
+		return sendSnapshot(target, exportKey, export, cfg.SigningKey, nil, cfg.DailyPrefix)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	recordDuration("upload", uploadStart)
+
+	result.Status = "success"
+
+	return nil
+}
+
+// listKVPrefixes lists the pairs under each of the prefixes, once each where the prefixes overlap.
+func listKVPrefixes(client *consul.Client, prefixes []string) (consul.KVPairs, error) {
+	var pairs consul.KVPairs
+	seen := map[string]bool{}
+
+	for _, prefix := range prefixes {
+		var prefixPairs consul.KVPairs
+
+		err := retry(fmt.Sprintf("listing keys of %s", prefix), 3, time.Second*5, func() error {
+			var err error
+			prefixPairs, _, err = client.KV().List(prefix, nil)
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kv := range prefixPairs {
+			if !seen[kv.Key] {
+				seen[kv.Key] = true
+				pairs = append(pairs, kv)
+			}
+		}
+	}
+
+	return pairs, nil
+}
+
+// incrementalExportBase returns the index to export the keys modified since, and the full export
+// the incremental export builds on, when the previous exports in each of the targets carry on from
+// the same full export taken within cfg.FullExportInterval. Otherwise the base is empty, for a full
+// export to be taken instead.
+func incrementalExportBase(cfg Config, modifyIndex uint64) (uint64, string) {
+	var since uint64
+	var base string
+
+	for i, target := range cfg.Targets {
+		key, manifest, err := previousKVExport(target)
+
+		if err != nil {
+			log.Warnf("error reading the previous kv export from %s, taking a full export: %s", cfg.TargetURIs[i], err)
+			return 0, ""
+		}
+
+		if manifest == nil || manifest.ModifyIndex == 0 {
+			log.Infof("no previous kv export with a recorded modify index in %s, taking a full export", cfg.TargetURIs[i])
+			return 0, ""
+		}
+
+		if strings.Join(sortedStrings(manifest.KVPrefixes), ",") != strings.Join(sortedStrings(cfg.KVPrefixes), ",") {
+			log.Infof("the previous kv export in %s is of other prefixes, taking a full export", cfg.TargetURIs[i])
+			return 0, ""
+		}
+
+		targetBase := manifest.IncrementalBase
+
+		if targetBase == "" {
+			targetBase = key
+		}
+
+		// A target that missed an export would otherwise carry on from a different full export.
+		if base != "" && targetBase != base {
+			log.Infof("the targets carry on from different full exports, taking a full export")
+			return 0, ""
+		}
+
+		base = targetBase
+
+		// Exporting from the oldest of the targets' indexes covers any the others are ahead by.
+		if i == 0 || manifest.ModifyIndex < since {
+			since = manifest.ModifyIndex
+		}
+	}
+
+	if taken, ok := snapshotTime(base); !ok || time.Since(taken) >= cfg.FullExportInterval {
+		log.Infof("the full export %s is older than %s, taking a full export", base, cfg.FullExportInterval)
+		return 0, ""
+	}
+
+	// The index only goes backwards when the kv was restored, which the exports since can't follow.
+	if modifyIndex < since {
+		log.Warnf("the kv's modify index %d is behind the previous export's %d, taking a full export", modifyIndex, since)
+		return 0, ""
+	}
+
+	return since, base
+}
+
+// previousKVExport returns the key of the newest KV export directly under the target path and its
+// manifest, which is nil when there's no export or it was stored without one.
+func previousKVExport(target *Target) (string, *SnapshotManifest, error) {
+	keys, err := providers[target.Type].List(target, "")
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	var newest string
+
+	for _, key := range keys {
+		if !isKVExportKey(key) || !isNamedSnapshotKey(key) {
+			continue
+		}
+
+		taken, ok := snapshotTime(key)
+
+		if !ok {
+			continue
+		}
+
+		if newestTaken, _ := snapshotTime(newest); newest == "" || taken.After(newestTaken) {
+			newest = key
+		}
+	}
+
+	if newest == "" {
+		return "", nil, nil
+	}
+
+	source := *target
+	source.Path = path.Join(target.Path, newest)
+
+	manifest, err := fetchSnapshotManifest(&source)
+
+	return newest, manifest, err
+}
+
+// modifiedSince returns the pairs modified after the index.
+func modifiedSince(pairs consul.KVPairs, index uint64) consul.KVPairs {
+	var modified consul.KVPairs
+
+	for _, kv := range pairs {
+		if kv.ModifyIndex > index {
+			modified = append(modified, kv)
+		}
+	}
+
+	return modified
+}
+
+// isKVExport reports whether the data is a KV export rather than a snapshot. Snapshots are gzip
+// archives, so anything starting as a JSON array can only be an export.
+func isKVExport(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("["))
+}
+
+// parseKVExport reads the pairs from a KV export in the format of `consul kv export`.
+func parseKVExport(data []byte) (consul.KVPairs, error) {
+	var entries []kvExportEntry
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	pairs := make(consul.KVPairs, 0, len(entries))
+
+	for _, entry := range entries {
+		value, err := base64.StdEncoding.DecodeString(entry.Value)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of key %s: %s", entry.Key, err)
+		}
+
+		pairs = append(pairs, &consul.KVPair{Key: entry.Key, Flags: entry.Flags, Value: value})
+	}
+
+	return pairs, nil
+}
+
+// importKVPairs writes each of the pairs to the cluster, as `consul kv import` does. Keys outside
+// the pairs are left as they are.
+func importKVPairs(client *consul.Client, pairs consul.KVPairs) error {
+	for _, kv := range pairs {
+		err := retry(fmt.Sprintf("importing key %s", kv.Key), 3, time.Second*5, func() error {
+			_, err := client.KV().Put(kv, nil)
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// writeExportManifest stores the manifest of a kv export taken at the time in the directory.
+func writeExportManifest(t *testing.T, dir string, taken time.Time, manifest SnapshotManifest) string {
+	key := fmt.Sprintf("%d.kv.json", taken.Unix())
+	data, _ := json.Marshal(manifest)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, key), []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, key+".meta.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestIncrementalExportBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-backup-export")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	target, err := parseTarget("file://" + dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		KVPrefixes:         []string{"a/", "b/"},
+		Incremental:        true,
+		FullExportInterval: time.Hour,
+		Targets:            []*Target{target},
+		TargetURIs:         []string{"file://" + dir},
+	}
+
+	if _, base := incrementalExportBase(cfg, 10); base != "" {
+		t.Errorf("expected a full export without a previous export, got one on top of %s", base)
+	}
+
+	now := time.Now()
+	full := writeExportManifest(t, dir, now.Add(-time.Minute*2), SnapshotManifest{KVPrefixes: []string{"b/", "a/"}, ModifyIndex: 5})
+
+	if since, base := incrementalExportBase(cfg, 10); since != 5 || base != full {
+		t.Errorf("expected the keys since 5 on top of %s, got since %d on top of '%s'", full, since, base)
+	}
+
+	writeExportManifest(t, dir, now.Add(-time.Minute), SnapshotManifest{KVPrefixes: []string{"a/", "b/"}, ModifyIndex: 8, IncrementalSince: 5, IncrementalBase: full})
+
+	if since, base := incrementalExportBase(cfg, 10); since != 8 || base != full {
+		t.Errorf("expected the keys since 8 on top of %s, got since %d on top of '%s'", full, since, base)
+	}
+
+	if _, base := incrementalExportBase(cfg, 7); base != "" {
+		t.Error("expected a full export after the modify index went backwards")
+	}
+
+	cfg.FullExportInterval = time.Minute
+
+	if _, base := incrementalExportBase(cfg, 10); base != "" {
+		t.Error("expected a full export once the last full export is older than the interval")
+	}
+
+	cfg.FullExportInterval = time.Hour
+	cfg.KVPrefixes = []string{"a/"}
+
+	if _, base := incrementalExportBase(cfg, 10); base != "" {
+		t.Error("expected a full export after the prefixes changed")
+	}
+}
+
+func TestModifiedSince(t *testing.T) {
+	pairs := consul.KVPairs{
+		{Key: "a", ModifyIndex: 3},
+		{Key: "b", ModifyIndex: 4},
+		{Key: "c", ModifyIndex: 9},
+	}
+
+	modified := modifiedSince(pairs, 4)
+
+	if len(modified) != 1 || modified[0].Key != "c" {
+		t.Errorf("expected only c to be modified since 4, got %v", modified)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "strings"
+
+// stringsFlag is a flag that can be given multiple times, collecting each value.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// healthState tracks the outcome of the scheduled backups, for the readiness endpoint.
+type healthState struct {
+	mu            sync.Mutex
+	started       time.Time
+	maxAge        time.Duration
+	lastSuccess   time.Time
+	lastStatus    string
+	lastError     string
+	failedTargets []string
+}
+
+// health is the state the health endpoints of the scheduler report.
+var health = &healthState{started: time.Now()}
+
+// observe records the outcome of a scheduled backup. Skipped backups, where another instance held
+// the lock, leave the outcome of the last backup in place.
+func (h *healthState) observe(r *RunResult) {
+	if r.Status == "skipped" {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastStatus = r.Status
+	h.lastError = r.Error
+	h.failedTargets = r.FailedTargets
+
+	if r.Status == "success" {
+		h.lastSuccess = time.Now()
+	}
+}
+
+// ready returns an error describing why the scheduler isn't ready, when the last backup failed, a
+// target failed to store it, or there's been no successful backup within the max age. Until the
+// first backup the max age counts from when the scheduler started.
+func (h *healthState) ready(now time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.lastStatus != "" && h.lastStatus != "success" {
+		return fmt.Errorf("last backup failed: %s", h.lastError)
+	}
+
+	if len(h.failedTargets) > 0 {
+		return fmt.Errorf("last backup failed to store to %s", strings.Join(h.failedTargets, ", "))
+	}
+
+	since := h.lastSuccess
+
+	if since.IsZero() {
+		since = h.started
+	}
+
+	if h.maxAge > 0 && now.Sub(since) > h.maxAge {
+		if h.lastSuccess.IsZero() {
+			return fmt.Errorf("no successful backup since starting %s ago", now.Sub(since).Truncate(time.Second))
+		}
+
+		return fmt.Errorf("last successful backup was %s ago, more than %s", now.Sub(since).Truncate(time.Second), h.maxAge)
+	}
+
+	return nil
+}
+
+// healthzHandler reports the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports whether the backups are succeeding, failing with 503 when they aren't.
+func (h *healthState) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := h.ready(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// startHealthServer serves /healthz and /readyz on the address in the background, where /readyz
+// fails once there's been no successful backup within the max age.
+func startHealthServer(addr string, maxAge time.Duration) {
+	health.mu.Lock()
+	health.maxAge = maxAge
+	health.mu.Unlock()
+
+	mux := serveMux(addr)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", health.readyzHandler)
+
+	log.Infof("serving health checks on %s/healthz and %s/readyz, ready while backups succeed within %s", addr, addr, maxAge)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyBeforeFirstBackup(t *testing.T) {
+	start := time.Now()
+	h := &healthState{started: start, maxAge: time.Hour}
+
+	if err := h.ready(start.Add(time.Minute)); err != nil {
+		t.Errorf("expected ready within the max age of starting, got %s", err)
+	}
+
+	if err := h.ready(start.Add(2 * time.Hour)); err == nil {
+		t.Errorf("expected not ready with no backup within the max age of starting")
+	}
+}
+
+func TestReadyAfterBackups(t *testing.T) {
+	h := &healthState{started: time.Now().Add(-time.Hour), maxAge: time.Hour}
+
+	h.observe(&RunResult{Status: "success"})
+
+	if err := h.ready(time.Now()); err != nil {
+		t.Errorf("expected ready after a successful backup, got %s", err)
+	}
+
+	if err := h.ready(time.Now().Add(2 * time.Hour)); err == nil {
+		t.Errorf("expected not ready once the last success is older than the max age")
+	}
+
+	h.observe(&RunResult{Status: "success", FailedTargets: []string{"s3://bucket"}})
+
+	if err := h.ready(time.Now()); err == nil {
+		t.Errorf("expected not ready when a target failed to store the last backup")
+	}
+
+	h.observe(&RunResult{Status: "failure", Error: "boom"})
+
+	if err := h.ready(time.Now()); err == nil || err.Error() != "last backup failed: boom" {
+		t.Errorf("expected not ready after a failed backup, got %v", err)
+	}
+
+	// A skipped backup leaves the failure in place.
+	h.observe(&RunResult{Status: "skipped"})
+
+	if err := h.ready(time.Now()); err == nil {
+		t.Errorf("expected a skipped backup not to clear the failure")
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	h := &healthState{started: time.Now()}
+	h.observe(&RunResult{Status: "failure", Error: "boom"})
+
+	w := httptest.NewRecorder()
+	h.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after a failed backup, got %d", w.Code)
+	}
+
+	h.observe(&RunResult{Status: "success"})
+
+	w = httptest.NewRecorder()
+	h.readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 after a successful backup, got %d", w.Code)
+	}
+}
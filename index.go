@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// previousSnapshotIndex returns the raft index recorded alongside the newest snapshot directly
+// under the target path, and whether one was found.
+func previousSnapshotIndex(target *Target) (uint64, bool, error) {
+	keys, err := providers[target.Type].List(target, "")
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	var newest string
+
+	for _, key := range keys {
+		if !isNamedSnapshotKey(key) {
+			continue
+		}
+
+		taken, ok := snapshotTime(key)
+
+		if !ok {
+			continue
+		}
+
+		if newestTaken, _ := snapshotTime(newest); newest == "" || taken.After(newestTaken) {
+			newest = key
+		}
+	}
+
+	if newest == "" {
+		return 0, false, nil
+	}
+
+	indexKey := newest + ".index"
+	found := false
+
+	for _, key := range keys {
+		if key == indexKey {
+			found = true
+		}
+	}
+
+	// Snapshots stored before the index was recorded have nothing to compare against.
+	if !found {
+		return 0, false, nil
+	}
+
+	source := *target
+	source.Path = path.Join(target.Path, indexKey)
+
+	data, err := providers[target.Type].Get(&source)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	index, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid index recorded in %s: %s", indexKey, err)
+	}
+
+	return index, true, nil
+}
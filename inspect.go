@@ -0,0 +1,408 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	consul "github.com/hashicorp/consul/api"
+	consulSnapshot "github.com/hashicorp/consul/snapshot"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+	log "github.com/sirupsen/logrus"
+)
+
+// messageTypeNames maps the consul fsm message types to the names used by `consul snapshot inspect`.
+var messageTypeNames = map[uint8]string{
+	0:  "Register",
+	1:  "Deregister",
+	2:  "KVS",
+	3:  "Session",
+	4:  "ACL",
+	5:  "Tombstone",
+	6:  "CoordinateBatchUpdate",
+	7:  "PreparedQuery",
+	8:  "Txn",
+	9:  "Autopilot",
+	10: "Area",
+	11: "ACLBootstrap",
+	12: "Intention",
+	13: "ConnectCA",
+	14: "ConnectCAProviderState",
+	15: "ConnectCAConfig",
+	16: "Index",
+	17: "ACLTokenSet",
+	18: "ACLTokenDelete",
+	19: "ACLPolicySet",
+	20: "ACLPolicyDelete",
+	21: "ConnectCALeaf",
+	22: "ConfigEntry",
+	23: "ACLRoleSet",
+	24: "ACLRoleDelete",
+	25: "ACLBindingRuleSet",
+	26: "ACLBindingRuleDelete",
+	27: "ACLAuthMethodSet",
+	28: "ACLAuthMethodDelete",
+	29: "ChunkingState",
+}
+
+// TypeStats is the record count and size of a single data type within a snapshot.
+type TypeStats struct {
+	Name  string
+	Count int
+	Size  int64
+}
+
+// SnapshotInfo is the summary of a snapshot archive.
+type SnapshotInfo struct {
+	Meta      *raft.SnapshotMeta
+	LastIndex uint64
+	Stats     []TypeStats
+	TotalSize int64
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// walkSnapshotState verifies the checksums of the snapshot archive, then calls fn with the type of
+// each record in its state.bin. fn must decode the record with decode, which returns the size of
+// the record read.
+func walkSnapshotState(open uploadSource, fn func(msgType uint8, decode func(v interface{}) (int64, error)) error) (*raft.SnapshotMeta, uint64, error) {
+	verifyReader, err := open()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	meta, err := consulSnapshot.Verify(verifyReader)
+	verifyReader.Close()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r, err := open()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer r.Close()
+
+	decomp, err := gzip.NewReader(r)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to decompress snapshot: %s", err)
+	}
+
+	defer decomp.Close()
+
+	archive := tar.NewReader(decomp)
+
+	for {
+		hdr, err := archive.Next()
+
+		if err == io.EOF {
+			return nil, 0, fmt.Errorf("snapshot archive does not contain state.bin")
+		}
+
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed reading snapshot: %s", err)
+		}
+
+		if hdr.Name == "state.bin" {
+			break
+		}
+	}
+
+	state := &countingReader{r: archive}
+	dec := codec.NewDecoder(state, &codec.MsgpackHandle{})
+
+	var header struct {
+		LastIndex uint64
+	}
+
+	if err := dec.Decode(&header); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode snapshot header: %s", err)
+	}
+
+	msgType := make([]byte, 1)
+
+	for {
+		start := state.n
+
+		_, err := io.ReadFull(state, msgType)
+
+		if err == io.EOF {
+			return meta, header.LastIndex, nil
+		}
+
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read snapshot record type: %s", err)
+		}
+
+		decode := func(v interface{}) (int64, error) {
+			err := dec.Decode(v)
+			return state.n - start, err
+		}
+
+		if err := fn(msgType[0], decode); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+func inspectSnapshot(snapshot []byte) (*SnapshotInfo, error) {
+	stats := map[uint8]*TypeStats{}
+	info := &SnapshotInfo{}
+
+	var err error
+
+	info.Meta, info.LastIndex, err = walkSnapshotState(bytesSource(snapshot), func(msgType uint8, decode func(v interface{}) (int64, error)) error {
+		var record interface{}
+
+		size, err := decode(&record)
+
+		if err != nil {
+			return fmt.Errorf("failed to decode snapshot record: %s", err)
+		}
+
+		s, ok := stats[msgType]
+
+		if !ok {
+			name, known := messageTypeNames[msgType]
+
+			if !known {
+				name = fmt.Sprintf("Unknown(%d)", msgType)
+			}
+
+			s = &TypeStats{Name: name}
+			stats[msgType] = s
+		}
+
+		s.Count++
+		s.Size += size
+		info.TotalSize += size
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range stats {
+		info.Stats = append(info.Stats, *s)
+	}
+
+	sort.Slice(info.Stats, func(i, j int) bool {
+		return info.Stats[i].Size > info.Stats[j].Size
+	})
+
+	return info, nil
+}
+
+func logSnapshotInfo(info *SnapshotInfo) {
+	log.Infof("snapshot id: %s", info.Meta.ID)
+	log.Infof("snapshot index: %d, term: %d, version: %d", info.Meta.Index, info.Meta.Term, info.Meta.Version)
+
+	for _, s := range info.Stats {
+		log.Infof("snapshot contains %d %s records totalling %d bytes", s.Count, s.Name, s.Size)
+	}
+
+	log.Infof("snapshot state totals %d bytes", info.TotalSize)
+}
+
+// formatSnapshotInfo renders the summary in the same layout as `consul snapshot inspect`.
+func formatSnapshotInfo(info *SnapshotInfo) []byte {
+	var buf bytes.Buffer
+
+	w := tabwriter.NewWriter(&buf, 8, 8, 6, ' ', 0)
+
+	fmt.Fprintf(w, " ID\t%s\n", info.Meta.ID)
+	fmt.Fprintf(w, " Size\t%d\n", info.Meta.Size)
+	fmt.Fprintf(w, " Index\t%d\n", info.Meta.Index)
+	fmt.Fprintf(w, " Term\t%d\n", info.Meta.Term)
+	fmt.Fprintf(w, " Version\t%d\n", info.Meta.Version)
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, " Type\tCount\tSize\t")
+	fmt.Fprintln(w, " ----\t----\t----\t")
+
+	for _, s := range info.Stats {
+		fmt.Fprintf(w, " %s\t%d\t%s\t\n", s.Name, s.Count, formatByteSize(s.Size))
+	}
+
+	fmt.Fprintln(w, " ----\t----\t----\t")
+	fmt.Fprintf(w, " Total\t\t%s\t\n", formatByteSize(info.TotalSize))
+
+	w.Flush()
+
+	return buf.Bytes()
+}
+
+// formatByteSize formats a size the way consul's inspect output does, eg 12.3KB.
+func formatByteSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[unit])
+	}
+
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// snapshotState is the data verification compares with the live cluster, read straight from the
+// snapshot archive rather than by restoring it to the dummy agent.
+type snapshotState struct {
+	// Index is the raft index the snapshot was taken at.
+	Index uint64
+	KVs   consul.KVPairs
+	// SessionIndexes is the create index of each session.
+	SessionIndexes []uint64
+	Queries        int
+}
+
+// readSnapshotState verifies the checksums of the snapshot archive and reads the KV pairs, sessions
+// and prepared queries from its state. Only the KV of the namespace and partition in use is read,
+// as that's all the live cluster lists.
+func readSnapshotState(open uploadSource) (*snapshotState, error) {
+	state := &snapshotState{}
+	var err error
+
+	_, state.Index, err = walkSnapshotState(open, func(msgType uint8, decode func(v interface{}) (int64, error)) error {
+		var err error
+
+		switch messageTypeNames[msgType] {
+		case "KVS":
+			var entry struct {
+				Key         string
+				Flags       uint64
+				Value       []byte
+				Session     string
+				LockIndex   uint64
+				CreateIndex uint64
+				ModifyIndex uint64
+				// Namespace and Partition are only set in consul enterprise snapshots.
+				Namespace string
+				Partition string
+			}
+
+			if _, err = decode(&entry); err == nil && inConsulScope(entry.Namespace, entry.Partition) {
+				state.KVs = append(state.KVs, &consul.KVPair{
+					Key:         entry.Key,
+					Flags:       entry.Flags,
+					Value:       entry.Value,
+					Session:     entry.Session,
+					LockIndex:   entry.LockIndex,
+					CreateIndex: entry.CreateIndex,
+					ModifyIndex: entry.ModifyIndex,
+				})
+			}
+		case "Session":
+			var session struct {
+				CreateIndex uint64
+			}
+
+			if _, err = decode(&session); err == nil {
+				state.SessionIndexes = append(state.SessionIndexes, session.CreateIndex)
+			}
+		case "PreparedQuery":
+			var query interface{}
+
+			if _, err = decode(&query); err == nil {
+				state.Queries++
+			}
+		default:
+			var record interface{}
+
+			_, err = decode(&record)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to decode snapshot %s record: %s", messageTypeNames[msgType], err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// countSessions counts the sessions created at or before the index, matching
+// countSessionsAndQueries.
+func (s *snapshotState) countSessions(index uint64) int {
+	count := 0
+
+	for _, createIndex := range s.SessionIndexes {
+		if createIndex <= index {
+			count++
+		}
+	}
+
+	return count
+}
+
+// missingKeyPrefixes returns the prefixes no key in the snapshot exists under.
+func (s *snapshotState) missingKeyPrefixes(prefixes []string) []string {
+	var missing []string
+
+	for _, prefix := range prefixes {
+		found := false
+
+		for _, kv := range s.KVs {
+			if strings.HasPrefix(kv.Key, prefix) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, prefix)
+		}
+	}
+
+	return missing
+}
+
+// inConsulScope reports whether a record of the namespace and partition is in the ones in use,
+// where unset means the default.
+func inConsulScope(namespace string, partition string) bool {
+	scope := func(value string, current string) bool {
+		if value == "" {
+			value = "default"
+		}
+
+		if current == "" {
+			current = "default"
+		}
+
+		return value == current
+	}
+
+	return scope(namespace, consulNamespace) && scope(partition, consulPartition)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// storedSnapshot describes a snapshot stored directly under a target path, with the details of its
+// manifest when it has one.
+type storedSnapshot struct {
+	Key        string    `json:"key"`
+	Timestamp  time.Time `json:"timestamp"`
+	Size       int64     `json:"size"`
+	Datacenter string    `json:"datacenter,omitempty"`
+	KeyCount   *int      `json:"key_count,omitempty"`
+}
+
+// runList prints the snapshots stored in a target, newest first, for picking one to restore.
+func runList(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	targetURI := flags.String("target", "", "The target to list the snapshots of, eg s3://bucket/prefix. May be given as the only argument instead.")
+	output := flags.String("output", "table", "The format to print the snapshots in, table or json.")
+	nameTemplateText := flags.String("name-template", defaultNameTemplate, "The --name-template the snapshots were stored with, for finding them under the target.")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s list [options] {target_uri}\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if *targetURI == "" && flags.NArg() == 1 {
+		*targetURI = flags.Arg(0)
+	} else if *targetURI == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *output != "table" && *output != "json" {
+		fatalf("invalid output format '%s', expected table or json", *output)
+	}
+
+	if err := parseNameTemplate(*nameTemplateText); err != nil {
+		fatalf("%s", err)
+	}
+
+	target, err := parseTarget(*targetURI)
+
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	if _, ok := providers[target.Type]; !ok {
+		fatalf("target type of %s is not supported, expected one of: %s", target.Type, strings.Join(supportedTargetTypes(), ", "))
+	}
+
+	snapshots, err := listStoredSnapshots(target)
+
+	if err != nil {
+		fatalf("error listing snapshots of %s: %s", *targetURI, err)
+	}
+
+	if *output == "json" {
+		// An empty list rather than null keeps the output simple to consume.
+		if snapshots == nil {
+			snapshots = []storedSnapshot{}
+		}
+
+		data, err := json.MarshalIndent(snapshots, "", "  ")
+
+		if err != nil {
+			fatalf("error encoding snapshots: %s", err)
+		}
+
+		os.Stdout.Write(append(data, '\n'))
+		return
+	}
+
+	os.Stdout.Write(formatStoredSnapshots(snapshots))
+}
+
+// listStoredSnapshots lists the snapshots at the name template's depth under the target path, newest
+// first. Sizes are of the snapshot as stored, including its parts when split, and the size,
+// datacenter and key count are read from its manifest when it has one.
+func listStoredSnapshots(target *Target) ([]storedSnapshot, error) {
+	objects, err := providers[target.Type].Stat(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []storedSnapshot
+	sizes := map[string]int64{}
+	manifests := map[string]bool{}
+
+	for _, object := range objects {
+		if !isNamedSnapshotKey(object.Key) {
+			continue
+		}
+
+		if t, ok := snapshotTime(object.Key); ok {
+			snapshots = append(snapshots, storedSnapshot{Key: object.Key, Timestamp: t.UTC()})
+			sizes[object.Key] += object.Size
+		} else if strings.HasSuffix(object.Key, ".meta.json") {
+			manifests[strings.TrimSuffix(object.Key, ".meta.json")] = true
+		} else if i := strings.LastIndex(object.Key, ".part"); i > 0 {
+			sizes[object.Key[:i]] += object.Size
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp.After(snapshots[j].Timestamp)
+	})
+
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		snapshot.Size = sizes[snapshot.Key]
+
+		if !manifests[snapshot.Key] {
+			continue
+		}
+
+		manifestSource := *target
+		manifestSource.Path = path.Join(target.Path, snapshot.Key+".meta.json")
+
+		data, err := providers[target.Type].Get(&manifestSource)
+
+		if err != nil {
+			return nil, fmt.Errorf("error fetching the manifest of snapshot %s: %s", snapshot.Key, err)
+		}
+
+		var manifest SnapshotManifest
+
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("error reading the manifest of snapshot %s: %s", snapshot.Key, err)
+		}
+
+		// Split snapshots are stored as a manifest of their parts, the manifest has their size whole.
+		snapshot.Size = int64(manifest.Size)
+		snapshot.Datacenter = manifest.Datacenter
+		snapshot.KeyCount = manifest.KeyCount
+	}
+
+	return snapshots, nil
+}
+
+// formatStoredSnapshots formats the snapshots as a table, leaving details their manifest doesn't
+// record blank.
+func formatStoredSnapshots(snapshots []storedSnapshot) []byte {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 8, 8, 6, ' ', 0)
+
+	fmt.Fprintln(w, " Snapshot\tTimestamp\tSize\tDatacenter\tKeys\t")
+
+	for _, snapshot := range snapshots {
+		keys := ""
+
+		if snapshot.KeyCount != nil {
+			keys = strconv.Itoa(*snapshot.KeyCount)
+		}
+
+		fmt.Fprintf(w, " %s\t%s\t%s\t%s\t%s\t\n", snapshot.Key, snapshot.Timestamp.Format("2006-01-02 15:04:05 MST"), formatByteSize(snapshot.Size), snapshot.Datacenter, keys)
+	}
+
+	w.Flush()
+
+	return buf.Bytes()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// acquireBackupLock acquires the consul session lock on the key, so when the tool runs alongside
+// every server only one of them backs up each time. A nil lock is returned when another instance
+// holds it, or acquired it since this one looked, as it's then backing up or already has. The lock's
+// value records the host holding it, for finding who has it.
+func acquireBackupLock(client *consul.Client, key string) (*consul.Lock, error) {
+	pair, _, err := client.KV().Get(key, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var lockIndex uint64
+
+	if pair != nil {
+		if pair.Session != "" {
+			return nil, nil
+		}
+
+		lockIndex = pair.LockIndex
+	}
+
+	hostname, _ := os.Hostname()
+
+	lock, err := client.LockOpts(&consul.LockOptions{
+		Key:          key,
+		Value:        []byte(fmt.Sprintf("%s %s", hostname, time.Now().UTC().Format(time.RFC3339))),
+		SessionName:  "consul-backup",
+		LockTryOnce:  true,
+		LockWaitTime: time.Second,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	lost, err := lock.Lock(nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if lost == nil {
+		return nil, nil
+	}
+
+	// Each acquisition increments the lock index, so anything more than this one means another
+	// instance held the lock in between.
+	pair, _, err = client.KV().Get(key, nil)
+
+	if err == nil && (pair == nil || pair.LockIndex != lockIndex+1) {
+		err = lock.Unlock()
+		return nil, err
+	}
+
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	return lock, nil
+}
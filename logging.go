@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configureLogging sets the log format, either text or json, and the minimum level logged. Colors
+// are disabled for text logs when noColor or NO_COLOR is set.
+func configureLogging(format string, level string, noColor bool) error {
+	switch format {
+	case "text":
+		if _, ok := os.LookupEnv("NO_COLOR"); ok || noColor {
+			log.SetFormatter(&log.TextFormatter{
+				DisableColors: true,
+			})
+		}
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format '%s', expected text or json", format)
+	}
+
+	switch level {
+	case "debug", "info", "warn", "error":
+		parsed, _ := log.ParseLevel(level)
+		log.SetLevel(parsed)
+	default:
+		return fmt.Errorf("invalid log level '%s', expected debug, info, warn or error", level)
+	}
+
+	return nil
+}
@@ -1,249 +1,950 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/url"
 	"os"
+	"path"
+	"strconv"
+	"strings"
 	"time"
-	oldLogger "log"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	consul "github.com/hashicorp/consul/api"
-	consulServer "github.com/hashicorp/consul/agent"
-	consulServerConfig "github.com/hashicorp/consul/agent/config"
+
+	"consul_backup_tool/pkg/target"
+	version "github.com/hashicorp/go-version"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
 )
 
-// Target is the target.
-type Target struct {
-	Type string
-	Base string
-	Path string
-	Options url.Values
+// onCollision is what to do when an uploaded key already exists in the target, one of overwrite,
+// skip or fail.
+var onCollision = "overwrite"
+
+// snapshotContentType is the content type stored snapshots are uploaded with, where supported.
+var snapshotContentType = "application/octet-stream"
+
+// contentType returns the content type to upload the object under the key with.
+func contentType(key string) string {
+	switch {
+	case isSnapshotKey(key):
+		return snapshotContentType
+	case strings.HasSuffix(key, ".json"):
+		return "application/json"
+	case strings.HasSuffix(key, ".txt"), strings.HasSuffix(key, ".sha256"):
+		return "text/plain"
+	case strings.HasSuffix(key, ".sig"):
+		return "application/pgp-signature"
+	default:
+		return "application/octet-stream"
+	}
 }
 
 func main() {
-	consulAddr := flag.String("consul-addr", "", "The address of the consul server, including protocol (http/https)")
-	consulTLSSkipVerify := flag.Bool("consul-tls-skip-verify", false, "Skip verifying the consul tls connection.")
-	targetURI := flag.String("target", "", "The target to send the backup to. Format: {provider}://{path_on_provider} (eg, s3://my-bucket/consul-snapshots")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "delete":
+			runDelete(os.Args[2:])
+			return
+		case "copy":
+			runCopy(os.Args[2:])
+			return
+		case "upload":
+			runUpload(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "status":
+			runStatus(os.Args[2:])
+			return
+		case "list":
+			runList(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		}
+	}
+
+	consulAddr := flag.String("consul-addr", "", "The address of the consul server, eg https://consul:8501. Without a protocol https is used when CONSUL_HTTP_SSL is true, http otherwise. Multiple comma separated addresses are tried in order until one provides a snapshot.")
+	flag.StringVar(&consulCAFile, "consul-ca-file", "", "Path to a pem encoded ca certificate to verify the consul server's certificate with, taking precedence over --consul-tls-skip-verify. Defaults to CONSUL_CACERT.")
+	flag.StringVar(&consulClientCert, "consul-client-cert", "", "Path to a pem encoded client certificate to authenticate to consul with when it requires mutual tls. Defaults to CONSUL_CLIENT_CERT.")
+	flag.StringVar(&consulClientKey, "consul-client-key", "", "Path to the pem encoded key of --consul-client-cert. Defaults to CONSUL_CLIENT_KEY.")
+	flag.StringVar(&consulTLSServerName, "consul-tls-server-name", "", "Name to verify the consul server's certificate against, rather than the host of its address. Defaults to CONSUL_TLS_SERVER_NAME.")
+	flag.StringVar(&consulHTTPAuth, "consul-http-auth", "", "Credentials as user:pass to authenticate to consul with using http basic auth, eg when behind an authenticating proxy. Defaults to CONSUL_HTTP_AUTH.")
+	flag.StringVar(&consulToken, "consul-token", "", "ACL token to use with consul, which needs to be a management token or have acl = \"write\" to take snapshots. Defaults to CONSUL_HTTP_TOKEN.")
+	flag.StringVar(&consulTokenFile, "consul-token-file", "", "Path of a file holding the ACL token to use with consul, eg written by vault agent. Defaults to CONSUL_HTTP_TOKEN_FILE.")
+	flag.StringVar(&consulDatacenter, "consul-datacenter", "", "Datacenter to snapshot and verify against, forwarded to by the consul agent, when not the agent's own.")
+	flag.StringVar(&consulNamespace, "consul-namespace", "", "Consul enterprise namespace to export and verify the KV of, stored under {target}/{namespace}/. Defaults to CONSUL_NAMESPACE.")
+	flag.StringVar(&consulPartition, "consul-partition", "", "Consul enterprise admin partition to export and verify the KV of, stored under {target}/{partition}/. Defaults to CONSUL_PARTITION.")
+	flag.StringVar(&consulNamespace, "namespace", "", "Alias of --consul-namespace.")
+	flag.StringVar(&consulPartition, "partition", "", "Alias of --consul-partition.")
+	allDatacenters := flag.Bool("all-datacenters", false, "Back up every datacenter known to the cluster at once, storing each under {target}/{dc}/.")
+	var datacenters stringsFlag
+	flag.Var(&datacenters, "datacenter", "Back up this datacenter, storing it under {target}/{dc}/, alongside the others given. Can be given multiple times.")
+	consulTLSSkipVerify := flag.Bool("consul-tls-skip-verify", false, "Skip verifying the consul tls connection. CONSUL_CACERT, CONSUL_CLIENT_CERT, CONSUL_CLIENT_KEY and CONSUL_HTTP_SSL_VERIFY are honored as with the consul cli.")
+	consulWaitRetries := flag.Int("consul-wait-retries", 0, "Times to retry reaching the (first) consul agent before starting, for when running as a sidecar that can start before consul is ready.")
+	consulWaitDelay := flag.Duration("consul-wait-delay", time.Second*5, "Delay between --consul-wait-retries.")
+	onlyLeader := flag.Bool("only-leader", false, "Only take a backup when the (first) consul agent is the raft leader, useful when running alongside every server.")
+	lockKey := flag.String("lock-key", "", "Key of a consul session lock, eg consul-backup/lock, to hold while backing up, so when running alongside every server only one backs up at a time. Others skip their backup, as do any finding another instance took the lock while they acquired it. Needs session and key write permissions.")
+	restoreTimeout := flag.Duration("restore-timeout", 0, "Maximum time to allow for restoring the snapshot to the dummy consul agent during verification. 0 means no limit.")
+	verifySessionsQueries := flag.Bool("verify-sessions-queries", false, "Also verify the snapshot holds as many sessions and prepared queries as the live cluster had at the snapshot index.")
+	var expectKeyPrefixes stringsFlag
+	flag.Var(&expectKeyPrefixes, "expect-key-prefix", "Fail verification when the snapshot has no keys under this prefix, eg service/config/. Can be given multiple times.")
+	var kvPrefixes stringsFlag
+	flag.Var(&kvPrefixes, "kv-prefix", "Back up only the KV under this prefix, eg service-configs/, as a {unix_timestamp}.kv.json export in the format of consul kv export rather than taking a snapshot. Needs only read access to the prefixes. Can be given multiple times.")
+	incremental := flag.Bool("incremental", false, "With --kv-prefix, only export the keys modified since the previous export, going by the highest ModifyIndex recorded in its manifest, with a full export once the last is --full-export-interval old. Restoring takes the full export followed by each incremental export after it, in order. Deleted keys are only dropped by the next full export, as consul kv import never deletes keys.")
+	fullExportInterval := flag.Duration("full-export-interval", time.Hour*24, "How often --incremental takes a full export of the prefixes.")
+	verifyMaxProcs := flag.Int("verify-max-procs", 0, "Limit the cpus used while verifying the snapshot with the dummy consul agent (GOMAXPROCS). 0 means no limit.")
+	encryptionKeyValue := flag.String("encryption-key", "", "Base64 encoded 32 byte key to encrypt snapshots with (AES-256-GCM) before upload, stored as {snapshot}.enc. Defaults to ENCRYPTION_KEY.")
+	encrypt := flag.String("encrypt", "", "Encrypt snapshots before upload, stored as {snapshot}.enc, either to age recipients with age:{recipient}[,{recipient}] or with AES-256-GCM using a key file with aes256:{keyfile}. An alternative to --encryption-key.")
+	compressDictPath := flag.String("compress-dict", "", "Path to a zstd dictionary, trained with zstd --train on uncompressed snapshots, to compress snapshots with before upload, stored as {snapshot}.zst. Consecutive snapshots are similar, so this greatly improves on the gzip compression consul uses.")
+	compress := flag.String("compress", "", "Compress snapshots before upload, either zstd (level 3), stored as {snapshot}.zst, gzip (best level), stored as {snapshot}.gz, or none, the default. Snapshots are already gzip archives, so zstd replaces their gzip layer and gzip leaves a snapshot consul restores as it is.")
+	signKeyPath := flag.String("sign-key", "", "Path to an openpgp private key used to upload a detached {snapshot}.sig signature alongside the snapshot. An encrypted key is unlocked with SIGN_KEY_PASSPHRASE.")
+	flag.BoolVar(&target.S3CreateBucket, "create-bucket", false, "Create the s3 target bucket in the configured region if it doesn't exist.")
+	flag.Int64Var(&target.S3PartSize, "upload-part-size", target.S3PartSize, "Size in bytes of the parts s3 uploads larger than it are split into, at least 5MiB.")
+	flag.IntVar(&target.S3UploadConcurrency, "upload-concurrency", target.S3UploadConcurrency, "How many parts of an s3 upload to send at once.")
+	flag.StringVar(&target.S3StorageClass, "s3-storage-class", "", "Storage class to upload to s3 targets with, eg STANDARD_IA or GLACIER, when not given by their storage-class option.")
+	flag.StringVar(&target.S3SSE, "s3-sse", "", "Server side encryption to upload to s3 targets with, either AES256 or aws:kms, when not given by their sse option.")
+	flag.StringVar(&target.S3KMSKeyID, "s3-kms-key-id", "", "KMS key to encrypt uploads to s3 targets with when using aws:kms, when not given by their kms-key-id option.")
+	flag.DurationVar(&dummyAgentConfig.ReadyTimeout, "agent-ready-timeout", time.Second*30, "Maximum time to wait for the dummy consul agent used for verification to become ready.")
+	flag.BoolVar(&dummyAgentConfig.EphemeralPorts, "verify-ephemeral-ports", dummyAgentConfig.EphemeralPorts, "Bind the dummy consul agent used for verification to free loopback ports instead of the consul defaults, avoiding conflicts with services on the host. Pass --verify-ephemeral-ports=false for the defaults.")
+	flag.BoolVar(&dummyAgentConfig.ACLs, "verify-acls", false, "Enable ACLs on the dummy consul agent used for verification, bootstrapped with a random token, so restoring the snapshot exercises its ACL state.")
+	flag.StringVar(&dummyAgentConfig.Addr, "verify-addr", "", "Address for the http api of the dummy consul agent used for verification, eg 127.0.0.1:18500, rather than a free loopback port.")
+	flag.DurationVar(&target.S3TTL, "ttl", 0, "Tag uploaded s3 objects with an expires-at time this far in the future (and set the Expires header), for lifecycle rules to expire them by.")
+	requireConsulVersion := flag.String("require-consul-version", "", "Version constraint the live consul servers must satisfy, eg \">= 1.5, < 1.7\".")
+	agentVersionPolicy := flag.String("agent-version-policy", "warn", "What to do when the live consul's major or minor version differs from the embedded agent snapshots are verified with, which may not restore them faithfully. Either fail, warn or ignore.")
+	consulVersionPolicy := flag.String("consul-version-policy", "fail", "What to do when the live consul version doesn't satisfy --require-consul-version, either fail or warn.")
+	nameTemplateText := flag.String("name-template", defaultNameTemplate, "Template of the keys snapshots are stored under, eg {{.Datacenter}}/{{.Timestamp.Format \"2006/01/02\"}}/{{.Timestamp.Unix}}.snap, with .Timestamp, .Datacenter, .Namespace, .Partition and .Hostname. The name needs to end in {{.Timestamp.Unix}}.snap. Compression and encryption extensions are added to it.")
+	dailyPrefix := flag.String("daily-prefix", "", "Also store the first snapshot of each day (UTC) under this prefix of the target, eg daily, for tiered retention.")
+	logFormat := flag.String("log-format", "text", "Format of the log output, either text or json.")
+	logLevel := flag.String("log-level", "info", "Minimum level of logs to output, one of debug, info, warn or error. Debug adds detail such as the resolved targets, retries and each key that failed verification, but never tokens or keys.")
+	noColor := flag.Bool("no-color", false, "Disable colored log output. Colors are already disabled when not logging to a terminal or when NO_COLOR is set.")
+	s3MaxConcurrency := flag.Int("s3-max-concurrency", 0, "Maximum number of s3 api calls to have in flight at once, shared across all s3 operations. 0 means no limit.")
+	stale := flag.Bool("stale", false, "Allow any consul server to provide the snapshot rather than only the leader.")
+	snapshotFromNode := flag.String("snapshot-from-node", "", "With --stale, the node to prefer taking the snapshot from, e.g. a non-voting server dedicated to backups.")
+	maxStaleness := flag.Duration("max-staleness", 0, "With --stale, the most a snapshot may lag behind the leader. 0 means no limit.")
+	stalenessPolicy := flag.String("staleness-policy", "fail", "What to do when a stale snapshot exceeds --max-staleness, either fail or warn.")
+	indexRegressionPolicy := flag.String("index-regression-policy", "", "Record each snapshot's raft index as {snapshot}.index and check it hasn't gone backwards since the previous snapshot, which points to a rollback or split brain. Either fail or warn, empty disables the check.")
+	currentPointerKey := flag.String("current-pointer-key", "", "After storing the snapshot, point this key of the target, eg current, at it by writing the snapshot's key to it. Restoring or diffing the pointer follows it to the snapshot, a stable entry point that doesn't duplicate the snapshot like a latest copy would.")
+	successMarkerKey := flag.String("success-marker-key", "", "After a run that verified the snapshot and stored it to every target, write the time to this key of each target, eg last-success.txt, for monitors to check backups are succeeding end to end by its last modified time.")
+	skipVerify := flag.Bool("skip-verify", false, "Skip verification entirely, uploading the snapshot without starting the dummy consul agent. The same as --verify-mode none.")
+	verifyMode := flag.String("verify-mode", "full", "How to verify the snapshot before upload: full restores it to a dummy consul agent and compares its kv with the live cluster, inspect checks the archive and compares the kv read from it without starting the agent, restore-only only checks it restores and none skips verification.")
+	verifySamplePercent := flag.Float64("verify-sample-percent", 0, "Only compare this percentage of the live keys with the snapshot, eg 10, for cheaper verification of very large stores. 0 compares every key.")
+	verifySampleSeed := flag.Int64("verify-sample-seed", 0, "Seed choosing the keys --verify-sample-percent compares, so runs with the same seed check the same keys. 0 picks a random seed, which is logged.")
+	verifyMismatchPolicy := flag.String("on-verify-mismatch", "fail", "What to do when the snapshot's kv doesn't match the live kv: fail, warn and store it anyway, or retry with a fresh snapshot, which often succeeds on busy clusters where the mismatch is only keys written as the snapshot was taken.")
+	verifyMismatchRetries := flag.Int("verify-mismatch-retries", 3, "With --on-verify-mismatch retry, how many fresh snapshots to take before failing.")
+	verifyByPrefix := flag.Bool("verify-by-prefix", false, "Compare the KV one top level prefix at a time instead of all at once, bounding memory use on very large stores.")
+	verifyConcurrency := flag.Int("verify-concurrency", 4, "With --verify-by-prefix, how many top level prefixes to list and compare at once.")
+	verifyTolerance := flag.Int("verify-tolerance", 0, "How many keys may be missing from the snapshot or differ from the live cluster before verification fails, for busy clusters where keys change while backing up.")
+	var verifySkipPrefixes stringsFlag
+	flag.Var(&verifySkipPrefixes, "verify-skip-prefix", "Leave the keys under this prefix, eg locks/, out of the verification, for keys known to churn while backing up. Can be given multiple times.")
+	clusterConfig := flag.Bool("cluster-config", false, "Also store the raft peer and autopilot configuration as {snapshot}.raft.json and {snapshot}.autopilot.json.")
+	aclExport := flag.Bool("acl-export", false, "Also store the ACL policies, roles, tokens, auth methods and binding rules as {snapshot}.acl.json, with the secret ids of tokens redacted. Needs a token with acl = \"read\".")
+	aclExportSecrets := flag.Bool("include-secrets", false, "Keep the secret ids of tokens in the --acl-export rather than redacting them, which needs a token with acl = \"write\". The export is stored as {snapshot}.acl.json.enc when encrypting.")
+	kvExport := flag.Bool("kv-export", false, "Also store the snapshot's KV as {snapshot}.kv.json in the format of consul kv export, for restoring single keys or importing into another cluster with consul kv import. It's stored as {snapshot}.kv.json.enc when encrypting.")
+	streamDirect := flag.Bool("stream-direct", false, "Stream the snapshot straight to an s3 target as it's downloaded, only verifying its checksums rather than restoring it to the dummy consul agent, for the lowest memory use.")
+	spoolDir := flag.String("spool-dir", "", "Spool the snapshot to a temporary file in this directory rather than holding it in memory, restoring it to the dummy consul agent and uploading it to the targets from there.")
+	restoreWhileDownloading := flag.Bool("restore-while-downloading", false, "Restore the snapshot into the dummy consul agent as it's downloaded, rather than after, so the download and the verification restore overlap. Compression and uploads still work from the downloaded copy once it's verified, so the snapshot is held in memory in full as usual, see --spool-dir or --stream-direct to avoid that.")
+	flag.BoolVar(restoreWhileDownloading, "single-pass", false, "Alias of --restore-while-downloading.")
+	inspect := flag.Bool("inspect", false, "Log a summary of the snapshot metadata and contents, similar to consul snapshot inspect.")
+	inspectReport := flag.Bool("inspect-report", false, "Also store a consul snapshot inspect style report of the snapshot as {snapshot}.inspect.txt.")
+	retain := flag.Int("retain", 0, "After uploading, delete all but this many of the newest snapshots directly under the target path, along with their sidecars. 0 means no limit.")
+	flag.IntVar(retain, "retain-count", 0, "Alias of --retain.")
+	retainDays := flag.Int("retain-days", 0, "After uploading, delete snapshots directly under the target path older than this many days, along with their sidecars. 0 means no limit.")
+	retainAge := flag.Duration("retain-age", 0, "After uploading, delete snapshots directly under the target path taken longer ago than this, eg 720h, along with their sidecars. An alternative to --retain-days. 0 means no limit.")
+	retainDaily := flag.Int("retain-daily", 0, "After uploading, delete all but this many of the newest daily snapshots under --daily-prefix, along with their sidecars. 0 means no limit.")
+	retentionDryRun := flag.Bool("retention-dry-run", false, "Only log what --retain, --retain-days, --retain-age and --retain-daily would delete.")
+	flag.Int64Var(&splitSize, "split-size", 0, "Split snapshots larger than this many bytes into {snapshot}.partNNNN objects, storing a manifest under the snapshot key. 0 means never split.")
+	flag.StringVar(&snapshotContentType, "content-type", "application/octet-stream", "Content type to upload snapshots with, for targets that store one.")
+	flag.StringVar(&target.SFTPKeyPath, "sftp-key", "", "Private key to authenticate to sftp targets with. Defaults to SFTP_KEY_PATH, with SFTP_KEY_PASSPHRASE unlocking an encrypted key.")
+	flag.StringVar(&target.SFTPKnownHosts, "sftp-known-hosts", "", "known_hosts file to verify the host keys of sftp targets against. Defaults to SFTP_KNOWN_HOSTS, then ~/.ssh/known_hosts.")
+	targetTimeout := flag.Duration("target-timeout", 0, "Maximum time to allow for each upload to the target. 0 means no limit.")
+	timeout := flag.Duration("timeout", 0, "Maximum time to allow for the whole backup, eg 15m, after which it's cancelled and fails. SIGINT and SIGTERM cancel it too. 0 means no limit.")
+	snapshotTimeout := flag.Duration("snapshot-timeout", 0, "Maximum time to allow for taking the snapshot from consul. 0 means no limit.")
+	uploadTimeout := flag.Duration("upload-timeout", 0, "Maximum time to allow for storing the snapshot to all the targets, where --target-timeout bounds each. 0 means no limit.")
+	flag.IntVar(&target.Retries, "upload-retries", 3, "How many times to retry a failed upload to the target, fetching the snapshot from consul when no agent could provide one, and the consul requests verifying it. Errors retrying can't fix, such as access denied or a missing bucket, fail straight away.")
+	flag.DurationVar(&target.Backoff, "upload-backoff", time.Second*5, "How long to wait before the first upload retry, doubling for each retry after it, with jitter. Also used for retrying the snapshot fetch from consul and the requests verifying it.")
+	flag.DurationVar(&target.RetryMaxWait, "upload-retry-max-wait", time.Minute, "Longest to wait between upload retries, capping the doubling of --upload-backoff. 0 means no limit.")
+	uploadBandwidthLimit := flag.String("upload-bandwidth-limit", "", "Limit the rate uploads are sent at, shared across all the targets, eg 10MiB/s, 500KB/s or a number of bytes per second, so backups don't saturate the link. Empty means no limit.")
+	flag.StringVar(&onCollision, "on-collision", "overwrite", "What to do when a key being uploaded already exists in the target, either overwrite, skip or fail.")
+	flag.StringVar(&resultFile, "result-file", "", "Write a JSON summary of the run to this path on completion, including on failure.")
+	auditEvent := flag.String("audit-event", "", "Fire a consul user event with this name after each backup, recording the snapshot and the host and user that took it in the cluster's event stream.")
+	metricsAddr := flag.String("metrics-addr", "", "Serve prometheus metrics of backup outcomes on this address, eg :9090.")
+	healthAddr := flag.String("health-addr", "", "With --schedule or --interval, serve /healthz and /readyz on this address, eg :8080, for liveness and readiness probes. Can be the same address as --metrics-addr.")
+	readyMaxAge := flag.Duration("ready-max-age", 0, "How long /readyz stays ready after the last successful backup. Defaults to twice the time between scheduled backups.")
+	metricsLinger := flag.Duration("metrics-linger", time.Second*30, "Without --schedule, how long to keep serving metrics after the backup so they can be scraped.")
+	pushgatewayURL := flag.String("pushgateway-url", "", "Push metrics of the outcome of the run to this prometheus pushgateway url as it exits, for runs that can't be scraped, eg from cron.")
+	pushgatewayJob := flag.String("pushgateway-job", "consul_backup", "Job name to push metrics to the pushgateway under.")
+	cloudWatchNamespace := flag.String("cloudwatch-namespace", "", "Put metrics of the outcome of the run to cloudwatch in this namespace as it exits, using the aws credentials in the environment.")
+	cloudWatchRegion := flag.String("cloudwatch-region", "", "Region to put cloudwatch metrics to. Defaults to AWS_REGION.")
+	webhookURL := flag.String("webhook-url", "", "POST a json summary of the outcome of the run to this url, eg a slack workflow or alerting webhook.")
+	flag.StringVar(webhookURL, "notify-url", "", "Alias of --webhook-url.")
+	slackWebhookURL := flag.String("slack-webhook-url", "", "Post a message describing the outcome of the run to this slack incoming webhook url.")
+	pagerDutyRoutingKey := flag.String("pagerduty-routing-key", "", "Integration key of a pagerduty events api v2 service to trigger an alert with when a backup fails, resolved by the next successful backup. Defaults to PAGERDUTY_ROUTING_KEY.")
+	webhookOn := flag.String("webhook-on", "always", "When to notify the webhook and slack, either always or failure.")
+	webhookTimeout := flag.Duration("webhook-timeout", time.Second*10, "How long to wait for the webhook, or for metrics to be pushed, before giving up on it.")
+	schedule := flag.String("schedule", "", "Keep running and take a backup on this cron schedule, eg \"0 */6 * * *\", instead of taking one backup and exiting.")
+	interval := flag.Duration("interval", 0, "Keep running and take a backup at this interval, eg 6h, instead of taking one backup and exiting. An alternative to --schedule.")
+	intervalJitter := flag.Duration("interval-jitter", 0, "With --schedule or --interval, start each backup a random time up to this long after it's due, eg 10m, so backups of many clusters on the same schedule don't all hit the targets at once. Needs to be shorter than the time between backups.")
+	targetQuorum := flag.String("target-quorum", "1", "How many targets need to store the snapshot for the run to succeed, or all.")
+	configPath := flag.String("config", "", "Path of a yaml config file to read settings from, named after these flags, eg consul-addr: http://consul:8500, with lists for flags that can be given multiple times. Flags given on the command line override the file. Without it, .consul-backup.yaml is read from the working directory, or else the home directory, when there is one, with the environment variables flags default to overriding it too.")
+	noConfigFile := flag.Bool("no-config-file", false, "Don't read .consul-backup.yaml from the working or home directory without --config.")
+	var targetURIs stringsFlag
+	flag.Var(&targetURIs, "target", "The target to send the backup to. Format: {provider}://{path_on_provider} (eg, s3://my-bucket/consul-snapshots). Can be given multiple times or as a comma separated list to store the backup in each, only failing when fewer than --target-quorum targets store it.")
 
 	flag.Parse()
 
+	if *configPath != "" {
+		if err := loadConfigFile(flag.CommandLine, *configPath, false); err != nil {
+			fatalf("%s", err)
+		}
+	} else if !*noConfigFile {
+		*configPath = findConfigFile()
+
+		if *configPath != "" {
+			if err := loadConfigFile(flag.CommandLine, *configPath, true); err != nil {
+				fatalf("%s", err)
+			}
+		}
+	}
+
+	target.SetS3MaxConcurrency(*s3MaxConcurrency)
+
+	if err := configureLogging(*logFormat, *logLevel, *noColor); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := configureTracing(); err != nil {
+		fatalf("%s", err)
+	}
+
+	// The default config file is read without being asked for, so it's worth saying it was.
+	if *configPath != "" {
+		log.Infof("read settings from %s", *configPath)
+	}
+
+	if *interval < 0 {
+		fatalf("invalid interval %s, expected a positive duration", *interval)
+	}
+
+	if *interval > 0 {
+		if *schedule != "" {
+			fatalf("--interval and --schedule can't be used together")
+		}
+
+		*schedule = "@every " + interval.String()
+	}
+
+	if *healthAddr != "" && *schedule == "" {
+		fatalf("--health-addr needs --schedule or --interval, as it reports on the scheduled backups")
+	}
+
+	if *intervalJitter < 0 {
+		fatalf("invalid interval jitter %s, expected a positive duration", *intervalJitter)
+	}
+
+	if *intervalJitter > 0 && *schedule == "" {
+		fatalf("--interval-jitter needs --schedule or --interval, as it delays the scheduled backups")
+	}
+
+	if *webhookOn != "always" && *webhookOn != "failure" {
+		fatalf("invalid webhook-on '%s', expected always or failure", *webhookOn)
+	}
+
+	if *pagerDutyRoutingKey == "" {
+		*pagerDutyRoutingKey = os.Getenv("PAGERDUTY_ROUTING_KEY")
+	}
+
+	// With a schedule each backup notifies the webhook itself, so here it only hears of failures to
+	// start the scheduler.
+	if *webhookURL != "" || *slackWebhookURL != "" || *pagerDutyRoutingKey != "" {
+		resultHook = func(r *RunResult) {
+			if *webhookURL != "" && (*webhookOn == "always" || r.Status != "success") {
+				notifyWebhook(*webhookURL, *webhookTimeout, r)
+			}
+
+			if *slackWebhookURL != "" && (*webhookOn == "always" || r.Status != "success") {
+				notifySlack(*slackWebhookURL, *webhookTimeout, r)
+			}
+
+			// Successes are always sent, as they resolve the alert a failure triggered.
+			if *pagerDutyRoutingKey != "" {
+				notifyPagerDuty(*pagerDutyRoutingKey, *webhookTimeout, r)
+			}
+		}
+	}
+
 	if len(*consulAddr) == 0 {
 		envConsulAddr := os.Getenv("CONSUL_ADDR")
 		consulAddr = &envConsulAddr
 	}
 
-	if len(*targetURI) == 0 {
-		envTargetURI := os.Getenv("TARGET_URI")
-		targetURI = &envTargetURI
+	if len(targetURIs) == 0 {
+		targetURIs = stringsFlag{os.Getenv("TARGET_URI")}
 	}
 
-	parsedConsulAddr, err := url.ParseRequestURI(*consulAddr)
-	if err != nil || parsedConsulAddr.Scheme == "" || parsedConsulAddr.Hostname() == "" {
-		log.Errorf("provided consul url is invalid, got '%s'", *consulAddr)
-		os.Exit(1)
+	// Each value may itself be a comma separated list of targets.
+	var uris []string
+
+	for _, value := range targetURIs {
+		for _, uri := range strings.Split(value, ",") {
+			uris = append(uris, strings.TrimSpace(uri))
+		}
 	}
 
-	parsedTargetURI, err := url.ParseRequestURI(*targetURI)
-	if err != nil || parsedTargetURI.Scheme == "" || parsedTargetURI.Host == "" {
-		log.Errorf("provided target url is invalid, got '%s'", *targetURI)
-		os.Exit(1)
+	consulAddrs := strings.Split(*consulAddr, ",")
+
+	for i, addr := range consulAddrs {
+		normalized, err := consulAddrURL(addr)
+
+		if err != nil {
+			fatalf("%s", err)
+		}
+
+		consulAddrs[i] = normalized
 	}
 
-	log.Infof("consul host: %s", *consulAddr)
-	log.Infof("target: %s", *targetURI)
+	if err := validateConsulConnection(); err != nil {
+		fatalf("%s", err)
+	}
+
+	defaultConsulScope()
+
+	// A multi datacenter run leaves scoping the targets to the runs of each datacenter, which store
+	// under {target}/{dc}/{partition}/{namespace}/.
+	if !*allDatacenters && len(uniqueDatacenters(datacenters)) == 0 {
+		for i := range uris {
+			if consulPartition != "" {
+				uris[i] = subTargetURI(uris[i], consulPartition)
+			}
 
-	target := &Target{
-		Type:    parsedTargetURI.Scheme,
-		Base:    parsedTargetURI.Host,
-		Path:    parsedTargetURI.Path,
-		Options: parsedTargetURI.Query(),
+			if consulNamespace != "" {
+				uris[i] = subTargetURI(uris[i], consulNamespace)
+			}
+		}
 	}
 
-	consulClient, err := consul.NewClient(&consul.Config{
-		Address: *consulAddr,
-		TLSConfig: consul.TLSConfig{
-			InsecureSkipVerify: *consulTLSSkipVerify,
-		},
-	})
+	var targets []*Target
 
-	if err != nil {
-		log.Errorf("error creating consul client: %s", err)
-		os.Exit(1)
+	for _, uri := range uris {
+		target, err := parseTarget(uri)
+
+		if err != nil {
+			fatalf("%s", err)
+		}
+
+		log.Debugf("target %s resolved to type %s, base %s, path %s, options %s", uri, target.Type, target.Base, target.Path, target.Options.Encode())
+
+		targets = append(targets, target)
 	}
 
-	data, _, err := consulClient.Snapshot().Save(nil)
+	quorum := len(targets)
 
-	if err != nil {
-		log.Errorf("error fetching consul snapshot: %s", err)
-		os.Exit(1)
+	if *targetQuorum != "all" {
+		parsed, err := strconv.Atoi(*targetQuorum)
+
+		if err != nil || parsed < 1 || parsed > len(targets) {
+			fatalf("invalid target quorum '%s', expected all or a number from 1 to the %d targets", *targetQuorum, len(targets))
+		}
+
+		quorum = parsed
 	}
 
-	snapshot, err := ioutil.ReadAll(data)
+	var err error
+	var versionConstraint version.Constraints
 
-	log.Infof("got snapshot of %d bytes", len(snapshot))
+	if *requireConsulVersion != "" {
+		versionConstraint, err = version.NewConstraint(*requireConsulVersion)
 
-	if err != nil {
-		log.Errorf("error reading consul snapshot: %s", err)
-		os.Exit(1)
+		if err != nil {
+			fatalf("invalid consul version constraint '%s': %s", *requireConsulVersion, err)
+		}
 	}
 
-	consulAgent, err := getConsulAgent()
+	if *consulVersionPolicy != "fail" && *consulVersionPolicy != "warn" {
+		fatalf("invalid consul version policy '%s', expected fail or warn", *consulVersionPolicy)
+	}
 
-	if err != nil {
-		log.Errorf("error starting dummy consul agent to test snapshot: %s", err)
-		os.Exit(1)
+	if *agentVersionPolicy != "fail" && *agentVersionPolicy != "warn" && *agentVersionPolicy != "ignore" {
+		fatalf("invalid agent version policy '%s', expected fail, warn or ignore", *agentVersionPolicy)
 	}
 
-	log.Info("verifying snapshot by restoring to dummy consul server")
+	if *stalenessPolicy != "fail" && *stalenessPolicy != "warn" {
+		fatalf("invalid staleness policy '%s', expected fail or warn", *stalenessPolicy)
+	}
 
-	err = consulAgent.Start()
+	if *indexRegressionPolicy != "" && *indexRegressionPolicy != "fail" && *indexRegressionPolicy != "warn" {
+		fatalf("invalid index regression policy '%s', expected fail or warn", *indexRegressionPolicy)
+	}
 
-	if err != nil {
-		log.Errorf("error starting dummy consul agent to test snapshot: %s", err)
-		os.Exit(1)
+	if err := parseNameTemplate(*nameTemplateText); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := validateCollisionPolicy(); err != nil {
+		fatalf("%s", err)
 	}
 
-	dummyConsulClient, err := consul.NewClient(&consul.Config{
-		Address: "http://localhost:8500",
-		TLSConfig: consul.TLSConfig{
-			InsecureSkipVerify: *consulTLSSkipVerify,
-		},
-	})
+	if err := validateS3Upload(); err != nil {
+		fatalf("%s", err)
+	}
+
+	retainAgeLimit, err := retentionAge(*retainDays, *retainAge)
 
 	if err != nil {
-		log.Errorf("error creating dummy consul client to test snapshot: %s", err)
-		os.Exit(1)
+		fatalf("%s", err)
 	}
 
-	log.Info("waiting for consul server to become ready")
-	time.Sleep(time.Second * 2)
+	if err := validateRetainDaily(*retainDaily, *dailyPrefix); err != nil {
+		fatalf("%s", err)
+	}
 
-	reader := bytes.NewReader(snapshot)
+	if *skipVerify {
+		*verifyMode = "none"
+	}
 
-	err = dummyConsulClient.Snapshot().Restore(nil, reader)
+	if *verifyMode != "full" && *verifyMode != "inspect" && *verifyMode != "restore-only" && *verifyMode != "none" {
+		fatalf("invalid verify mode '%s', expected full, inspect, restore-only or none", *verifyMode)
+	}
 
-	if err != nil {
-		log.Errorf("error restoring snapshot to dummy consul agent: %s", err)
-		os.Exit(1)
+	result.VerifyMode = *verifyMode
+
+	if (*verifyMode == "none" || *verifyMode == "inspect") && *restoreWhileDownloading {
+		fatalf("--restore-while-downloading restores the snapshot for verification, so can't be combined with --verify-mode %s", *verifyMode)
+	}
+
+	// The dummy agent is consul oss, without the namespaces and partitions to compare the KV of.
+	if *verifyMode == "full" && len(kvPrefixes) == 0 && (consulNamespace != "" || consulPartition != "") {
+		fatalf("--consul-namespace and --consul-partition need --verify-mode inspect, which compares the KV of the namespace and partition read from the snapshot, rather than full")
+	}
+
+	if *verifyMode != "full" && *verifyByPrefix {
+		fatalf("--verify-by-prefix chunks the kv listed from the dummy consul agent, so needs --verify-mode full")
+	}
+
+	if *verifyMode != "full" && *verifyMode != "inspect" && (*verifySessionsQueries || *verifySamplePercent > 0) {
+		fatalf("--verify-sessions-queries and --verify-sample-percent are part of the kv comparison, so need --verify-mode full or inspect")
+	}
+
+	if *verifyMode != "full" && *verifyMode != "inspect" && (*verifyTolerance > 0 || len(verifySkipPrefixes) > 0) {
+		fatalf("--verify-tolerance and --verify-skip-prefix are part of the kv comparison, so need --verify-mode full or inspect")
+	}
+
+	if *verifyTolerance < 0 || *verifyConcurrency < 1 {
+		fatalf("--verify-tolerance can't be negative and --verify-concurrency needs to be at least 1")
+	}
+
+	if *verifyMismatchPolicy != "fail" && *verifyMismatchPolicy != "warn" && *verifyMismatchPolicy != "retry" {
+		fatalf("invalid verify mismatch policy '%s', expected fail, warn or retry", *verifyMismatchPolicy)
+	}
+
+	if *verifyMode != "full" && *verifyMode != "inspect" && *verifyMismatchPolicy != "fail" {
+		fatalf("--on-verify-mismatch applies to the kv comparison, so needs --verify-mode full or inspect")
+	}
+
+	if *verifySamplePercent < 0 || *verifySamplePercent > 100 {
+		fatalf("invalid verify sample percent %g, expected between 0 and 100", *verifySamplePercent)
+	}
+
+	if *verifyMode == "none" && len(expectKeyPrefixes) > 0 {
+		fatalf("--expect-key-prefix checks the snapshot's keys, so can't be combined with --verify-mode none")
+	}
+
+	if *snapshotFromNode != "" && !*stale {
+		log.Warnf("--snapshot-from-node has no effect without --stale, snapshots are otherwise always taken from the leader")
+	}
+
+	if err := setEncryptionKey(*encryptionKeyValue); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setEncryption(*encrypt); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setCompressionDict(*compressDictPath); err != nil {
+		fatalf("%s", err)
 	}
 
-	snapshotKvs, _, err := dummyConsulClient.KV().List("/", nil)
-	liveKvs, _, err := consulClient.KV().List("/", nil)
+	if err := setCompression(*compress); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setUploadBandwidthLimit(*uploadBandwidthLimit); err != nil {
+		fatalf("%s", err)
+	}
+
+	// Blank datacenters clear any given by a config file, as the children of a multi datacenter run do.
+	datacenters = uniqueDatacenters(datacenters)
+
+	if *allDatacenters || len(datacenters) > 0 {
+		if *allDatacenters && len(datacenters) > 0 {
+			fatalf("--all-datacenters and --datacenter can't be used together")
+		}
+
+		if consulDatacenter != "" {
+			fatalf("--all-datacenters and --datacenter pick the datacenters to back up, so can't be combined with --consul-datacenter")
+		}
+
+		// The datacenters are backed up at once, so each needs its own dummy agent ports.
+		if (*verifyMode == "full" || *verifyMode == "restore-only") && (!dummyAgentConfig.EphemeralPorts || dummyAgentConfig.Addr != "") {
+			fatalf("--all-datacenters and --datacenter verify the datacenters' snapshots at once, so can't be combined with --verify-ephemeral-ports=false or --verify-addr")
+		}
+	}
 
-	var snapshotKeys []string
-	var snapshotTotalBytes int64
-	var liveTotalBytes int64
+	if *streamDirect {
+		if len(targets) != 1 || targets[0].Type != "s3" {
+			fatalf("--stream-direct only supports a single s3 target")
+		}
 
-	for _, kv := range snapshotKvs {
-		snapshotTotalBytes += int64(len(kv.Value))
-		snapshotKeys = append(snapshotKeys, kv.Key)
+		// Everything that needs the snapshot in full, rather than as a stream, can't be combined.
+		if *signKeyPath != "" || encryptionEnabled() || compression != "" || splitSize > 0 || *dailyPrefix != "" || *restoreWhileDownloading || *inspect || *inspectReport || *clusterConfig || *kvExport || *aclExport || *indexRegressionPolicy != "" || *verifySessionsQueries || len(expectKeyPrefixes) > 0 {
+			fatalf("--stream-direct can't be combined with --sign-key, --encryption-key, --encrypt, --compress, --compress-dict, --split-size, --daily-prefix, --restore-while-downloading, --inspect, --inspect-report, --cluster-config, --kv-export, --acl-export, --index-regression-policy, --verify-sessions-queries or --expect-key-prefix")
+		}
 	}
 
-	for _, kv := range liveKvs {
-		liveTotalBytes += int64(len(kv.Value))
-		if !contains(snapshotKeys, kv.Key) {
-			log.Errorf("key %s was not found in the snapshot", kv.Key)
-			os.Exit(1)
+	if *spoolDir != "" {
+		for _, target := range targets {
+			if _, ok := providers[target.Type].(StreamProvider); !ok {
+				fatalf("--spool-dir doesn't support %s targets", target.Type)
+			}
+		}
+
+		// Everything that needs the snapshot in memory, or reads it some other way, can't be combined.
+		if *signKeyPath != "" || encryptionEnabled() || compression != "" || splitSize > 0 || *dailyPrefix != "" || *streamDirect || *restoreWhileDownloading || *inspect || *inspectReport {
+			fatalf("--spool-dir can't be combined with --sign-key, --encryption-key, --encrypt, --compress, --compress-dict, --split-size, --daily-prefix, --stream-direct, --restore-while-downloading, --inspect or --inspect-report")
 		}
 	}
 
-	if liveTotalBytes < snapshotTotalBytes - 1000 || liveTotalBytes > snapshotTotalBytes + 1000 {
-		log.Errorf("different snapshot kv size detected, got %d expected %d", snapshotTotalBytes, liveTotalBytes)
-		os.Exit(1)
+	if *aclExportSecrets && !*aclExport {
+		fatalf("--include-secrets only applies to --acl-export")
 	}
 
-	log.Infof("verified all keys are contained within the snapshot, got %d keys", len(snapshotKeys))
+	if *incremental && len(kvPrefixes) == 0 {
+		fatalf("--incremental only applies to --kv-prefix")
+	}
 
-	snapshotKey := fmt.Sprintf("%d.snap", time.Now().Unix())
+	if len(kvPrefixes) > 0 {
+		// Only the KV under the prefixes is read, so anything working on the raft snapshot can't be
+		// combined.
+		if *streamDirect || *spoolDir != "" || *restoreWhileDownloading || compression != "" || *inspect || *inspectReport || *clusterConfig || *kvExport || *aclExport || *indexRegressionPolicy != "" || len(expectKeyPrefixes) > 0 {
+			fatalf("--kv-prefix can't be combined with --stream-direct, --spool-dir, --restore-while-downloading, --compress, --compress-dict, --inspect, --inspect-report, --cluster-config, --kv-export, --acl-export, --index-regression-policy or --expect-key-prefix")
+		}
+	}
 
-	switch target.Type {
-	case "s3":
-		log.Infof("uploading snapshot to s3")
-		err = sendToS3(target, &snapshotKey, &snapshot)
-	default:
-		err = fmt.Errorf("target type of %s is not supported", target.Type)
+	var signingKey *openpgp.Entity
+
+	if *signKeyPath != "" {
+		signingKey, err = loadSigningKey(*signKeyPath, os.Getenv("SIGN_KEY_PASSPHRASE"))
+
+		if err != nil {
+			fatalf("error loading signing key: %s", err)
+		}
+	}
+
+	log.Infof("consul hosts: %s", strings.Join(consulAddrs, ", "))
+	log.Infof("targets: %s", strings.Join(uris, ", "))
+
+	result.Target = strings.Join(uris, ",")
+
+	for _, target := range targets {
+		if err := validateTarget(target); err != nil {
+			fatalf("%s", err)
+		}
+	}
+
+	// With a schedule each backup pushes its own metrics, as they're only pushed as the run exits.
+	if (*pushgatewayURL != "" || *cloudWatchNamespace != "") && *schedule == "" {
+		notify := resultHook
+
+		resultHook = func(r *RunResult) {
+			if notify != nil {
+				notify(r)
+			}
+
+			// Skipped runs didn't back up, so leave the outcome of the last backup in place.
+			if r.Status == "skipped" {
+				return
+			}
+
+			if *pushgatewayURL != "" {
+				pushMetrics(*pushgatewayURL, *pushgatewayJob, *webhookTimeout, r)
+			}
+
+			if *cloudWatchNamespace != "" {
+				putCloudWatchMetrics(*cloudWatchNamespace, *cloudWatchRegion, *webhookTimeout, r)
+			}
+		}
+	}
+
+	if *metricsAddr != "" {
+		startMetricsServer(*metricsAddr)
+
+		if *schedule == "" {
+			notify := resultHook
+
+			resultHook = func(r *RunResult) {
+				if notify != nil {
+					notify(r)
+				}
+
+				observeResult(r)
+				log.Infof("serving metrics for %s before exiting", *metricsLinger)
+				time.Sleep(*metricsLinger)
+			}
+		}
+	}
+
+	if *schedule != "" {
+		runSchedule(*schedule, *healthAddr, *readyMaxAge, *intervalJitter)
+		return
+	}
+
+	if *allDatacenters || len(datacenters) > 0 {
+		if *allDatacenters {
+			datacenters, err = listDatacenters(consulAddrs, *consulTLSSkipVerify)
+
+			if err != nil {
+				fatalf("error listing datacenters: %s", err)
+			}
+		}
+
+		if err := runDatacenterBackups(datacenters, uris); err != nil {
+			fatalf("%s", err)
+		}
+
+		recordDuration("total", runStart)
+		writeResult()
+		return
+	}
+
+	cfg := Config{
+		ConsulAddrs:           consulAddrs,
+		ConsulTLSSkipVerify:   *consulTLSSkipVerify,
+		ConsulWaitRetries:     *consulWaitRetries,
+		ConsulWaitDelay:       *consulWaitDelay,
+		OnlyLeader:            *onlyLeader,
+		LockKey:               *lockKey,
+		VersionConstraint:     versionConstraint,
+		ConsulVersionPolicy:   *consulVersionPolicy,
+		AgentVersionPolicy:    *agentVersionPolicy,
+		Stale:                 *stale,
+		SnapshotFromNode:      *snapshotFromNode,
+		MaxStaleness:          *maxStaleness,
+		StalenessPolicy:       *stalenessPolicy,
+		IndexRegressionPolicy: *indexRegressionPolicy,
+		StreamDirect:          *streamDirect,
+		RestoreDuringDownload: *restoreWhileDownloading,
+		Inspect:               *inspect,
+		InspectReport:         *inspectReport,
+		ClusterConfig:         *clusterConfig,
+		KVExport:              *kvExport,
+		ACLExport:             *aclExport,
+		ACLExportSecrets:      *aclExportSecrets,
+		KVPrefixes:            kvPrefixes,
+		Incremental:           *incremental,
+		FullExportInterval:    *fullExportInterval,
+		VerifyMode:            *verifyMode,
+		VerifyMaxProcs:        *verifyMaxProcs,
+		RestoreTimeout:        *restoreTimeout,
+		VerifyByPrefix:        *verifyByPrefix,
+		VerifyConcurrency:     *verifyConcurrency,
+		VerifyTolerance:       *verifyTolerance,
+		VerifySkipPrefixes:    verifySkipPrefixes,
+		VerifySamplePercent:   *verifySamplePercent,
+		VerifySampleSeed:      *verifySampleSeed,
+		VerifySessionsQueries: *verifySessionsQueries,
+		ExpectKeyPrefixes:     expectKeyPrefixes,
+		SpoolDir:              *spoolDir,
+		VerifyMismatchPolicy:  *verifyMismatchPolicy,
+		VerifyMismatchRetries: *verifyMismatchRetries,
+		Targets:               targets,
+		TargetURIs:            uris,
+		TargetQuorum:          quorum,
+		SigningKey:            signingKey,
+		DailyPrefix:           *dailyPrefix,
+		Retain:                *retain,
+		RetainDaily:           *retainDaily,
+		RetainAge:             retainAgeLimit,
+		RetentionDryRun:       *retentionDryRun,
+		CurrentPointerKey:     *currentPointerKey,
+		SuccessMarkerKey:      *successMarkerKey,
+		AuditEvent:            *auditEvent,
+		SnapshotTimeout:       *snapshotTimeout,
+		UploadTimeout:         *uploadTimeout,
+		TargetTimeout:         *targetTimeout,
+		Agent:                 dummyAgentConfig,
+	}
+
+	cfg.Context = startRunContext(*timeout)
+
+	if _, err := Backup(cfg); err != nil {
+		fatalf("%s", err)
 	}
 
+	recordDuration("total", runStart)
+	writeResult()
+}
+
+// storeSnapshot prepares the snapshot and sends it to the target.
+func storeSnapshot(target *Target, snapshot []byte, signingKey *openpgp.Entity, sidecars map[string][]byte, dailyPrefix string) error {
+	snapshotKey, stored, err := prepareSnapshot(snapshot)
+
 	if err != nil {
-		log.Errorf("error uploading to s3: %s", err)
-		os.Exit(1)
+		return err
 	}
+
+	return sendSnapshot(target, snapshotKey, stored, signingKey, sidecars, dailyPrefix)
 }
 
-func sendToS3(target *Target, snapshotKey *string, snapshot *[]byte) error {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(target.Options.Get("region")),
-	})
+// prepareSnapshot compresses and encrypts the snapshot as configured, returning it as it's to be
+// stored along with its new key from the name template, suffixed .zst or .gz when compressed and
+// .enc when encrypted.
+func prepareSnapshot(snapshot []byte) (string, []byte, error) {
+	snapshotKey, err := snapshotName()
 
 	if err != nil {
+		return "", nil, err
+	}
+
+	if compression != "" {
+		endSpan := startSpan("compress", "consul_backup.compression", compression)
+		compressed, err := compressSnapshot(snapshot)
+		endSpan(err)
+
+		if err != nil {
+			return "", nil, fmt.Errorf("error compressing snapshot: %s", err)
+		}
+
+		if compressionDict != nil {
+			log.Infof("compressed snapshot from %d to %d bytes with dictionary %d", len(snapshot), len(compressed), compressionDictID)
+		} else {
+			log.Infof("compressed snapshot from %d to %d bytes with %s", len(snapshot), len(compressed), compression)
+		}
+
+		snapshot = compressed
+		snapshotKey += compressionExtension()
+	}
+
+	if encryptionEnabled() {
+		endSpan := startSpan("encrypt")
+		encrypted, err := encryptStoredSnapshot(snapshot)
+		endSpan(err)
+
+		if err != nil {
+			return "", nil, fmt.Errorf("error encrypting snapshot: %s", err)
+		}
+
+		snapshot = encrypted
+		snapshotKey += ".enc"
+	}
+
+	result.SnapshotKey = snapshotKey
+	result.SnapshotSHA256 = sha256Hex(snapshot)
+
+	return snapshotKey, snapshot, nil
+}
+
+// sendSnapshot uploads the prepared snapshot to the target under its key, along with its checksum,
+// its signature when a signing key is given, any sidecars as {key}.{suffix} and a daily copy when
+// a daily prefix is given.
+func sendSnapshot(target *Target, snapshotKey string, snapshot []byte, signingKey *openpgp.Entity, sidecars map[string][]byte, dailyPrefix string) error {
+	if err := sendSnapshotObject(target, snapshotKey, snapshot); err != nil {
+		return fmt.Errorf("error uploading to %s: %s", target.Type, err)
+	}
+
+	if err := sendSnapshotChecksum(target, snapshotKey, result.SnapshotSHA256, len(snapshot)); err != nil {
 		return err
 	}
 
-	svc := s3.New(sess)
+	var signature []byte
+
+	if signingKey != nil {
+		var err error
 
-	s3Path := fmt.Sprintf("%s/%s", target.Path, *snapshotKey)
+		signature, err = signSnapshot(signingKey, snapshot)
 
-	retries := 0
+		if err != nil {
+			return fmt.Errorf("error signing snapshot: %s", err)
+		}
 
-	_, err = svc.PutObject(&s3.PutObjectInput{
-		Bucket: &target.Base,
-		Body: bytes.NewReader(*snapshot),
-		Key: &s3Path,
-	})
+		signatureKey := snapshotKey + ".sig"
 
-	for err != nil && retries < 3 {
-		retries++
-		log.Warnf("error uploading to aws, retrying in 5 seconds for retry %d/%d", retries, 3)
-		time.Sleep(time.Second * 5)
-		_, err = svc.PutObject(&s3.PutObjectInput{
-			Bucket: &target.Base,
-			Body: bytes.NewReader(*snapshot),
-			Key: &s3Path,
-		})
+		if err := sendObject(target, signatureKey, signature); err != nil {
+			return fmt.Errorf("error uploading snapshot signature to %s: %s", target.Type, err)
+		}
 	}
 
-	if err != nil {
+	if err := sendSidecars(target, snapshotKey, sidecars); err != nil {
 		return err
 	}
 
-	log.Infof("saved snapshot to bucket %s at path %s", target.Base, s3Path)
+	if dailyPrefix != "" {
+		if err := sendDailySnapshot(target, dailyPrefix, snapshotKey, snapshot, signature); err != nil {
+			return fmt.Errorf("error storing daily snapshot to %s: %s", target.Type, err)
+		}
+	}
 
 	return nil
 }
 
-func getConsulAgent() (*consulServer.Agent, error) {
-	devMode := true
-	builder, err := consulServerConfig.NewBuilder(consulServerConfig.Flags{
-		DevMode: &devMode,
-	})
+// sendSidecars uploads each sidecar to the target as {key}.{suffix}.
+func sendSidecars(target *Target, snapshotKey string, sidecars map[string][]byte) error {
+	for suffix, data := range sidecars {
+		sidecarKey := snapshotKey + "." + suffix
 
-	if err != nil {
-		return nil, err
+		if err := sendObject(target, sidecarKey, data); err != nil {
+			return fmt.Errorf("error uploading snapshot %s to %s: %s", suffix, target.Type, err)
+		}
+	}
+
+	return nil
+}
+
+// validateCollisionPolicy checks the --on-collision flag holds a known policy.
+func validateCollisionPolicy() error {
+	switch onCollision {
+	case "overwrite", "skip", "fail":
+		return nil
+	}
+
+	return fmt.Errorf("invalid collision policy '%s', expected overwrite, skip or fail", onCollision)
+}
+
+// sendObject uploads a single object to the target, first checking whether the key is already
+// taken when the collision policy calls for it.
+func sendObject(target *Target, key string, data []byte) error {
+	skip, err := checkCollision(target, key)
+
+	if err != nil || skip {
+		return err
+	}
+
+	return providers[target.Type].Put(target, key, data)
+}
+
+// checkCollision applies the collision policy to the key, reporting whether its upload should be
+// skipped, or failing when it already exists and that's the policy.
+func checkCollision(target *Target, key string) (bool, error) {
+	if onCollision == "overwrite" {
+		return false, nil
 	}
 
-	rt, err := builder.Build()
+	existing, err := providers[target.Type].List(target, key)
 
 	if err != nil {
-		return nil, err
+		return false, fmt.Errorf("error checking for an existing %s: %s", key, err)
 	}
 
-	l := oldLogger.New(ioutil.Discard, "", 0)
+	for _, existingKey := range existing {
+		if existingKey != key {
+			continue
+		}
+
+		if onCollision == "skip" {
+			log.Infof("%s already exists, skipping upload", key)
+			return true, nil
+		}
+
+		return false, fmt.Errorf("%s already exists", key)
+	}
 
-	return consulServer.New(&rt, l)
+	return false, nil
 }
 
-func contains(s []string, e string) bool {
-	for _, a := range s {
-		if a == e {
-			return true
+// sendDailySnapshot stores a copy of the snapshot under the daily prefix, unless one was already
+// stored there since the start of the current day.
+func sendDailySnapshot(target *Target, prefix string, snapshotKey string, snapshot []byte, signature []byte) error {
+	prefix = strings.Trim(prefix, "/") + "/"
+	existing, err := providers[target.Type].List(target, prefix)
+
+	if err != nil {
+		return err
+	}
+
+	startOfDay := time.Now().UTC().Truncate(24 * time.Hour)
+
+	for _, key := range existing {
+		if taken, ok := snapshotTime(strings.TrimPrefix(key, prefix)); ok && !taken.Before(startOfDay) {
+			log.Infof("daily snapshot %s already stored today", key)
+			return nil
 		}
 	}
-	return false
-}
\ No newline at end of file
+
+	dailyKey := prefix + snapshotKey
+
+	log.Infof("storing first snapshot of the day as %s", dailyKey)
+
+	if err := sendSnapshotObject(target, dailyKey, snapshot); err != nil {
+		return err
+	}
+
+	// The daily copy is signed too, so it can be restored where signatures are required.
+	if signature != nil {
+		return sendObject(target, dailyKey+".sig", signature)
+	}
+
+	return nil
+}
+
+// writeSuccessMarker writes the current time to the key, replacing whatever is there regardless of
+// the collision policy. Failing to write it is logged rather than failing a backup that has already
+// been stored, as the marker going stale alerts monitors anyway.
+func writeSuccessMarker(target *Target, key string) {
+	marker := []byte(time.Now().UTC().Format(time.RFC3339) + "\n")
+
+	if err := providers[target.Type].Put(target, key, marker); err != nil {
+		log.Warnf("error writing success marker %s to %s: %s", key, target.Type, err)
+	}
+}
+
+// trimSnapshotExtensions removes the encryption and compression extensions from a snapshot key.
+func trimSnapshotExtensions(key string) string {
+	key = strings.TrimSuffix(key, ".enc")
+	key = strings.TrimSuffix(key, ".zst")
+
+	return strings.TrimSuffix(key, ".gz")
+}
+
+// isSnapshotKey reports whether the key is of a snapshot itself, compressed or encrypted or not,
+// rather than one of its sidecars.
+func isSnapshotKey(key string) bool {
+	return strings.HasSuffix(trimSnapshotExtensions(key), ".snap")
+}
+
+// isKVExportKey reports whether the key is of a KV export stored with --kv-prefix, encrypted or not.
+func isKVExportKey(key string) bool {
+	return strings.HasSuffix(trimSnapshotExtensions(key), ".kv.json")
+}
+
+// snapshotTime parses the time a snapshot was taken from its {unix_timestamp}.snap key, or a KV
+// export from its {unix_timestamp}.kv.json key. Keys named with --name-template are parsed from the
+// timestamp ending their name, after any directories and a -, _ or . separated prefix.
+func snapshotTime(key string) (time.Time, bool) {
+	var name string
+
+	switch {
+	case isSnapshotKey(key):
+		name = strings.TrimSuffix(trimSnapshotExtensions(path.Base(key)), ".snap")
+	case isKVExportKey(key):
+		// The --kv-export sidecar of a snapshot, {key}.kv.json, is left out by failing to parse.
+		name = strings.TrimSuffix(trimSnapshotExtensions(path.Base(key)), ".kv.json")
+	default:
+		return time.Time{}, false
+	}
+
+	if i := strings.LastIndexAny(name, "-_."); i >= 0 {
+		name = name[i+1:]
+	}
+
+	ts, err := strconv.ParseInt(name, 10, 64)
+
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(ts, 0), true
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	lastSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consul_backup_last_success_timestamp",
+		Help: "Unix time of the last successful backup.",
+	})
+	snapshotBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consul_backup_snapshot_bytes",
+		Help: "Size of the last successfully backed up snapshot.",
+	})
+	backupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "consul_backup_duration_seconds",
+		Help:    "Time taken by successful backups.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	backupFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "consul_backup_failures_total",
+		Help: "Failed backups, by the phase they failed in.",
+	}, []string{"phase"})
+	lastAttemptTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consul_backup_last_attempt_timestamp",
+		Help: "Unix time of the last backup, successful or not.",
+	})
+	consecutiveFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consul_backup_consecutive_failures",
+		Help: "Backups that have failed since the last successful one.",
+	})
+	uploadRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consul_backup_upload_retries_total",
+		Help: "Uploads to targets that were retried after failing.",
+	})
+	lastVerifySuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consul_backup_last_verify_success",
+		Help: "Whether the last verified snapshot passed verification, 1 when it did and 0 when it didn't.",
+	})
+	retentionDeletedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consul_backup_retention_deleted_snapshots_total",
+		Help: "Snapshots deleted from the targets by retention.",
+	})
+	retentionDeletedBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "consul_backup_retention_deleted_bytes_total",
+		Help: "Bytes of the snapshots and their sidecars deleted from the targets by retention.",
+	})
+	storedSnapshots = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consul_backup_stored_snapshots",
+		Help: "Snapshots left on each target after retention was last applied to it.",
+	}, []string{"target"})
+	storedDailySnapshots = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consul_backup_stored_daily_snapshots",
+		Help: "Daily snapshots left on each target after --retain-daily was last applied to it.",
+	}, []string{"target"})
+)
+
+func init() {
+	prometheus.MustRegister(lastSuccessTimestamp, snapshotBytes, backupDuration, backupFailures, lastAttemptTimestamp, consecutiveFailures, uploadRetriesTotal, lastVerifySuccess, retentionDeletedTotal, retentionDeletedBytesTotal, storedSnapshots, storedDailySnapshots)
+}
+
+// httpMuxes are the muxes served on each address, so the metrics and health checks can share one.
+var httpMuxes = map[string]*http.ServeMux{}
+
+// serveMux returns the mux served on the address, serving a new one in the background the first
+// time the address is used.
+func serveMux(addr string) *http.ServeMux {
+	if mux, ok := httpMuxes[addr]; ok {
+		return mux
+	}
+
+	mux := http.NewServeMux()
+	httpMuxes[addr] = mux
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("error serving on %s: %s", addr, err)
+		}
+	}()
+
+	return mux
+}
+
+// startMetricsServer serves the prometheus metrics on /metrics of the address in the background.
+func startMetricsServer(addr string) {
+	serveMux(addr).Handle("/metrics", promhttp.Handler())
+
+	log.Infof("serving metrics on %s/metrics", addr)
+}
+
+// observeResult updates the metrics with the outcome of a backup.
+func observeResult(r *RunResult) {
+	lastAttemptTimestamp.SetToCurrentTime()
+	uploadRetriesTotal.Add(float64(r.UploadRetries))
+	retentionDeletedTotal.Add(float64(r.RetentionDeleted))
+	retentionDeletedBytesTotal.Add(float64(r.RetentionDeletedBytes))
+
+	// Retention runs as each target stores the snapshot, so a run failing afterwards still pruned.
+	for uri, count := range r.StoredSnapshots {
+		storedSnapshots.WithLabelValues(uri).Set(float64(count))
+	}
+
+	for uri, count := range r.StoredDailySnapshots {
+		storedDailySnapshots.WithLabelValues(uri).Set(float64(count))
+	}
+
+	if r.Status != "success" {
+		backupFailures.WithLabelValues(r.FailedPhase).Inc()
+		consecutiveFailures.Inc()
+
+		if r.FailedPhase == "verify" {
+			lastVerifySuccess.Set(0)
+		}
+
+		return
+	}
+
+	if r.VerifyMode != "none" {
+		lastVerifySuccess.Set(1)
+	}
+
+	consecutiveFailures.Set(0)
+	lastSuccessTimestamp.SetToCurrentTime()
+	snapshotBytes.Set(float64(r.SnapshotBytes))
+	backupDuration.Observe(r.Durations["total"])
+}
+
+// pushMetrics pushes the outcome of the run to the prometheus pushgateway, for runs that exit before
+// they could be scraped. Metrics are added to those already pushed for the job, so a failure leaves
+// the time and size of the last success in place. Failing to push is logged rather than changing the
+// outcome of the run.
+func pushMetrics(url string, job string, timeout time.Duration, r *RunResult) {
+	success := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consul_backup_last_success",
+		Help: "Whether the last backup succeeded, 1 when it did and 0 when it didn't.",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consul_backup_last_duration_seconds",
+		Help: "Time taken by the last backup, successful or not.",
+	})
+	attempt := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "consul_backup_last_attempt_timestamp",
+		Help: "Unix time of the last backup, successful or not.",
+	})
+
+	attempt.SetToCurrentTime()
+	duration.Set(r.Durations["total"])
+
+	pusher := push.New(url, job).
+		Client(&http.Client{Timeout: timeout}).
+		Collector(success).
+		Collector(duration).
+		Collector(attempt)
+
+	if r.Datacenter != "" {
+		pusher = pusher.Grouping("datacenter", r.Datacenter)
+	}
+
+	if r.Status == "success" {
+		success.Set(1)
+
+		succeeded := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "consul_backup_last_success_timestamp",
+			Help: "Unix time of the last successful backup.",
+		})
+		succeeded.SetToCurrentTime()
+
+		size := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "consul_backup_snapshot_bytes",
+			Help: "Size of the last successfully backed up snapshot.",
+		})
+		size.Set(float64(r.SnapshotBytes))
+
+		pusher = pusher.Collector(succeeded).Collector(size)
+	}
+
+	if err := pusher.Add(); err != nil {
+		log.Warnf("error pushing metrics to %s: %s", url, err)
+		return
+	}
+
+	log.Infof("pushed metrics to %s", url)
+}
+
+// cloudWatchEndpoint overrides the endpoint cloudwatch metrics are put to, when set.
+var cloudWatchEndpoint string
+
+// putCloudWatchMetrics puts the outcome of the run to cloudwatch in the namespace, with the
+// datacenter as a dimension when known. The region and credentials are found as for s3 targets,
+// from the environment. Failing to put them is logged rather than changing the outcome of the run.
+func putCloudWatchMetrics(namespace string, region string, timeout time.Duration, r *RunResult) {
+	config := &aws.Config{}
+
+	if region != "" {
+		config.Region = aws.String(region)
+	}
+
+	if cloudWatchEndpoint != "" {
+		config.Endpoint = aws.String(cloudWatchEndpoint)
+	}
+
+	sess, err := session.NewSession(config)
+
+	if err != nil {
+		log.Warnf("error putting metrics to cloudwatch: %s", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err = cloudwatch.New(sess).PutMetricDataWithContext(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(namespace),
+		MetricData: cloudWatchMetricData(r),
+	})
+
+	if err != nil {
+		log.Warnf("error putting metrics to cloudwatch: %s", err)
+		return
+	}
+
+	log.Infof("put metrics to cloudwatch namespace %s", namespace)
+}
+
+// cloudWatchMetricData returns the cloudwatch metrics describing the outcome of the run.
+func cloudWatchMetricData(r *RunResult) []*cloudwatch.MetricDatum {
+	var dimensions []*cloudwatch.Dimension
+
+	if r.Datacenter != "" {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String("Datacenter"),
+			Value: aws.String(r.Datacenter),
+		})
+	}
+
+	datum := func(name string, unit string, value float64) *cloudwatch.MetricDatum {
+		return &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Unit:       aws.String(unit),
+			Value:      aws.Float64(value),
+			Dimensions: dimensions,
+		}
+	}
+
+	success := 0.0
+
+	if r.Status == "success" {
+		success = 1
+	}
+
+	data := []*cloudwatch.MetricDatum{
+		datum("BackupSuccess", cloudwatch.StandardUnitCount, success),
+		datum("BackupDuration", cloudwatch.StandardUnitSeconds, r.Durations["total"]),
+	}
+
+	if r.Status == "success" {
+		data = append(data, datum("SnapshotSize", cloudwatch.StandardUnitBytes, float64(r.SnapshotBytes)))
+	}
+
+	return data
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordedRequest is a request received by a fake metrics endpoint.
+type recordedRequest struct {
+	method string
+	path   string
+	body   string
+}
+
+// metricsServer starts a fake metrics endpoint recording the requests it receives.
+func metricsServer(t *testing.T, status int, response string) (*httptest.Server, chan recordedRequest) {
+	requests := make(chan recordedRequest, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+
+		if err != nil {
+			t.Errorf("error reading request body: %s", err)
+		}
+
+		requests <- recordedRequest{method: r.Method, path: r.URL.Path, body: string(body)}
+
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+
+	return server, requests
+}
+
+func TestPushMetricsSuccess(t *testing.T) {
+	server, requests := metricsServer(t, http.StatusAccepted, "")
+	defer server.Close()
+
+	pushMetrics(server.URL, "consul_backup", time.Second, &RunResult{
+		Status:        "success",
+		Datacenter:    "dc1",
+		SnapshotBytes: 1234,
+		Durations:     map[string]float64{"total": 5},
+	})
+
+	req := <-requests
+
+	if req.method != http.MethodPost {
+		t.Errorf("expected metrics to be added with POST, got %s", req.method)
+	}
+
+	if req.path != "/metrics/job/consul_backup/datacenter/dc1" {
+		t.Errorf("expected metrics grouped by job and datacenter, got %s", req.path)
+	}
+
+	for _, name := range []string{"consul_backup_last_success", "consul_backup_last_duration_seconds", "consul_backup_last_attempt_timestamp", "consul_backup_last_success_timestamp", "consul_backup_snapshot_bytes"} {
+		if !strings.Contains(req.body, name) {
+			t.Errorf("expected %s to be pushed", name)
+		}
+	}
+}
+
+func TestPushMetricsFailure(t *testing.T) {
+	server, requests := metricsServer(t, http.StatusAccepted, "")
+	defer server.Close()
+
+	pushMetrics(server.URL, "consul_backup", time.Second, &RunResult{
+		Status:    "failure",
+		Durations: map[string]float64{"total": 5},
+	})
+
+	req := <-requests
+
+	if req.path != "/metrics/job/consul_backup" {
+		t.Errorf("expected metrics grouped by job alone without a datacenter, got %s", req.path)
+	}
+
+	// A failure leaves the time and size of the last success in the pushgateway.
+	for _, name := range []string{"consul_backup_last_success_timestamp", "consul_backup_snapshot_bytes"} {
+		if strings.Contains(req.body, name) {
+			t.Errorf("expected %s not to be pushed for a failure", name)
+		}
+	}
+}
+
+func TestPushMetricsUnreachable(t *testing.T) {
+	server, _ := metricsServer(t, http.StatusAccepted, "")
+	server.Close()
+
+	// Failing to push is logged rather than failing the run.
+	pushMetrics(server.URL, "consul_backup", time.Second, &RunResult{Status: "success", Durations: map[string]float64{}})
+}
+
+func TestPutCloudWatchMetrics(t *testing.T) {
+	server, requests := metricsServer(t, http.StatusOK, `<PutMetricDataResponse xmlns="http://monitoring.amazonaws.com/doc/2010-08-01/"><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></PutMetricDataResponse>`)
+	defer server.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	cloudWatchEndpoint = server.URL
+	defer func() { cloudWatchEndpoint = "" }()
+
+	putCloudWatchMetrics("ConsulBackup", "eu-west-1", time.Second, &RunResult{
+		Status:        "success",
+		Datacenter:    "dc1",
+		SnapshotBytes: 1234,
+		Durations:     map[string]float64{"total": 5},
+	})
+
+	req := <-requests
+	form, err := url.ParseQuery(req.body)
+
+	if err != nil {
+		t.Fatalf("error parsing request: %s", err)
+	}
+
+	if form.Get("Action") != "PutMetricData" || form.Get("Namespace") != "ConsulBackup" {
+		t.Errorf("expected metrics put to the ConsulBackup namespace, got %s", req.body)
+	}
+
+	if form.Get("MetricData.member.3.MetricName") != "SnapshotSize" || form.Get("MetricData.member.3.Value") != "1234" {
+		t.Errorf("expected the snapshot size to be put, got %s", req.body)
+	}
+
+	if form.Get("MetricData.member.1.Dimensions.member.1.Value") != "dc1" {
+		t.Errorf("expected metrics with the datacenter dimension, got %s", req.body)
+	}
+}
+
+func TestCloudWatchMetricData(t *testing.T) {
+	data := cloudWatchMetricData(&RunResult{Status: "failure", Durations: map[string]float64{"total": 2}})
+
+	if len(data) != 2 {
+		t.Fatalf("expected only success and duration for a failure, got %d metrics", len(data))
+	}
+
+	if *data[0].MetricName != "BackupSuccess" || *data[0].Value != 0 {
+		t.Errorf("expected BackupSuccess of 0, got %s of %v", *data[0].MetricName, *data[0].Value)
+	}
+
+	if *data[1].MetricName != "BackupDuration" || *data[1].Value != 2 {
+		t.Errorf("expected BackupDuration of 2, got %s of %v", *data[1].MetricName, *data[1].Value)
+	}
+
+	if len(data[0].Dimensions) != 0 {
+		t.Errorf("expected no dimensions without a datacenter, got %d", len(data[0].Dimensions))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultNameTemplate names snapshots {unix_timestamp}.snap directly under the target path.
+const defaultNameTemplate = "{{.Timestamp.Unix}}.snap"
+
+// nameTemplate is the parsed --name-template snapshots are named with.
+var nameTemplate = template.Must(template.New("name").Parse(defaultNameTemplate))
+
+// nameTemplateDepth is how many directories deep under the target path the name template stores
+// snapshots, so listing them looks at that depth rather than directly under the target path.
+var nameTemplateDepth = 0
+
+// snapshotNameData is what the name template is executed with.
+type snapshotNameData struct {
+	Timestamp  time.Time
+	Datacenter string
+	Namespace  string
+	Partition  string
+	Hostname   string
+}
+
+// parseNameTemplate parses the name template, checking it names snapshots with a .snap key that
+// ends in the unix timestamp, as the snapshot's time is read back from it.
+func parseNameTemplate(text string) error {
+	parsed, err := template.New("name").Parse(text)
+
+	if err != nil {
+		return fmt.Errorf("invalid name template: %s", err)
+	}
+
+	taken := time.Unix(1568000000, 0)
+	name, err := executeNameTemplate(parsed, taken, "dc1")
+
+	if err != nil {
+		return fmt.Errorf("invalid name template: %s", err)
+	}
+
+	if t, ok := snapshotTime(name); !ok || !t.Equal(taken) {
+		return fmt.Errorf("invalid name template '%s', the name needs to end in {{.Timestamp.Unix}}.snap, got %s", text, name)
+	}
+
+	nameTemplate = parsed
+	nameTemplateDepth = strings.Count(name, "/")
+
+	return nil
+}
+
+// executeNameTemplate names the snapshot taken at the time, cleaning the name of the empty
+// directories left by blank fields.
+func executeNameTemplate(tmpl *template.Template, taken time.Time, datacenter string) (string, error) {
+	hostname, _ := os.Hostname()
+
+	var buf bytes.Buffer
+
+	err := tmpl.Execute(&buf, snapshotNameData{
+		Timestamp:  taken.UTC(),
+		Datacenter: datacenter,
+		Namespace:  consulNamespace,
+		Partition:  consulPartition,
+		Hostname:   hostname,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	// Cleaning it as an absolute path also keeps it from climbing out of the target path.
+	return strings.TrimLeft(path.Clean("/"+buf.String()), "/"), nil
+}
+
+// snapshotName returns the key of a snapshot taken now, from the name template.
+func snapshotName() (string, error) {
+	name, err := executeNameTemplate(nameTemplate, time.Now(), result.Datacenter)
+
+	if err != nil {
+		return "", fmt.Errorf("error naming snapshot: %s", err)
+	}
+
+	return name, nil
+}
+
+// isNamedSnapshotKey reports whether the key is as deep under the target path as the name template
+// stores snapshots, rather than under another prefix such as the daily copies.
+func isNamedSnapshotKey(key string) bool {
+	return strings.Count(key, "/") == nameTemplateDepth
+}
@@ -0,0 +1,341 @@
+package target
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	log "github.com/sirupsen/logrus"
+)
+
+// azblobName returns the blob name of a key under the target path. The path's leading slash is
+// trimmed to match the layout of s3 targets.
+func azblobName(target *Target, key string) string {
+	base := strings.Trim(target.Path, "/")
+
+	if base == "" {
+		return key
+	}
+
+	return base + "/" + key
+}
+
+// newAzblobClient creates a client for the storage account. AZURE_STORAGE_CONNECTION_STRING is used
+// when set, otherwise the AZURE_STORAGE_ACCOUNT is authenticated with AZURE_STORAGE_KEY when set, or
+// the default azure credentials, which include managed identities. The endpoint target option
+// overrides the account's blob endpoint, eg for azurite.
+func newAzblobClient(target *Target) (*azblob.Client, error) {
+	if connectionString := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); connectionString != "" {
+		return azblob.NewClientFromConnectionString(connectionString, nil)
+	}
+
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+
+	if account == "" {
+		return nil, fmt.Errorf("azure storage account not configured, set AZURE_STORAGE_ACCOUNT or AZURE_STORAGE_CONNECTION_STRING")
+	}
+
+	endpoint := target.Options.Get("endpoint")
+
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net/", account)
+	}
+
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		credential, err := azblob.NewSharedKeyCredential(account, key)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_KEY: %s", err)
+		}
+
+		return azblob.NewClientWithSharedKeyCredential(endpoint, credential, nil)
+	}
+
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return azblob.NewClient(endpoint, credential, nil)
+}
+
+// isRetryableAzblobError reports whether an upload failing with the error could succeed if retried,
+// which isn't the case for bad requests, authentication errors and missing containers.
+func isRetryableAzblobError(err error) bool {
+	if aerr, ok := err.(*azcore.ResponseError); ok {
+		return aerr.StatusCode != 400 && aerr.StatusCode != 401 && aerr.StatusCode != 403 && aerr.StatusCode != 404
+	}
+
+	return err != context.DeadlineExceeded && err != context.Canceled
+}
+
+// Azure only accepts metadata names that are valid C# identifiers, so hyphens are stored as
+// underscores.
+var azblobMetadataName = strings.NewReplacer("-", "_")
+var azblobMetadataKey = strings.NewReplacer("_", "-")
+
+// azblobString returns a pointer to the string, as the sdk's options take.
+func azblobString(s string) *string {
+	return &s
+}
+
+// azblobUploadOptions returns the options to upload the blob with, carrying its content type and,
+// for snapshots, their verification result as metadata.
+func azblobUploadOptions(name string) *azblob.UploadBufferOptions {
+	options := &azblob.UploadBufferOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: azblobString(ContentType(name))},
+	}
+
+	if metadata := ObjectMetadata(name); metadata != nil {
+		options.Metadata = map[string]*string{}
+
+		for k, v := range metadata {
+			options.Metadata[azblobMetadataName.Replace(k)] = azblobString(v)
+		}
+	}
+
+	return options
+}
+
+// uploadAzblobStream uploads the blob in blocks read from the body, which unlike UploadBuffer and
+// UploadFile reads the body through --upload-bandwidth-limit.
+func uploadAzblobStream(ctx context.Context, client *azblob.Client, container string, name string, body io.Reader, options *azblob.UploadBufferOptions) error {
+	_, err := client.UploadStream(ctx, container, name, throttleUpload(body), &azblob.UploadStreamOptions{
+		HTTPHeaders: options.HTTPHeaders,
+		Metadata:    options.Metadata,
+	})
+
+	return err
+}
+
+func sendToAzblob(target *Target, snapshotKey *string, snapshot *[]byte) error {
+	client, err := newAzblobClient(target)
+
+	if err != nil {
+		return err
+	}
+
+	name := azblobName(target, *snapshotKey)
+	options := azblobUploadOptions(name)
+
+	ctx, cancel := uploadContext()
+	defer cancel()
+
+	err = retryUpload("uploading to azure", isRetryableAzblobError, func() error {
+		if uploadLimiter != nil {
+			return uploadAzblobStream(ctx, client, target.Base, name, bytes.NewReader(*snapshot), options)
+		}
+
+		_, err := client.UploadBuffer(ctx, target.Base, name, *snapshot, options)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("saved snapshot to container %s at path %s", target.Base, name)
+
+	return nil
+}
+
+// sendFileToAzblob uploads the file at the path to the key in blocks read from the file, so it's
+// never held in memory in full.
+func sendFileToAzblob(target *Target, key string, path string) error {
+	client, err := newAzblobClient(target)
+
+	if err != nil {
+		return err
+	}
+
+	name := azblobName(target, key)
+	options := azblobUploadOptions(name)
+
+	ctx, cancel := uploadContext()
+	defer cancel()
+
+	err = retryUpload("uploading to azure", isRetryableAzblobError, func() error {
+		file, err := os.Open(path)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		if uploadLimiter != nil {
+			return uploadAzblobStream(ctx, client, target.Base, name, file, options)
+		}
+
+		_, err = client.UploadFile(ctx, target.Base, name, file, options)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("saved snapshot to container %s at path %s", target.Base, name)
+
+	return nil
+}
+
+// statAzblobPrefix returns the keys and sizes of the blobs under the target path that start with the
+// prefix, relative to the target path.
+func statAzblobPrefix(target *Target, prefix string) ([]ObjectInfo, error) {
+	client, err := newAzblobClient(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	base := azblobName(target, "")
+	pager := client.NewListBlobsFlatPager(target.Base, &azblob.ListBlobsFlatOptions{
+		Prefix: azblobString(base + prefix),
+	})
+
+	var objects []ObjectInfo
+
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			var size int64
+
+			if item.Properties != nil && item.Properties.ContentLength != nil {
+				size = *item.Properties.ContentLength
+			}
+
+			objects = append(objects, ObjectInfo{
+				Key:  strings.TrimPrefix(*item.Name, base),
+				Size: size,
+			})
+		}
+	}
+
+	return objects, nil
+}
+
+func listAzblob(target *Target, prefix string) ([]string, error) {
+	objects, err := statAzblobPrefix(target, prefix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+
+	return keys, nil
+}
+
+func deleteFromAzblob(target *Target, key string) error {
+	client, err := newAzblobClient(target)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DeleteBlob(context.Background(), target.Base, azblobName(target, key), nil)
+
+	return err
+}
+
+func fetchFromAzblob(target *Target) ([]byte, error) {
+	client, err := newAzblobClient(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.DownloadStream(context.Background(), target.Base, strings.TrimPrefix(target.Path, "/"), nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", target.Path, err)
+	}
+
+	defer response.Body.Close()
+
+	return ioutil.ReadAll(response.Body)
+}
+
+// statAzblob returns the keys and sizes of the blobs under the target path, relative to it.
+func statAzblob(target *Target) ([]ObjectInfo, error) {
+	return statAzblobPrefix(target, "")
+}
+
+// azblobObjectMetadata returns the metadata of the blob at the key under the target path.
+func azblobObjectMetadata(target *Target, key string) (map[string]string, error) {
+	client, err := newAzblobClient(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	properties, err := client.ServiceClient().NewContainerClient(target.Base).NewBlobClient(azblobName(target, key)).GetProperties(context.Background(), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]string{}
+
+	for k, v := range properties.Metadata {
+		if v != nil {
+			metadata[azblobMetadataKey.Replace(strings.ToLower(k))] = *v
+		}
+	}
+
+	return metadata, nil
+}
+
+// azblobProvider stores objects in azure blob storage.
+type azblobProvider struct{}
+
+func init() {
+	Register("azblob", azblobProvider{})
+}
+
+func (azblobProvider) Put(target *Target, key string, data []byte) error {
+	return sendToAzblob(target, &key, &data)
+}
+
+func (azblobProvider) PutFile(target *Target, key string, path string) error {
+	return sendFileToAzblob(target, key, path)
+}
+
+func (azblobProvider) Get(target *Target) ([]byte, error) {
+	return fetchFromAzblob(target)
+}
+
+func (azblobProvider) List(target *Target, prefix string) ([]string, error) {
+	return listAzblob(target, prefix)
+}
+
+func (azblobProvider) Delete(target *Target, key string) error {
+	return deleteFromAzblob(target, key)
+}
+
+func (azblobProvider) Stat(target *Target) ([]ObjectInfo, error) {
+	return statAzblob(target)
+}
+
+func (azblobProvider) Metadata(target *Target, key string) (map[string]string, error) {
+	return azblobObjectMetadata(target, key)
+}
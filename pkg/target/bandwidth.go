@@ -0,0 +1,145 @@
+package target
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bandwidthLimiter paces reads to a rate in bytes per second, shared by every reader throttled by
+// it, so uploads to several targets at once stay within the rate between them.
+type bandwidthLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// uploadLimiter limits the rate uploads are sent at when --upload-bandwidth-limit is set, nil
+// otherwise.
+var uploadLimiter *bandwidthLimiter
+
+// bandwidthUnits are the multipliers of the units a bandwidth can be given in, where K, M and G
+// are binary as with rclone's --bwlimit.
+var bandwidthUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+}
+
+// parseBandwidth parses a rate such as 10MiB/s, 500KB/s or 1048576 into bytes per second.
+func parseBandwidth(value string) (int64, error) {
+	trimmed := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "/s")
+	number := strings.TrimRightFunc(trimmed, func(r rune) bool { return r >= 'a' && r <= 'z' })
+
+	multiplier, ok := bandwidthUnits[strings.TrimSpace(trimmed[len(number):])]
+	parsed, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+
+	if !ok || err != nil || parsed <= 0 || int64(parsed*float64(multiplier)) < 1 {
+		return 0, fmt.Errorf("invalid bandwidth limit '%s', expected a rate such as 10MiB/s, 500KB/s or a number of bytes per second", value)
+	}
+
+	return int64(parsed * float64(multiplier)), nil
+}
+
+// SetBandwidthLimit limits the rate of uploads to the bandwidth, or leaves them unlimited
+// when it's empty.
+func SetBandwidthLimit(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	rate, err := parseBandwidth(value)
+
+	if err != nil {
+		return err
+	}
+
+	uploadLimiter = &bandwidthLimiter{rate: rate}
+
+	return nil
+}
+
+// BandwidthLimit returns the rate uploads are limited to in bytes per second, or 0 when they're
+// unlimited.
+func BandwidthLimit() int64 {
+	if uploadLimiter == nil {
+		return 0
+	}
+
+	return uploadLimiter.rate
+}
+
+// wait blocks until n more bytes can be sent without exceeding the rate.
+func (l *bandwidthLimiter) wait(n int) {
+	l.mu.Lock()
+
+	now := time.Now()
+
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// chunkSize is the most read at once, a tenth of a second's worth so the pacing stays smooth.
+func (l *bandwidthLimiter) chunkSize() int {
+	size := l.rate / 10
+
+	if size < 1 {
+		return 1
+	}
+
+	if size > 64*1024 {
+		return 64 * 1024
+	}
+
+	return int(size)
+}
+
+// throttledReader reads from the reader at the limiter's rate.
+type throttledReader struct {
+	reader  io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if size := r.limiter.chunkSize(); len(p) > size {
+		p = p[:size]
+	}
+
+	n, err := r.reader.Read(p)
+
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+
+	return n, err
+}
+
+// throttleUpload returns the reader limited to --upload-bandwidth-limit, or the reader itself when
+// uploads aren't limited. The throttled reader deliberately hides any Seek or ReadAt of the reader,
+// so clients that would otherwise read the body directly go through the limit.
+func throttleUpload(reader io.Reader) io.Reader {
+	if uploadLimiter == nil {
+		return reader
+	}
+
+	return &throttledReader{reader: reader, limiter: uploadLimiter}
+}
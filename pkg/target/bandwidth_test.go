@@ -0,0 +1,71 @@
+package target
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"10MiB/s": 10 << 20,
+		"10MB/s":  10 * 1000 * 1000,
+		"500kb/s": 500 * 1000,
+		"1.5M":    3 << 19,
+		"2 GiB/s": 2 << 30,
+		"4096":    4096,
+		"512B/s":  512,
+	} {
+		rate, err := parseBandwidth(value)
+
+		if err != nil {
+			t.Errorf("parsing %s: %s", value, err)
+		} else if rate != expected {
+			t.Errorf("parsing %s gave %d, expected %d", value, rate, expected)
+		}
+	}
+
+	for _, value := range []string{"", "fast", "10TB/s", "-1MiB/s", "0", "0.1"} {
+		if _, err := parseBandwidth(value); err == nil {
+			t.Errorf("expected parsing '%s' to fail", value)
+		}
+	}
+}
+
+func TestThrottleUploadLimitsRate(t *testing.T) {
+	defer func() { uploadLimiter = nil }()
+
+	reader := bytes.NewReader(nil)
+
+	if throttleUpload(reader) != io.Reader(reader) {
+		t.Fatal("expected an unlimited upload to be read directly")
+	}
+
+	if err := SetBandwidthLimit("10KiB/s"); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 5*1024)
+	start := time.Now()
+
+	// Readers share the limit, so two halves take as long as the whole.
+	for _, half := range [][]byte{data[:len(data)/2], data[len(data)/2:]} {
+		read, err := ioutil.ReadAll(throttleUpload(bytes.NewReader(half)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(read, half) {
+			t.Fatal("throttled reader changed the data")
+		}
+	}
+
+	// 5KiB at 10KiB/s takes half a second, less the first chunk, which the limiter lets through
+	// without waiting.
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("read 5KiB in %s, expected close to 500ms at 10KiB/s", elapsed)
+	}
+}
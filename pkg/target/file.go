@@ -0,0 +1,237 @@
+package target
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fileDir returns the directory a file target stores its snapshots in.
+func fileDir(target *Target) string {
+	return filepath.FromSlash(target.Base + target.Path)
+}
+
+// fileMode returns the permissions for stored files from the octal mode target option.
+func fileMode(target *Target) (os.FileMode, error) {
+	mode := target.Options.Get("mode")
+
+	if mode == "" {
+		return 0644, nil
+	}
+
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode '%s'", mode)
+	}
+
+	return os.FileMode(parsed), nil
+}
+
+func sendToFile(target *Target, snapshotKey *string, snapshot *[]byte) error {
+	return sendToFileFrom(target, *snapshotKey, BytesSource(*snapshot))
+}
+
+// sendToFileFrom stores the data read from the source under the key.
+func sendToFileFrom(target *Target, key string, source Source) error {
+	mode, err := fileMode(target)
+
+	if err != nil {
+		return err
+	}
+
+	filePath := filepath.Join(fileDir(target), filepath.FromSlash(key))
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+
+	// Writing to a temporary file and renaming it over the key replaces the file atomically, so
+	// readers such as those following a pointer never see it partially written.
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	data, err := source()
+
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	_, err = io.Copy(tmp, throttleUpload(data))
+	data.Close()
+
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// Syncing before the rename means a crash, or an nfs server restarting, can't leave the key
+	// pointing at a file whose contents never reached the disk.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// The mode is applied explicitly as temporary files are created 0600.
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return err
+	}
+
+	if err := syncDir(filepath.Dir(filePath)); err != nil {
+		return err
+	}
+
+	log.Infof("saved snapshot to %s", filePath)
+
+	return nil
+}
+
+// syncDir flushes the directory's entries to disk, so renames into it are durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+func listFile(target *Target, prefix string) ([]string, error) {
+	dir := fileDir(target)
+
+	var keys []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Nothing has been stored yet.
+			if os.IsNotExist(err) && path == dir {
+				return nil
+			}
+
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+
+		if err != nil {
+			return err
+		}
+
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func deleteFromFile(target *Target, key string) error {
+	return os.Remove(filepath.Join(fileDir(target), filepath.FromSlash(key)))
+}
+
+func fetchFromFile(target *Target) ([]byte, error) {
+	return ioutil.ReadFile(fileDir(target))
+}
+
+func statFile(target *Target) ([]ObjectInfo, error) {
+	dir := fileDir(target)
+
+	var objects []ObjectInfo
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return nil
+			}
+
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:  filepath.ToSlash(rel),
+			Size: info.Size(),
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// fileProvider stores objects in local directories.
+type fileProvider struct{}
+
+func init() {
+	Register("file", fileProvider{})
+}
+
+func (fileProvider) Put(target *Target, key string, data []byte) error {
+	return sendToFile(target, &key, &data)
+}
+
+func (fileProvider) PutFile(target *Target, key string, path string) error {
+	return sendToFileFrom(target, key, FileSource(path))
+}
+
+func (fileProvider) Get(target *Target) ([]byte, error) {
+	return fetchFromFile(target)
+}
+
+func (fileProvider) List(target *Target, prefix string) ([]string, error) {
+	return listFile(target, prefix)
+}
+
+func (fileProvider) Delete(target *Target, key string) error {
+	return deleteFromFile(target, key)
+}
+
+func (fileProvider) Stat(target *Target) ([]ObjectInfo, error) {
+	return statFile(target)
+}
@@ -0,0 +1,266 @@
+package target
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// gcsObjectName returns the object name of a key under the target path. Unlike s3, gcs keeps a
+// leading slash as part of the name, so it's trimmed to match the layout of s3 targets.
+func gcsObjectName(target *Target, key string) string {
+	base := strings.Trim(target.Path, "/")
+
+	if base == "" {
+		return key
+	}
+
+	return base + "/" + key
+}
+
+// gcsBucket returns the target bucket. With the project target option, requests are billed to that
+// project, as requester pays buckets need.
+func gcsBucket(client *storage.Client, target *Target) *storage.BucketHandle {
+	bucket := client.Bucket(target.Base)
+
+	if project := target.Options.Get("project"); project != "" {
+		bucket = bucket.UserProject(project)
+	}
+
+	return bucket
+}
+
+// newGCSClient creates a gcs client using the application default credentials, which includes a
+// GOOGLE_APPLICATION_CREDENTIALS service account file.
+func newGCSClient() (*storage.Client, error) {
+	return storage.NewClient(context.Background())
+}
+
+// isRetryableGCSError reports whether an upload failing with the error could succeed if retried,
+// which isn't the case for bad requests, permission errors and missing buckets.
+func isRetryableGCSError(err error) bool {
+	if gerr, ok := err.(*googleapi.Error); ok {
+		return gerr.Code != 400 && gerr.Code != 401 && gerr.Code != 403 && gerr.Code != 404
+	}
+
+	return err != context.DeadlineExceeded && err != context.Canceled
+}
+
+func sendToGCS(target *Target, snapshotKey *string, snapshot *[]byte) error {
+	return sendToGCSFrom(target, *snapshotKey, BytesSource(*snapshot))
+}
+
+// sendToGCSFrom uploads the data read from the source to the key.
+func sendToGCSFrom(target *Target, key string, source Source) error {
+	client, err := newGCSClient()
+
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	name := gcsObjectName(target, key)
+
+	ctx, cancel := uploadContext()
+	defer cancel()
+
+	err = retryUpload("uploading to gcs", isRetryableGCSError, func() error {
+		data, err := source()
+
+		if err != nil {
+			return err
+		}
+
+		defer data.Close()
+
+		// Closing the writer commits whatever was written, so a failed copy cancels the upload
+		// rather than storing part of the object.
+		attemptCtx, cancelAttempt := context.WithCancel(ctx)
+		defer cancelAttempt()
+
+		writer := gcsBucket(client, target).Object(name).NewWriter(attemptCtx)
+		writer.ContentType = ContentType(name)
+		writer.Metadata = ObjectMetadata(name)
+
+		if _, err := io.Copy(writer, throttleUpload(data)); err != nil {
+			cancelAttempt()
+			writer.Close()
+			return err
+		}
+
+		return writer.Close()
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("saved snapshot to bucket %s at path %s", target.Base, name)
+
+	return nil
+}
+
+func listGCS(target *Target, prefix string) ([]string, error) {
+	client, err := newGCSClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	base := gcsObjectName(target, "")
+	objects := gcsBucket(client, target).Objects(context.Background(), &storage.Query{
+		Prefix: base + prefix,
+	})
+
+	var keys []string
+
+	for {
+		object, err := objects.Next()
+
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, strings.TrimPrefix(object.Name, base))
+	}
+
+	return keys, nil
+}
+
+func deleteFromGCS(target *Target, key string) error {
+	client, err := newGCSClient()
+
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	return gcsBucket(client, target).Object(gcsObjectName(target, key)).Delete(context.Background())
+}
+
+func fetchFromGCS(target *Target) ([]byte, error) {
+	client, err := newGCSClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	reader, err := gcsBucket(client, target).Object(strings.TrimPrefix(target.Path, "/")).NewReader(context.Background())
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", target.Path, err)
+	}
+
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// statGCS returns the keys and sizes of the objects under the target path, relative to it.
+func statGCS(target *Target) ([]ObjectInfo, error) {
+	client, err := newGCSClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	base := gcsObjectName(target, "")
+	iter := gcsBucket(client, target).Objects(context.Background(), &storage.Query{
+		Prefix: base,
+	})
+
+	var objects []ObjectInfo
+
+	for {
+		object, err := iter.Next()
+
+		if err == iterator.Done {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:  strings.TrimPrefix(object.Name, base),
+			Size: object.Size,
+		})
+	}
+
+	return objects, nil
+}
+
+// gcsObjectMetadata returns the metadata of the object at the key under the target path.
+func gcsObjectMetadata(target *Target, key string) (map[string]string, error) {
+	client, err := newGCSClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	attrs, err := gcsBucket(client, target).Object(gcsObjectName(target, key)).Attrs(context.Background())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return attrs.Metadata, nil
+}
+
+// gcsProvider stores objects in google cloud storage.
+type gcsProvider struct{}
+
+func init() {
+	Register("gs", gcsProvider{})
+	Register("gcs", gcsProvider{})
+}
+
+func (gcsProvider) Put(target *Target, key string, data []byte) error {
+	return sendToGCS(target, &key, &data)
+}
+
+func (gcsProvider) PutFile(target *Target, key string, path string) error {
+	return sendToGCSFrom(target, key, FileSource(path))
+}
+
+func (gcsProvider) Get(target *Target) ([]byte, error) {
+	return fetchFromGCS(target)
+}
+
+func (gcsProvider) List(target *Target, prefix string) ([]string, error) {
+	return listGCS(target, prefix)
+}
+
+func (gcsProvider) Delete(target *Target, key string) error {
+	return deleteFromGCS(target, key)
+}
+
+func (gcsProvider) Stat(target *Target) ([]ObjectInfo, error) {
+	return statGCS(target)
+}
+
+func (gcsProvider) Metadata(target *Target, key string) (map[string]string, error) {
+	return gcsObjectMetadata(target, key)
+}
@@ -0,0 +1,103 @@
+package target
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Provider stores objects in one type of target. Providers register themselves by target type, the
+// scheme of target uris, so a new one is added in its own file without touching the rest.
+type Provider interface {
+	// Put uploads the data to the key under the target path.
+	Put(target *Target, key string, data []byte) error
+	// Get downloads the object at the target path.
+	Get(target *Target) ([]byte, error)
+	// List returns the keys of the objects under the target path that start with the prefix,
+	// relative to the target path.
+	List(target *Target, prefix string) ([]string, error)
+	// Delete removes the key under the target path.
+	Delete(target *Target, key string) error
+	// Stat lists the objects under the target path along with their sizes.
+	Stat(target *Target) ([]ObjectInfo, error)
+}
+
+// MetadataProvider is implemented by providers that store metadata on objects.
+type MetadataProvider interface {
+	// Metadata returns the metadata stored on the key under the target path.
+	Metadata(target *Target, key string) (map[string]string, error)
+}
+
+// StreamProvider is implemented by providers that can upload a file from disk without reading it
+// into memory, as snapshots spooled with --spool-dir are.
+type StreamProvider interface {
+	// PutFile uploads the file at the path to the key under the target path.
+	PutFile(target *Target, key string, path string) error
+}
+
+// Source opens the data to upload. It's opened again for each attempt, so a failed upload can
+// be retried from the start.
+type Source func() (io.ReadCloser, error)
+
+// BytesSource returns an upload source for data held in memory.
+func BytesSource(data []byte) Source {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+// FileSource returns an upload source for the file at the path.
+func FileSource(path string) Source {
+	return func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+// ObjectInfo describes an object stored in a target.
+type ObjectInfo struct {
+	Key  string
+	Size int64
+}
+
+// Providers are the registered providers, keyed by target type.
+var Providers = map[string]Provider{}
+
+// Register makes the provider available for targets of the type.
+func Register(targetType string, provider Provider) {
+	Providers[targetType] = provider
+}
+
+// Validate checks a provider is registered for the target's type, that s3 targets' options are
+// valid and that rclone is installed for rclone targets, so mistakes are reported at startup rather
+// than once the snapshot is taken.
+func Validate(target *Target) error {
+	if _, ok := Providers[target.Type]; !ok {
+		return fmt.Errorf("target type of %s is not supported, expected one of: %s", target.Type, strings.Join(Types(), ", "))
+	}
+
+	switch target.Type {
+	case "s3":
+		return validateS3Target(target)
+	case "rclone":
+		return validateRcloneTarget()
+	}
+
+	return nil
+}
+
+// Types returns the target types a provider is registered for, sorted.
+func Types() []string {
+	var types []string
+
+	for t := range Providers {
+		types = append(types, t)
+	}
+
+	sort.Strings(types)
+
+	return types
+}
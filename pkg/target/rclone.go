@@ -0,0 +1,204 @@
+package target
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rclonePath returns the rclone remote path of a key under the target path, eg remote:backups/key.
+func rclonePath(target *Target, key string) string {
+	base := strings.Trim(target.Path, "/")
+
+	if base != "" && key != "" {
+		base += "/"
+	}
+
+	return target.Base + ":" + base + key
+}
+
+// validateRcloneTarget checks the rclone binary rclone targets run is on the PATH. It isn't part of
+// the docker image, which has nothing but the consul-backup binary.
+func validateRcloneTarget() error {
+	if _, err := exec.LookPath("rclone"); err != nil {
+		return fmt.Errorf("rclone targets need the rclone binary on the PATH, which the docker image doesn't include: %s", err)
+	}
+
+	return nil
+}
+
+// runRclone runs an rclone command against the target's remote, passing the config target option
+// on as the rclone config file. Stderr is included in the error when the command fails.
+func runRclone(ctx context.Context, target *Target, stdin []byte, command string, args ...string) ([]byte, error) {
+	args = append([]string{command}, args...)
+
+	if config := target.Options.Get("config"); config != "" {
+		args = append([]string{"--config", config}, args...)
+	}
+
+	cmd := exec.CommandContext(ctx, "rclone", args...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if stdin != nil {
+		cmd.Stdin = throttleUpload(bytes.NewReader(stdin))
+	}
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("rclone %s failed: %s: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// sendToRclone uploads the snapshot to an rclone remote by piping it to rclone rcat, giving access
+// to every backend rclone supports with the remotes already configured for it.
+func sendToRclone(target *Target, snapshotKey *string, snapshot *[]byte) error {
+	remotePath := rclonePath(target, *snapshotKey)
+
+	ctx, cancel := uploadContext()
+	defer cancel()
+
+	// Rclone failures are all retried, as its exit codes say little about whether retrying can help.
+	err := retryUpload("uploading with rclone", func(error) bool { return true }, func() error {
+		_, err := runRclone(ctx, target, *snapshot, "rcat", remotePath)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("saved snapshot to %s", remotePath)
+
+	return nil
+}
+
+// sendFileToRclone uploads the file at the path to an rclone remote with rclone copyto, which reads
+// it from disk rather than it being held in memory.
+func sendFileToRclone(target *Target, key string, path string) error {
+	remotePath := rclonePath(target, key)
+
+	ctx, cancel := uploadContext()
+	defer cancel()
+
+	err := retryUpload("uploading with rclone", func(error) bool { return true }, func() error {
+		args := []string{path, remotePath}
+
+		// rclone reads the file itself, so the limit is passed on to it, in its KiB/s.
+		if uploadLimiter != nil {
+			args = append(args, "--bwlimit", fmt.Sprintf("%dk", (uploadLimiter.rate+1023)/1024))
+		}
+
+		_, err := runRclone(ctx, target, nil, "copyto", args...)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("saved snapshot to %s", remotePath)
+
+	return nil
+}
+
+func listRclone(target *Target, prefix string) ([]string, error) {
+	output, err := runRclone(context.Background(), target, nil, "lsf", "--recursive", "--files-only", rclonePath(target, ""))
+
+	if err != nil {
+		// Nothing has been stored yet.
+		if strings.Contains(err.Error(), "directory not found") {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var keys []string
+
+	for _, key := range strings.Split(string(output), "\n") {
+		if key != "" && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func deleteFromRclone(target *Target, key string) error {
+	_, err := runRclone(context.Background(), target, nil, "deletefile", rclonePath(target, key))
+
+	return err
+}
+
+func fetchFromRclone(target *Target) ([]byte, error) {
+	return runRclone(context.Background(), target, nil, "cat", rclonePath(target, ""))
+}
+
+func statRclone(target *Target) ([]ObjectInfo, error) {
+	output, err := runRclone(context.Background(), target, nil, "lsjson", "--recursive", "--files-only", rclonePath(target, ""))
+
+	if err != nil {
+		if strings.Contains(err.Error(), "directory not found") {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var entries []struct {
+		Path string
+		Size int64
+	}
+
+	if err := json.Unmarshal(output, &entries); err != nil {
+		return nil, fmt.Errorf("error decoding rclone lsjson output: %s", err)
+	}
+
+	objects := make([]ObjectInfo, 0, len(entries))
+
+	for _, entry := range entries {
+		objects = append(objects, ObjectInfo{Key: entry.Path, Size: entry.Size})
+	}
+
+	return objects, nil
+}
+
+// rcloneProvider stores objects in any rclone remote.
+type rcloneProvider struct{}
+
+func init() {
+	Register("rclone", rcloneProvider{})
+}
+
+func (rcloneProvider) Put(target *Target, key string, data []byte) error {
+	return sendToRclone(target, &key, &data)
+}
+
+func (rcloneProvider) PutFile(target *Target, key string, path string) error {
+	return sendFileToRclone(target, key, path)
+}
+
+func (rcloneProvider) Get(target *Target) ([]byte, error) {
+	return fetchFromRclone(target)
+}
+
+func (rcloneProvider) List(target *Target, prefix string) ([]string, error) {
+	return listRclone(target, prefix)
+}
+
+func (rcloneProvider) Delete(target *Target, key string) error {
+	return deleteFromRclone(target, key)
+}
+
+func (rcloneProvider) Stat(target *Target) ([]ObjectInfo, error) {
+	return statRclone(target)
+}
@@ -0,0 +1,80 @@
+package target
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Retries is how many times a failed upload to a target is retried.
+var Retries = 3
+
+// Backoff is the delay before the first upload retry, doubling for each retry after it.
+var Backoff = time.Second * 5
+
+// RetryMaxWait is the longest to wait between upload retries however far the backoff has doubled,
+// when set.
+var RetryMaxWait time.Duration
+
+// OnRetry is called with how many times an upload was retried once it's succeeded or given up, for
+// the run to count them.
+var OnRetry = func(retries int) {}
+
+// retryUpload calls fn until it succeeds with the policy of Retry, within Context.
+func retryUpload(description string, retryable func(error) bool, fn func() error) error {
+	retries, err := Retry(Context, description, retryable, fn)
+	OnRetry(retries)
+
+	return err
+}
+
+// Retry calls fn until it succeeds, retrying up to Retries times with an exponential backoff from
+// Backoff, plus up to a quarter again of jitter so uploads failing together don't retry together,
+// and never waiting longer than RetryMaxWait. Errors retryable reports false for are returned
+// straight away, as retrying them can't succeed, as is the last error once the context is done. It
+// returns how many times it retried along with the last error.
+func Retry(ctx context.Context, description string, retryable func(error) bool, fn func() error) (int, error) {
+	err := fn()
+	delay := Backoff
+	attempt := 1
+
+	for ; err != nil && attempt <= Retries; attempt++ {
+		if !retryable(err) {
+			log.Debugf("not retrying %s, the error can't be fixed by retrying", description)
+			return attempt - 1, err
+		}
+
+		if ctx.Err() != nil {
+			return attempt - 1, err
+		}
+
+		wait := delay
+
+		if jitter := int64(delay / 4); jitter > 0 {
+			wait += time.Duration(rand.Int63n(jitter))
+		}
+
+		if RetryMaxWait > 0 && wait > RetryMaxWait {
+			wait = RetryMaxWait
+		}
+
+		log.Warnf("error %s, retrying in %s for retry %d/%d: %s", description, wait.Round(time.Millisecond), attempt, Retries, err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return attempt - 1, err
+		}
+
+		err = fn()
+		delay *= 2
+	}
+
+	if err == nil {
+		log.Debugf("succeeded %s after %d retries", description, attempt-1)
+	}
+
+	return attempt - 1, err
+}
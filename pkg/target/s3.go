@@ -0,0 +1,740 @@
+package target
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+// S3CreateBucket creates the target bucket when it doesn't exist yet.
+var S3CreateBucket bool
+
+// S3TTL is how long uploaded objects should be kept for, exposed to lifecycle rules through the
+// expires-at tag and the Expires header.
+var S3TTL time.Duration
+
+// S3StorageClass, S3SSE and S3KMSKeyID apply to s3 targets without a storage-class, sse or
+// kms-key-id option respectively.
+var S3StorageClass string
+var S3SSE string
+var S3KMSKeyID string
+
+// s3Option returns the named option of the target, or the fallback when it isn't given.
+func s3Option(target *Target, name string, fallback string) string {
+	if value := target.Options.Get(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// validateS3Target checks the target's options, so mistakes in them are reported at startup rather
+// than once the snapshot is taken.
+func validateS3Target(target *Target) error {
+	if _, err := newS3Service(target); err != nil {
+		return err
+	}
+
+	_, err := s3PutObjectInput(target, "", nil)
+
+	return err
+}
+
+// S3PartSize is the size of the parts uploads larger than it are split into, uploaded
+// S3UploadConcurrency at a time.
+var S3PartSize int64 = s3manager.DefaultUploadPartSize
+var S3UploadConcurrency = s3manager.DefaultUploadConcurrency
+
+// ValidateS3Upload checks the part size and concurrency of s3 uploads.
+func ValidateS3Upload() error {
+	if S3PartSize < s3manager.MinUploadPartSize {
+		return fmt.Errorf("upload part size must be at least %d bytes, s3's minimum", s3manager.MinUploadPartSize)
+	}
+
+	if S3UploadConcurrency < 1 {
+		return fmt.Errorf("upload concurrency must be at least 1")
+	}
+
+	return nil
+}
+
+// s3Slots bounds the number of s3 api calls in flight at once across all targets when set, with
+// s3SlotsHeld recording the requests holding one.
+var s3Slots chan struct{}
+var s3SlotsHeld sync.Map
+
+// SetS3MaxConcurrency limits the number of s3 api calls in flight at once across all targets to n,
+// or leaves them unlimited when it's 0.
+func SetS3MaxConcurrency(n int) {
+	if n > 0 {
+		s3Slots = make(chan struct{}, n)
+	}
+}
+
+// s3StorageClasses are the storage classes accepted by the storage-class target option.
+var s3StorageClasses = map[string]bool{
+	s3.StorageClassStandard:           true,
+	s3.StorageClassReducedRedundancy:  true,
+	s3.StorageClassStandardIa:         true,
+	s3.StorageClassOnezoneIa:          true,
+	s3.StorageClassIntelligentTiering: true,
+	s3.StorageClassGlacier:            true,
+	s3.StorageClassDeepArchive:        true,
+}
+
+// s3NonRetryableCodes are the error codes of s3 uploads that retrying can't fix.
+var s3NonRetryableCodes = map[string]bool{
+	"AccessDenied":            true,
+	"NoSuchBucket":            true,
+	"InvalidBucketName":       true,
+	"InvalidAccessKeyId":      true,
+	"SignatureDoesNotMatch":   true,
+	"NoCredentialProviders":   true,
+	request.CanceledErrorCode: true,
+}
+
+// isRetryableS3Error reports whether an upload failing with the error could succeed if retried.
+func isRetryableS3Error(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return !s3NonRetryableCodes[aerr.Code()]
+	}
+
+	return true
+}
+
+// sendToS3 uploads the snapshot to the target bucket. The storage-class, sse, kms-key-id, tag and
+// metadata target options are applied to the object, tag and metadata can be repeated and take
+// key:value pairs.
+func sendToS3(target *Target, snapshotKey *string, snapshot *[]byte) error {
+	svc, err := newS3Service(target)
+
+	if err != nil {
+		return err
+	}
+
+	if S3CreateBucket {
+		if err := ensureS3Bucket(svc, target.Base, aws.StringValue(svc.Config.Region)); err != nil {
+			return err
+		}
+	}
+
+	input, err := s3PutObjectInput(target, *snapshotKey, ObjectMetadata(*snapshotKey))
+
+	if err != nil {
+		return err
+	}
+
+	s3Path := *input.Key
+
+	ctx, cancel := uploadContext()
+	defer cancel()
+
+	if int64(len(*snapshot)) > S3PartSize || uploadLimiter != nil {
+		// Large snapshots are uploaded in parts, so a slow link doesn't have to carry the whole
+		// snapshot in a single request. Limited uploads go through the uploader too, as signing a
+		// PutObject reads the body to hash it before sending it, halving the rate it's sent at.
+		err = retryUpload("uploading to aws", isRetryableS3Error, func() error {
+			return uploadToS3(ctx, svc, input, bytes.NewReader(*snapshot))
+		})
+	} else {
+		// S3 rejects the upload if the body it receives doesn't match the digest.
+		sum := md5.Sum(*snapshot)
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+
+		err = retryUpload("uploading to aws", isRetryableS3Error, func() error {
+			input.Body = bytes.NewReader(*snapshot)
+			_, err := svc.PutObjectWithContext(ctx, input)
+			return err
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("saved snapshot to bucket %s at path %s", target.Base, s3Path)
+
+	return nil
+}
+
+// s3PutObjectInput builds the upload of the key to the target bucket, without a body, applying the
+// target options to the object along with the given metadata.
+func s3PutObjectInput(target *Target, key string, metadata map[string]string) (*s3.PutObjectInput, error) {
+	s3Path := fmt.Sprintf("%s/%s", target.Path, key)
+
+	input := &s3.PutObjectInput{
+		Bucket:      &target.Base,
+		Key:         &s3Path,
+		ContentType: aws.String(ContentType(key)),
+	}
+
+	if storageClass := s3Option(target, "storage-class", S3StorageClass); storageClass != "" {
+		if !s3StorageClasses[storageClass] {
+			return nil, fmt.Errorf("unsupported s3 storage class '%s'", storageClass)
+		}
+
+		input.StorageClass = aws.String(storageClass)
+	}
+
+	// Without a kms-key-id, aws:kms encrypts with the bucket's default kms key.
+	if sse := s3Option(target, "sse", S3SSE); sse != "" {
+		if sse != s3.ServerSideEncryptionAes256 && sse != s3.ServerSideEncryptionAwsKms {
+			return nil, fmt.Errorf("unsupported s3 server side encryption '%s', expected %s or %s", sse, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+		}
+
+		input.ServerSideEncryption = aws.String(sse)
+	}
+
+	if kmsKeyID := s3Option(target, "kms-key-id", S3KMSKeyID); kmsKeyID != "" {
+		if aws.StringValue(input.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms {
+			return nil, fmt.Errorf("the s3 kms-key-id option needs sse=%s", s3.ServerSideEncryptionAwsKms)
+		}
+
+		input.SSEKMSKeyId = aws.String(kmsKeyID)
+	}
+
+	parsedTags, err := parseKeyValues(target.Options["tag"])
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 tag: %s", err)
+	}
+
+	tagging := url.Values{}
+
+	for k, v := range parsedTags {
+		tagging.Set(k, v)
+	}
+
+	if S3TTL > 0 {
+		expiresAt := time.Now().Add(S3TTL).UTC()
+		input.Expires = &expiresAt
+		tagging.Set("expires-at", expiresAt.Format(time.RFC3339))
+	}
+
+	if len(tagging) > 0 {
+		input.Tagging = aws.String(tagging.Encode())
+	}
+
+	if options := target.Options["metadata"]; len(options) > 0 {
+		parsedMetadata, err := parseKeyValues(options)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 metadata: %s", err)
+		}
+
+		// Copying it leaves the caller's metadata as it was, and means a nil one can be added to.
+		combined := make(map[string]string, len(metadata)+len(parsedMetadata))
+
+		for k, v := range metadata {
+			combined[k] = v
+		}
+
+		for k, v := range parsedMetadata {
+			combined[k] = v
+		}
+
+		metadata = combined
+	}
+
+	if len(metadata) > 0 {
+		input.Metadata = aws.StringMap(metadata)
+	}
+
+	return input, nil
+}
+
+// sendFileToS3 uploads the file at the path to the key in parts, so it's never held in memory in
+// full. The file is reopened for each attempt, so unlike a stream from consul the upload can be
+// retried.
+func sendFileToS3(target *Target, key string, path string) error {
+	metadata := ObjectMetadata(key)
+
+	return retryUpload("uploading to aws", isRetryableS3Error, func() error {
+		file, err := os.Open(path)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		return StreamToS3(target, key, file, metadata)
+	})
+}
+
+// uploadToS3 uploads the body as the object described by the input in parts of S3PartSize, with
+// S3UploadConcurrency parts in flight at once.
+func uploadToS3(ctx context.Context, svc *s3.S3, input *s3.PutObjectInput, body io.Reader) error {
+	uploader := s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+		u.PartSize = S3PartSize
+		u.Concurrency = S3UploadConcurrency
+	})
+
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		Body:                 throttleUpload(body),
+		ContentType:          input.ContentType,
+		StorageClass:         input.StorageClass,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+		Tagging:              input.Tagging,
+		Metadata:             input.Metadata,
+		Expires:              input.Expires,
+	})
+
+	return err
+}
+
+// StreamToS3 uploads the snapshot as it's read from the reader, in parts, so it's never held in
+// memory in full, storing the metadata on the object. Unlike sendToS3 the upload isn't retried, as
+// the reader can only be read once.
+func StreamToS3(target *Target, snapshotKey string, snapshot io.Reader, metadata map[string]string) error {
+	svc, err := newS3Service(target)
+
+	if err != nil {
+		return err
+	}
+
+	if S3CreateBucket {
+		if err := ensureS3Bucket(svc, target.Base, aws.StringValue(svc.Config.Region)); err != nil {
+			return err
+		}
+	}
+
+	input, err := s3PutObjectInput(target, snapshotKey, metadata)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := uploadContext()
+	defer cancel()
+
+	if err := uploadToS3(ctx, svc, input, snapshot); err != nil {
+		return err
+	}
+
+	log.Infof("saved snapshot to bucket %s at path %s", target.Base, *input.Key)
+
+	return nil
+}
+
+// listS3 returns the keys of the objects under the target path that start with the prefix,
+// relative to the target path.
+func listS3(target *Target, prefix string) ([]string, error) {
+	svc, err := newS3Service(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Object keys are stored without the leading slash of the target path.
+	base := strings.Trim(target.Path, "/")
+
+	if base != "" {
+		base += "/"
+	}
+
+	var keys []string
+
+	err = svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &target.Base,
+		Prefix: aws.String(base + prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(*object.Key, base))
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// deleteFromS3 deletes the object stored at the key under the target path.
+func deleteFromS3(target *Target, key string) error {
+	svc, err := newS3Service(target)
+
+	if err != nil {
+		return err
+	}
+
+	s3Path := fmt.Sprintf("%s/%s", target.Path, key)
+
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: &target.Base,
+		Key:    &s3Path,
+	})
+
+	return err
+}
+
+// fetchFromS3 downloads the snapshot object the target path points at.
+func fetchFromS3(target *Target) ([]byte, error) {
+	svc, err := newS3Service(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: &target.Base,
+		Key:    &target.Path,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer output.Body.Close()
+
+	return ioutil.ReadAll(output.Body)
+}
+
+func newS3Service(target *Target) (*s3.S3, error) {
+	config := &aws.Config{}
+
+	// An empty region would override the one the sdk finds in the environment, so only set it when
+	// one is available.
+	for _, region := range []string{target.Options.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if region != "" {
+			config.Region = aws.String(region)
+			break
+		}
+	}
+
+	endpoint := target.Options.Get("endpoint")
+
+	// S3 compatible stores such as minio mostly ignore the region, but requests still need one.
+	if config.Region == nil && endpoint != "" {
+		config.Region = aws.String("us-east-1")
+	}
+
+	if config.Region == nil {
+		return nil, fmt.Errorf("no s3 region configured, set the region target option or AWS_REGION")
+	}
+
+	creds, err := s3Credentials(target, aws.StringValue(config.Region))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Without any credential options the sdk's default chain is used.
+	config.Credentials = creds
+
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+
+	// S3 compatible stores are typically only addressable with path style requests, so they're used
+	// with an endpoint unless force-path-style says otherwise.
+	forcePathStyle := endpoint != ""
+
+	if value := target.Options.Get("force-path-style"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 force-path-style '%s', expected true or false", value)
+		}
+
+		forcePathStyle = parsed
+	}
+
+	config.S3ForcePathStyle = aws.Bool(forcePathStyle)
+
+	sess, err := session.NewSession(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	svc := s3.New(sess)
+
+	if s3Slots != nil {
+		// A request cancelled while waiting for a slot goes on without one, and fails straight away
+		// sending with its cancelled context.
+		svc.Handlers.Send.PushFront(func(r *request.Request) {
+			select {
+			case s3Slots <- struct{}{}:
+				s3SlotsHeld.Store(r, true)
+			case <-r.Context().Done():
+			}
+		})
+		svc.Handlers.Send.PushBack(func(r *request.Request) {
+			if _, held := s3SlotsHeld.LoadAndDelete(r); held {
+				<-s3Slots
+			}
+		})
+	}
+
+	return svc, nil
+}
+
+// s3CredentialsCache holds the credentials of each combination of credential options, so a role is
+// assumed once for the run rather than for every call, and refreshed by the sdk as it expires.
+var (
+	s3CredentialsCache = map[string]*credentials.Credentials{}
+	s3CredentialsMu    sync.Mutex
+)
+
+// s3Credentials returns the credentials for the target's profile, role-arn, external-id,
+// role-session-name and web-identity-token-file options, or nil for the sdk's default chain, which
+// already uses AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN as set for IRSA on eks. A role-arn is
+// assumed with the credentials of the profile or the default chain, eg to upload to a bucket in
+// another account, or with the token file's web identity when it's given.
+func s3Credentials(target *Target, region string) (*credentials.Credentials, error) {
+	profile := target.Options.Get("profile")
+	roleARN := target.Options.Get("role-arn")
+	externalID := target.Options.Get("external-id")
+	sessionName := s3Option(target, "role-session-name", "consul-backup")
+	tokenFile := target.Options.Get("web-identity-token-file")
+
+	if roleARN == "" && (externalID != "" || tokenFile != "" || target.Options.Get("role-session-name") != "") {
+		return nil, fmt.Errorf("the s3 external-id, role-session-name and web-identity-token-file options need a role-arn to assume")
+	}
+
+	if tokenFile != "" && externalID != "" {
+		return nil, fmt.Errorf("the s3 external-id option can't be used with web-identity-token-file, as roles assumed with a web identity don't take one")
+	}
+
+	if profile == "" && roleARN == "" {
+		return nil, nil
+	}
+
+	if tokenFile != "" {
+		if _, err := os.Stat(tokenFile); err != nil {
+			return nil, fmt.Errorf("error reading s3 web-identity-token-file: %s", err)
+		}
+	}
+
+	key := strings.Join([]string{region, profile, roleARN, externalID, sessionName, tokenFile}, "\n")
+
+	s3CredentialsMu.Lock()
+	defer s3CredentialsMu.Unlock()
+
+	if creds, ok := s3CredentialsCache[key]; ok {
+		return creds, nil
+	}
+
+	// The session the role is assumed with has none of the target's endpoint options, as sts isn't
+	// served by s3 compatible stores.
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{Region: aws.String(region)},
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error loading s3 credentials: %s", err)
+	}
+
+	creds := sess.Config.Credentials
+
+	switch {
+	case tokenFile != "":
+		creds = stscreds.NewWebIdentityCredentials(sess, roleARN, sessionName, tokenFile)
+	case roleARN != "":
+		creds = stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+
+			if externalID != "" {
+				p.ExternalID = aws.String(externalID)
+			}
+		})
+	}
+
+	s3CredentialsCache[key] = creds
+
+	return creds, nil
+}
+
+// EnsureS3Bucket creates the target bucket in the target's region when it doesn't exist yet.
+func EnsureS3Bucket(target *Target) error {
+	svc, err := newS3Service(target)
+
+	if err != nil {
+		return err
+	}
+
+	return ensureS3Bucket(svc, target.Base, aws.StringValue(svc.Config.Region))
+}
+
+func ensureS3Bucket(svc *s3.S3, bucket string, region string) error {
+	_, err := svc.HeadBucket(&s3.HeadBucketInput{
+		Bucket: &bucket,
+	})
+
+	if err == nil {
+		return nil
+	}
+
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NotFound" {
+		return err
+	}
+
+	log.Infof("bucket %s does not exist, creating it in %s", bucket, region)
+
+	input := &s3.CreateBucketInput{
+		Bucket: &bucket,
+	}
+
+	// us-east-1 is the default location and is rejected as an explicit constraint.
+	if region != "" && region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: &region,
+		}
+	}
+
+	if _, err := svc.CreateBucket(input); err != nil {
+		return fmt.Errorf("error creating bucket %s: %s", bucket, err)
+	}
+
+	return svc.WaitUntilBucketExists(&s3.HeadBucketInput{
+		Bucket: &bucket,
+	})
+}
+
+// parseKeyValues parses a list of key:value pairs, as used by the tag and metadata target options.
+func parseKeyValues(pairs []string) (map[string]string, error) {
+	parsed := make(map[string]string, len(pairs))
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, ":", 2)
+
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected key:value, got '%s'", pair)
+		}
+
+		parsed[parts[0]] = parts[1]
+	}
+
+	return parsed, nil
+}
+
+// statS3 returns the keys and sizes of the objects under the target path, relative to it.
+func statS3(target *Target) ([]ObjectInfo, error) {
+	svc, err := newS3Service(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	base := strings.Trim(target.Path, "/")
+
+	if base != "" {
+		base += "/"
+	}
+
+	var objects []ObjectInfo
+
+	err = svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &target.Base,
+		Prefix: aws.String(base),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:  strings.TrimPrefix(*object.Key, base),
+				Size: aws.Int64Value(object.Size),
+			})
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// s3ObjectMetadata returns the user metadata of the object at the key under the target path, with
+// lower case keys as they were stored.
+func s3ObjectMetadata(target *Target, key string) (map[string]string, error) {
+	svc, err := newS3Service(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s3Path := fmt.Sprintf("%s/%s", target.Path, key)
+
+	output, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: &target.Base,
+		Key:    &s3Path,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// S3 returns metadata keys canonicalized as http headers, eg Verify-Mode.
+	metadata := map[string]string{}
+
+	for k, v := range output.Metadata {
+		metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+
+	return metadata, nil
+}
+
+// s3Provider stores objects in s3.
+type s3Provider struct{}
+
+func init() {
+	Register("s3", s3Provider{})
+}
+
+func (s3Provider) Put(target *Target, key string, data []byte) error {
+	return sendToS3(target, &key, &data)
+}
+
+func (s3Provider) PutFile(target *Target, key string, path string) error {
+	return sendFileToS3(target, key, path)
+}
+
+func (s3Provider) Get(target *Target) ([]byte, error) {
+	return fetchFromS3(target)
+}
+
+func (s3Provider) List(target *Target, prefix string) ([]string, error) {
+	return listS3(target, prefix)
+}
+
+func (s3Provider) Delete(target *Target, key string) error {
+	return deleteFromS3(target, key)
+}
+
+func (s3Provider) Stat(target *Target) ([]ObjectInfo, error) {
+	return statS3(target)
+}
+
+func (s3Provider) Metadata(target *Target, key string) (map[string]string, error) {
+	return s3ObjectMetadata(target, key)
+}
@@ -0,0 +1,180 @@
+package target
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestS3PutObjectInputMetadataOption(t *testing.T) {
+	target, err := Parse("s3://bucket/backups?region=us-east-1&metadata=k:v")
+
+	if err != nil {
+		t.Fatalf("error parsing target: %s", err)
+	}
+
+	// Validating the target at startup builds the upload without any snapshot metadata.
+	if err := validateS3Target(target); err != nil {
+		t.Fatalf("error validating target: %s", err)
+	}
+
+	input, err := s3PutObjectInput(target, "1.snap", nil)
+
+	if err != nil {
+		t.Fatalf("error building upload: %s", err)
+	}
+
+	if aws.StringValue(input.Metadata["k"]) != "v" {
+		t.Errorf("expected metadata k:v from the target option, got %v", aws.StringValueMap(input.Metadata))
+	}
+}
+
+func TestS3PutObjectInputCombinesMetadata(t *testing.T) {
+	target, err := Parse("s3://bucket/backups?region=us-east-1&metadata=k:v")
+
+	if err != nil {
+		t.Fatalf("error parsing target: %s", err)
+	}
+
+	metadata := map[string]string{"sha256": "abc"}
+	input, err := s3PutObjectInput(target, "1.snap", metadata)
+
+	if err != nil {
+		t.Fatalf("error building upload: %s", err)
+	}
+
+	if aws.StringValue(input.Metadata["k"]) != "v" || aws.StringValue(input.Metadata["sha256"]) != "abc" {
+		t.Errorf("expected the snapshot and target metadata together, got %v", aws.StringValueMap(input.Metadata))
+	}
+
+	if _, ok := metadata["k"]; ok {
+		t.Errorf("expected the snapshot metadata to be left as it was")
+	}
+}
+
+func TestS3PutObjectInputInvalidMetadata(t *testing.T) {
+	target, err := Parse("s3://bucket/backups?region=us-east-1&metadata=novalue")
+
+	if err != nil {
+		t.Fatalf("error parsing target: %s", err)
+	}
+
+	if err := validateS3Target(target); err == nil {
+		t.Errorf("expected metadata without a value to fail validation")
+	}
+}
+
+func TestS3CredentialOptions(t *testing.T) {
+	for _, options := range []string{"external-id=x", "role-session-name=x", "web-identity-token-file=/tmp/token", "role-arn=arn:aws:iam::1:role/r&external-id=x&web-identity-token-file=/tmp/token"} {
+		target, _ := Parse("s3://bucket/backups?region=us-east-1&" + options)
+
+		if _, err := s3Credentials(target, "us-east-1"); err == nil {
+			t.Errorf("expected the options %s to be refused", options)
+		}
+	}
+
+	target, _ := Parse("s3://bucket/backups?region=us-east-1")
+
+	if creds, err := s3Credentials(target, "us-east-1"); err != nil || creds != nil {
+		t.Errorf("expected the default chain without credential options, got %v, %v", creds, err)
+	}
+
+	dir, err := ioutil.TempDir("", "consul-backup-aws")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	credentialsFile := filepath.Join(dir, "credentials")
+	profiles := "[backup]\naws_access_key_id = AKIDBACKUP\naws_secret_access_key = secret\n"
+
+	if err := ioutil.WriteFile(credentialsFile, []byte(profiles), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	defer os.Unsetenv("AWS_SHARED_CREDENTIALS_FILE")
+
+	target, _ = Parse("s3://bucket/backups?region=us-east-1&profile=backup")
+	creds, err := s3Credentials(target, "us-east-1")
+
+	if err != nil {
+		t.Fatalf("error loading profile: %s", err)
+	}
+
+	value, err := creds.Get()
+
+	if err != nil || value.AccessKeyID != "AKIDBACKUP" {
+		t.Errorf("expected the backup profile's key, got %s, %v", value.AccessKeyID, err)
+	}
+
+	// Assuming a role with the profile's credentials reuses them for every call of the run.
+	target, _ = Parse("s3://bucket/backups?region=us-east-1&profile=backup&role-arn=arn:aws:iam::123456789012:role/backup&external-id=x")
+	first, err := s3Credentials(target, "us-east-1")
+
+	if err != nil {
+		t.Fatalf("error assuming role: %s", err)
+	}
+
+	if second, _ := s3Credentials(target, "us-east-1"); first != second {
+		t.Error("expected the assumed role's credentials to be reused")
+	}
+}
+
+func TestS3SlotWaitStopsWithContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "x")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "y")
+
+	defer func() {
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		s3Slots = nil
+	}()
+
+	// The only slot is held, as if by a call that never returns.
+	SetS3MaxConcurrency(1)
+	s3Slots <- struct{}{}
+
+	target, _ := Parse("s3://bucket/backups?endpoint=" + server.URL)
+	svc, err := newS3Service(target)
+
+	if err != nil {
+		t.Fatalf("error creating s3 client: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String("bucket")})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the call cancelled waiting for a slot to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the call to stop waiting for a slot once its context was done")
+	}
+
+	if len(s3Slots) != 1 {
+		t.Errorf("expected only the held slot to be taken, got %d", len(s3Slots))
+	}
+}
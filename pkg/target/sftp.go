@@ -0,0 +1,420 @@
+package target
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPKeyPath is the private key to authenticate to sftp targets with, overriding SFTP_KEY_PATH
+// when set. An encrypted key is unlocked with SFTP_KEY_PASSPHRASE.
+var SFTPKeyPath string
+
+// SFTPKnownHosts is the known_hosts file sftp targets' host keys are verified against, overriding
+// SFTP_KNOWN_HOSTS when set. Defaults to ~/.ssh/known_hosts.
+var SFTPKnownHosts string
+
+// sftpPath returns the path of a key under the target path on the server.
+func sftpPath(target *Target, key string) string {
+	return path.Join(target.Path, key)
+}
+
+// sftpClientConfig returns the address of the target's server and the config to connect to it
+// with, authenticating with the private key and verifying the host key against known hosts.
+func sftpClientConfig(target *Target) (string, *ssh.ClientConfig, error) {
+	keyPath := SFTPKeyPath
+
+	if keyPath == "" {
+		keyPath = os.Getenv("SFTP_KEY_PATH")
+	}
+
+	if keyPath == "" {
+		return "", nil, fmt.Errorf("no sftp private key configured, set --sftp-key or SFTP_KEY_PATH")
+	}
+
+	pem, err := ioutil.ReadFile(keyPath)
+
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading sftp private key: %s", err)
+	}
+
+	var signer ssh.Signer
+
+	if passphrase := os.Getenv("SFTP_KEY_PASSPHRASE"); passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pem)
+	}
+
+	if err != nil {
+		return "", nil, fmt.Errorf("error parsing sftp private key %s: %s", keyPath, err)
+	}
+
+	knownHostsPath := SFTPKnownHosts
+
+	if knownHostsPath == "" {
+		knownHostsPath = os.Getenv("SFTP_KNOWN_HOSTS")
+	}
+
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading known hosts to verify the sftp host key: %s", err)
+	}
+
+	addr := target.Base
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	return addr, &ssh.ClientConfig{
+		User:            target.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         Timeout,
+	}, nil
+}
+
+// newSFTPClient connects to the target's server, returning the client along with a function
+// closing the connection.
+func newSFTPClient(target *Target) (*sftp.Client, func(), error) {
+	addr, config, err := sftpClientConfig(target)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dialSFTP(context.Background(), addr, config)
+}
+
+// dialSFTP connects to the server at the address with the config. The connection is closed if the
+// context is done before the returned function closes it, so a stalled transfer fails rather than
+// hanging.
+func dialSFTP(ctx context.Context, addr string, config *ssh.ClientConfig) (*sftp.Client, func(), error) {
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			netConn.Close()
+		case <-done:
+		}
+	}()
+
+	stop := func() {
+		once.Do(func() { close(done) })
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+
+	if err != nil {
+		stop()
+		netConn.Close()
+		return nil, nil, err
+	}
+
+	conn := ssh.NewClient(sshConn, chans, reqs)
+	client, err := sftp.NewClient(conn)
+
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return client, func() {
+		stop()
+		client.Close()
+		conn.Close()
+	}, nil
+}
+
+// isRetryableSFTPError reports whether an upload failing with the error could succeed if retried,
+// which isn't the case when the server's host key doesn't match or the key isn't accepted.
+func isRetryableSFTPError(err error) bool {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+
+	// The ssh handshake wraps these errors as strings, so they can only be told apart by message.
+	return !strings.Contains(err.Error(), "knownhosts:") && !strings.Contains(err.Error(), "unable to authenticate")
+}
+
+func sendToSFTP(target *Target, snapshotKey *string, snapshot *[]byte) error {
+	return sendToSFTPFrom(target, *snapshotKey, BytesSource(*snapshot))
+}
+
+// sendToSFTPFrom uploads the data read from the source to the key.
+func sendToSFTPFrom(target *Target, key string, source Source) error {
+	mode, err := fileMode(target)
+
+	if err != nil {
+		return err
+	}
+
+	addr, config, err := sftpClientConfig(target)
+
+	if err != nil {
+		return err
+	}
+
+	filePath := sftpPath(target, key)
+	tmpPath := path.Join(path.Dir(filePath), "."+path.Base(filePath)+".tmp")
+
+	ctx, cancel := uploadContext()
+	defer cancel()
+
+	err = retryUpload("uploading over sftp", isRetryableSFTPError, func() error {
+		err := uploadSFTPFile(ctx, addr, config, source, tmpPath, filePath, mode)
+
+		// The connection is closed when the upload times out, failing whatever was in progress
+		// with a less telling error.
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Infof("saved snapshot to %s at path %s", target.Base, filePath)
+
+	return nil
+}
+
+// uploadSFTPFile uploads the data read from the source to a temporary file and renames it over
+// the file path once it's complete, so the file path never holds a partial upload.
+func uploadSFTPFile(ctx context.Context, addr string, config *ssh.ClientConfig, source Source, tmpPath string, filePath string, mode os.FileMode) error {
+	client, closeClient, err := dialSFTP(ctx, addr, config)
+
+	if err != nil {
+		return err
+	}
+
+	defer closeClient()
+
+	if err := client.MkdirAll(path.Dir(filePath)); err != nil {
+		return err
+	}
+
+	// Uploading to a temporary file and renaming it over the key once it's complete means the
+	// key never holds a partial upload.
+	file, err := client.Create(tmpPath)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := source()
+
+	if err != nil {
+		file.Close()
+		client.Remove(tmpPath)
+		return err
+	}
+
+	_, err = io.Copy(file, throttleUpload(data))
+	data.Close()
+
+	if err != nil {
+		file.Close()
+		client.Remove(tmpPath)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		client.Remove(tmpPath)
+		return err
+	}
+
+	if err := client.Chmod(tmpPath, mode); err != nil {
+		client.Remove(tmpPath)
+		return err
+	}
+
+	// Plain sftp renames fail when the target exists, the posix-rename extension replaces it.
+	if err := client.PosixRename(tmpPath, filePath); err != nil {
+		if err := replaceSFTPFile(client, tmpPath, filePath); err != nil {
+			client.Remove(tmpPath)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceSFTPFile renames the file over an existing one for servers without the posix-rename
+// extension. The existing file is moved aside first, and back again if the rename fails, so it's
+// only removed once the new file has replaced it.
+func replaceSFTPFile(client *sftp.Client, from string, to string) error {
+	oldPath := path.Join(path.Dir(to), "."+path.Base(to)+".old")
+
+	client.Remove(oldPath)
+
+	// Moving it aside fails when there's no existing file, which leaves nothing to restore.
+	moved := client.Rename(to, oldPath) == nil
+
+	if err := client.Rename(from, to); err != nil {
+		if moved {
+			client.Rename(oldPath, to)
+		}
+
+		return err
+	}
+
+	if moved {
+		client.Remove(oldPath)
+	}
+
+	return nil
+}
+
+func statSFTP(target *Target) ([]ObjectInfo, error) {
+	client, closeClient, err := newSFTPClient(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeClient()
+
+	var objects []ObjectInfo
+	walker := client.Walk(target.Path)
+
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			// Nothing has been stored yet.
+			if os.IsNotExist(err) && walker.Path() == target.Path {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		if walker.Stat().IsDir() {
+			continue
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:  strings.TrimPrefix(strings.TrimPrefix(walker.Path(), target.Path), "/"),
+			Size: walker.Stat().Size(),
+		})
+	}
+
+	return objects, nil
+}
+
+func listSFTP(target *Target, prefix string) ([]string, error) {
+	objects, err := statSFTP(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+
+	for _, object := range objects {
+		if strings.HasPrefix(object.Key, prefix) {
+			keys = append(keys, object.Key)
+		}
+	}
+
+	return keys, nil
+}
+
+func deleteFromSFTP(target *Target, key string) error {
+	client, closeClient, err := newSFTPClient(target)
+
+	if err != nil {
+		return err
+	}
+
+	defer closeClient()
+
+	return client.Remove(sftpPath(target, key))
+}
+
+func fetchFromSFTP(target *Target) ([]byte, error) {
+	client, closeClient, err := newSFTPClient(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeClient()
+
+	file, err := client.Open(target.Path)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", target.Path, err)
+	}
+
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+// sftpProvider stores objects on a server over sftp.
+type sftpProvider struct{}
+
+func init() {
+	Register("sftp", sftpProvider{})
+}
+
+func (sftpProvider) Put(target *Target, key string, data []byte) error {
+	return sendToSFTP(target, &key, &data)
+}
+
+func (sftpProvider) PutFile(target *Target, key string, path string) error {
+	return sendToSFTPFrom(target, key, FileSource(path))
+}
+
+func (sftpProvider) Get(target *Target) ([]byte, error) {
+	return fetchFromSFTP(target)
+}
+
+func (sftpProvider) List(target *Target, prefix string) ([]string, error) {
+	return listSFTP(target, prefix)
+}
+
+func (sftpProvider) Delete(target *Target, key string) error {
+	return deleteFromSFTP(target, key)
+}
+
+func (sftpProvider) Stat(target *Target) ([]ObjectInfo, error) {
+	return statSFTP(target)
+}
@@ -0,0 +1,150 @@
+package target
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// memorySFTPClient returns a client of an in memory sftp server, which like plain sftp fails to
+// rename over an existing file.
+func memorySFTPClient(t *testing.T) *sftp.Client {
+	serverConn, clientConn := net.Pipe()
+	server := sftp.NewRequestServer(serverConn, sftp.InMemHandler())
+
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+
+	if err != nil {
+		t.Fatalf("error starting sftp client: %s", err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client
+}
+
+// writeSFTPFile writes the contents to the path on the server.
+func writeSFTPFile(t *testing.T, client *sftp.Client, path string, contents string) {
+	file, err := client.Create(path)
+
+	if err != nil {
+		t.Fatalf("error creating %s: %s", path, err)
+	}
+
+	file.Write([]byte(contents))
+	file.Close()
+}
+
+// readSFTPFile reads the contents of the path on the server.
+func readSFTPFile(t *testing.T, client *sftp.Client, path string) string {
+	file, err := client.Open(path)
+
+	if err != nil {
+		t.Fatalf("error opening %s: %s", path, err)
+	}
+
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+
+	if err != nil {
+		t.Fatalf("error reading %s: %s", path, err)
+	}
+
+	return string(data)
+}
+
+func TestReplaceSFTPFile(t *testing.T) {
+	client := memorySFTPClient(t)
+
+	writeSFTPFile(t, client, "/1.snap", "old")
+	writeSFTPFile(t, client, "/.1.snap.tmp", "new")
+
+	if err := replaceSFTPFile(client, "/.1.snap.tmp", "/1.snap"); err != nil {
+		t.Fatalf("error replacing file: %s", err)
+	}
+
+	if contents := readSFTPFile(t, client, "/1.snap"); contents != "new" {
+		t.Errorf("expected the file to be replaced, got %s", contents)
+	}
+
+	if _, err := client.Stat("/.1.snap.old"); err == nil {
+		t.Errorf("expected the replaced file to be removed")
+	}
+}
+
+func TestReplaceSFTPFileWithoutExisting(t *testing.T) {
+	client := memorySFTPClient(t)
+
+	writeSFTPFile(t, client, "/.1.snap.tmp", "new")
+
+	if err := replaceSFTPFile(client, "/.1.snap.tmp", "/1.snap"); err != nil {
+		t.Fatalf("error renaming file: %s", err)
+	}
+
+	if contents := readSFTPFile(t, client, "/1.snap"); contents != "new" {
+		t.Errorf("expected the file to be renamed, got %s", contents)
+	}
+}
+
+func TestReplaceSFTPFileKeepsExistingOnFailure(t *testing.T) {
+	client := memorySFTPClient(t)
+
+	writeSFTPFile(t, client, "/1.snap", "old")
+
+	// There's no temporary file to rename, so the rename fails.
+	if err := replaceSFTPFile(client, "/.1.snap.tmp", "/1.snap"); err == nil {
+		t.Fatalf("expected renaming a missing file to fail")
+	}
+
+	if contents := readSFTPFile(t, client, "/1.snap"); contents != "old" {
+		t.Errorf("expected the existing file to be kept, got %s", contents)
+	}
+}
+
+func TestDialSFTPStopsAtContextDeadline(t *testing.T) {
+	// The server accepts the connection but never answers the ssh handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err = dialSFTP(ctx, listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+
+	if err == nil {
+		t.Fatalf("expected the stalled handshake to fail")
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("expected the dial to stop at the deadline, took %s", time.Since(start))
+	}
+}
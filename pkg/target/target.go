@@ -0,0 +1,91 @@
+// Package target stores snapshots and their sidecars in the places backups are kept, each type of
+// target being handled by the provider registered for its url scheme.
+package target
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Target is a place snapshots are stored, parsed from a url such as s3://bucket/path.
+type Target struct {
+	Type    string
+	Base    string
+	Path    string
+	Options url.Values
+	// User is the user in the target url, eg for sftp://user@host/path.
+	User string
+}
+
+// Timeout bounds each upload to a target when set, so a slow target can't hold up the run.
+var Timeout time.Duration
+
+// Context is the context uploads are made within, cancelling it stops the uploads in flight and any
+// retries of them.
+var Context = context.Background()
+
+// ContentType returns the content type to upload the object under the key with, where the target
+// stores one.
+var ContentType = func(key string) string {
+	return "application/octet-stream"
+}
+
+// ObjectMetadata returns the metadata to store on the object under the key, for targets that store
+// metadata on objects, or nil for none.
+var ObjectMetadata = func(key string) map[string]string {
+	return nil
+}
+
+// uploadContext returns the context an upload to a target is made with, within Context.
+func uploadContext() (context.Context, context.CancelFunc) {
+	if Timeout > 0 {
+		return context.WithTimeout(Context, Timeout)
+	}
+
+	return context.WithCancel(Context)
+}
+
+// Parse parses a target url, eg s3://bucket/path, file:///backups or rclone://remote:path.
+func Parse(uri string) (*Target, error) {
+	// Rclone targets name the remote the way rclone does, eg rclone://remote:backups, which isn't a
+	// valid url host, so the remote is split out before parsing the rest.
+	var rcloneRemote string
+
+	if strings.HasPrefix(uri, "rclone://") {
+		remote := strings.SplitN(strings.TrimPrefix(uri, "rclone://"), ":", 2)
+
+		if len(remote) != 2 || remote[0] == "" || strings.Contains(remote[0], "/") {
+			return nil, fmt.Errorf("provided target url is invalid, expected rclone://remote:path, got '%s'", uri)
+		}
+
+		rcloneRemote = remote[0]
+		uri = "rclone://" + rcloneRemote + "/" + strings.TrimPrefix(remote[1], "/")
+	}
+
+	parsedURI, err := url.ParseRequestURI(uri)
+	// File targets are usually absolute paths, eg file:///backups, so have no host.
+	if err != nil || parsedURI.Scheme == "" || (parsedURI.Host == "" && parsedURI.Scheme != "file") {
+		return nil, fmt.Errorf("provided target url is invalid, got '%s'", uri)
+	}
+
+	target := &Target{
+		Type:    parsedURI.Scheme,
+		Base:    parsedURI.Host,
+		Path:    parsedURI.Path,
+		Options: parsedURI.Query(),
+	}
+
+	if parsedURI.User != nil {
+		target.User = parsedURI.User.Username()
+	}
+
+	// Remote names may contain characters a url host can't, so the original name is kept.
+	if rcloneRemote != "" {
+		target.Base = rcloneRemote
+	}
+
+	return target, nil
+}
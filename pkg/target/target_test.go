@@ -0,0 +1,100 @@
+package target
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for uri, expected := range map[string]Target{
+		"s3://bucket/backups?region=eu-west-1": {Type: "s3", Base: "bucket", Path: "/backups"},
+		"file:///var/backups":                  {Type: "file", Path: "/var/backups"},
+		"sftp://backup@host:2222/snapshots":    {Type: "sftp", Base: "host:2222", Path: "/snapshots", User: "backup"},
+		"rclone://my_remote:consul/backups":    {Type: "rclone", Base: "my_remote", Path: "/consul/backups"},
+	} {
+		target, err := Parse(uri)
+
+		if err != nil {
+			t.Errorf("error parsing %s: %s", uri, err)
+			continue
+		}
+
+		if target.Type != expected.Type || target.Base != expected.Base || target.Path != expected.Path || target.User != expected.User {
+			t.Errorf("parsing %s gave %+v, expected %+v", uri, *target, expected)
+		}
+	}
+
+	for _, uri := range []string{"", "bucket/backups", "s3:///backups", "rclone://backups", "rclone://:backups"} {
+		if _, err := Parse(uri); err == nil {
+			t.Errorf("expected parsing '%s' to fail", uri)
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	target, err := Parse("s3://bucket/backups?region=eu-west-1&tag=a:1&tag=b:2")
+
+	if err != nil {
+		t.Fatalf("error parsing target: %s", err)
+	}
+
+	if target.Options.Get("region") != "eu-west-1" || len(target.Options["tag"]) != 2 {
+		t.Errorf("expected the region and both tags as options, got %v", target.Options)
+	}
+}
+
+func TestRetryStopsWhenContextDone(t *testing.T) {
+	defaultBackoff := Backoff
+	Backoff = time.Hour
+
+	defer func() {
+		Backoff = defaultBackoff
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	start := time.Now()
+
+	retries, err := Retry(ctx, "testing", func(error) bool { return true }, func() error {
+		attempts++
+		return errors.New("failed")
+	})
+
+	if err == nil || attempts != 1 || retries != 0 {
+		t.Errorf("expected a single failed attempt, got %d attempts, %d retries and error %v", attempts, retries, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the retry to stop with the context, took %s", elapsed)
+	}
+}
+
+func TestRetrySkipsUnretryableErrors(t *testing.T) {
+	attempts := 0
+
+	_, err := Retry(context.Background(), "testing", func(error) bool { return false }, func() error {
+		attempts++
+		return errors.New("access denied")
+	})
+
+	if err == nil || attempts != 1 {
+		t.Errorf("expected a single failed attempt, got %d attempts and error %v", attempts, err)
+	}
+}
+
+func TestValidateRcloneNeedsBinary(t *testing.T) {
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", t.TempDir())
+
+	target, _ := Parse("rclone://remote:backups")
+
+	if err := Validate(target); err == nil || !strings.Contains(err.Error(), "rclone binary") {
+		t.Errorf("expected rclone targets to be refused without the rclone binary, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// writeSnapshotPointer points the pointer key at the snapshot by writing the snapshot's path
+// relative to the pointer to it, replacing whatever is there regardless of the collision policy.
+// Each target replaces the object in a single write, so readers see either the old or new pointer.
+// Failing to write it is logged rather than failing a backup that has already been stored.
+func writeSnapshotPointer(target *Target, pointerKey string, snapshotKey string) {
+	relative := strings.Repeat("../", strings.Count(pointerKey, "/")) + snapshotKey
+	pointer := []byte(relative + "\n")
+
+	if err := providers[target.Type].Put(target, pointerKey, pointer); err != nil {
+		log.Warnf("error pointing %s at %s in %s: %s", pointerKey, snapshotKey, target.Type, err)
+		return
+	}
+
+	log.Infof("pointed %s at %s", pointerKey, snapshotKey)
+}
+
+// resolveSnapshotPointer returns the snapshot the source points at when it's a pointer written by
+// writeSnapshotPointer, or the source itself when it's a snapshot or a KV export.
+func resolveSnapshotPointer(source *Target) (*Target, error) {
+	if isSnapshotKey(path.Base(source.Path)) || isKVExportKey(path.Base(source.Path)) {
+		return source, nil
+	}
+
+	data, err := providers[source.Type].Get(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	relative := strings.TrimSpace(string(data))
+
+	if len(data) > 1024 || !(isSnapshotKey(relative) || isKVExportKey(relative)) {
+		return nil, fmt.Errorf("%s is neither a snapshot nor a pointer to one", path.Base(source.Path))
+	}
+
+	snapshot := *source
+	snapshot.Path = path.Join(path.Dir(source.Path), relative)
+
+	log.Infof("following pointer %s to %s", path.Base(source.Path), snapshot.Path)
+
+	return &snapshot, nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// runRestore restores a stored snapshot into a live consul cluster, replacing its state, or only
+// into the dummy agent with --dry-run. With --verify the live KV is compared with the snapshot's once
+// it's restored. KV exports stored with --kv-prefix are imported instead.
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := flags.String("from", "", "The snapshot to restore, eg s3://my-bucket/consul-snapshots/1568000000.snap, instead of giving it as an argument.")
+	consulAddr := flags.String("consul-addr", "", "The address of the consul server to restore to. Without a protocol https is used when CONSUL_HTTP_SSL is true, http otherwise. Defaults to CONSUL_ADDR.")
+	flags.StringVar(&consulDatacenter, "consul-datacenter", "", "Datacenter to restore to, forwarded to by the consul agent, when not the agent's own.")
+	flags.StringVar(&consulCAFile, "consul-ca-file", "", "Path to a pem encoded ca certificate to verify the consul server's certificate with, taking precedence over --consul-tls-skip-verify. Defaults to CONSUL_CACERT.")
+	flags.StringVar(&consulClientCert, "consul-client-cert", "", "Path to a pem encoded client certificate to authenticate to consul with when it requires mutual tls. Defaults to CONSUL_CLIENT_CERT.")
+	flags.StringVar(&consulClientKey, "consul-client-key", "", "Path to the pem encoded key of --consul-client-cert. Defaults to CONSUL_CLIENT_KEY.")
+	flags.StringVar(&consulTLSServerName, "consul-tls-server-name", "", "Name to verify the consul server's certificate against, rather than the host of its address. Defaults to CONSUL_TLS_SERVER_NAME.")
+	flags.StringVar(&consulHTTPAuth, "consul-http-auth", "", "Credentials as user:pass to authenticate to consul with using http basic auth, eg when behind an authenticating proxy. Defaults to CONSUL_HTTP_AUTH.")
+	flags.StringVar(&consulToken, "consul-token", "", "ACL token to use with consul, which needs to be a management token or have acl = \"write\" to take snapshots. Defaults to CONSUL_HTTP_TOKEN.")
+	flags.StringVar(&consulTokenFile, "consul-token-file", "", "Path of a file holding the ACL token to use with consul, eg written by vault agent. Defaults to CONSUL_HTTP_TOKEN_FILE.")
+	flags.StringVar(&consulNamespace, "consul-namespace", "", "Consul enterprise namespace to import KV exports into. Defaults to CONSUL_NAMESPACE.")
+	flags.StringVar(&consulPartition, "consul-partition", "", "Consul enterprise admin partition to import KV exports into. Defaults to CONSUL_PARTITION.")
+	consulTLSSkipVerify := flags.Bool("consul-tls-skip-verify", false, "Skip verifying the consul tls connection.")
+	restoreTimeout := flags.Duration("restore-timeout", 0, "Maximum time to allow for restoring the snapshot. 0 means no limit.")
+	encryptionKeyValue := flags.String("encryption-key", "", "Base64 encoded 32 byte key to decrypt .enc snapshots with. Defaults to ENCRYPTION_KEY.")
+	ageIdentity := flags.String("age-identity", "", "Path of an age identity file to decrypt snapshots encrypted with --encrypt age:{recipient}. Defaults to AGE_IDENTITY_FILE.")
+	compressDictPath := flags.String("compress-dict", "", "Path to the zstd dictionary to decompress .zst snapshots compressed with --compress-dict.")
+	verifyKeyPath := flags.String("verify-key", "", "Path to the openpgp public key, armored or binary, to check the detached {snapshot}.sig signature written with --sign-key against. Snapshots with an invalid signature are always refused.")
+	allowUnsignedFlag := flags.Bool("allow-unsigned", false, "Use snapshots without a signature, or whose signature can't be checked without --verify-key, rather than refusing them.")
+	confirm := flags.Bool("confirm", false, "Confirm the live consul state should be overwritten by the snapshot.")
+	force := flags.Bool("force", false, "Restore even when the live cluster already holds KV data or services other than consul, is of a different datacenter than the snapshot was taken from, or can't be checked. For KV exports, import even when keys they hold already exist, which incremental exports are allowed to without it.")
+	verify := flags.Bool("verify", false, "After restoring a snapshot, list the live KV and compare it with the snapshot's, failing the restore when they differ. Keys written to the cluster since the restore are left out.")
+	dryRun := flags.Bool("dry-run", false, "Only check the snapshot restores by restoring it to the dummy consul agent, leaving the live cluster untouched. Needs neither --consul-addr nor --confirm.")
+	flags.DurationVar(&dummyAgentConfig.ReadyTimeout, "agent-ready-timeout", time.Second*30, "Maximum time to wait for the dummy consul agent used for --dry-run to become ready.")
+	flags.BoolVar(&dummyAgentConfig.EphemeralPorts, "verify-ephemeral-ports", dummyAgentConfig.EphemeralPorts, "Bind the dummy consul agent used for --dry-run to free loopback ports instead of the consul defaults, avoiding conflicts with services on the host. Pass --verify-ephemeral-ports=false for the defaults.")
+	flags.BoolVar(&dummyAgentConfig.ACLs, "verify-acls", false, "Enable ACLs on the dummy consul agent used for --dry-run, bootstrapped with a random token, so restoring the snapshot exercises its ACL state.")
+	flags.StringVar(&dummyAgentConfig.Addr, "verify-addr", "", "Address for the http api of the dummy consul agent used for --dry-run, eg 127.0.0.1:18500, rather than a free loopback port.")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s restore --confirm --consul-addr {consul_addr} {snapshot_uri}\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s restore --dry-run {snapshot_uri}\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+	defaultConsulScope()
+
+	uri := *from
+
+	if uri == "" && flags.NArg() == 1 {
+		uri = flags.Arg(0)
+	}
+
+	if uri == "" || flags.NArg() > 1 || (*from != "" && flags.NArg() > 0) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *consulAddr == "" {
+		envConsulAddr := os.Getenv("CONSUL_ADDR")
+		consulAddr = &envConsulAddr
+	}
+
+	// A dry run never connects to the live cluster, so doesn't need its address.
+	if !*dryRun || *consulAddr != "" {
+		normalizedConsulAddr, err := consulAddrURL(*consulAddr)
+
+		if err != nil {
+			fatalf("%s", err)
+		}
+
+		consulAddr = &normalizedConsulAddr
+
+		if err := validateConsulConnection(); err != nil {
+			fatalf("%s", err)
+		}
+	}
+
+	if err := setEncryptionKey(*encryptionKeyValue); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setAgeIdentities(*ageIdentity); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setCompressionDict(*compressDictPath); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setSignatureVerification(*verifyKeyPath, *allowUnsignedFlag); err != nil {
+		fatalf("%s", err)
+	}
+
+	source, err := parseTarget(uri)
+
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	if _, ok := providers[source.Type]; !ok {
+		fatalf("target type of %s is not supported, expected one of: %s", source.Type, strings.Join(supportedTargetTypes(), ", "))
+	}
+
+	if !*confirm && !*dryRun {
+		fatalf("refusing to overwrite the state of %s with %s without --confirm", *consulAddr, uri)
+	}
+
+	source, err = resolveSnapshotPointer(source)
+
+	if err != nil {
+		fatalf("error resolving %s: %s", uri, err)
+	}
+
+	log.Infof("downloading snapshot %s", uri)
+
+	snapshot, err := fetchSnapshot(source)
+
+	if err != nil {
+		fatalf("error downloading snapshot %s: %s", uri, err)
+	}
+
+	manifest, err := fetchSnapshotManifest(source)
+
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	if isKVExport(snapshot) {
+		restoreKVExport(uri, snapshot, manifest, *consulAddr, *consulTLSSkipVerify, *dryRun, *force)
+		return
+	}
+
+	if *dryRun {
+		_, dummyConsulClient, err := startDummyAgent(dummyAgentConfig)
+
+		if err != nil {
+			fatalf("error starting dummy consul agent: %s", err)
+		}
+
+		log.Infof("restoring snapshot of %d bytes to the dummy consul agent", len(snapshot))
+
+		if err := restoreSnapshot(dummyConsulClient, snapshot, *restoreTimeout); err != nil {
+			fatalf("error restoring snapshot %s to dummy consul agent: %s", uri, err)
+		}
+
+		pairs, err := listKVChunk(dummyConsulClient, "")
+
+		if err != nil {
+			fatalf("error listing keys of snapshot %s: %s", uri, err)
+		}
+
+		log.Infof("snapshot %s restores with %d keys, dry run so the live cluster was left untouched", uri, len(pairs))
+		return
+	}
+
+	consulClient, err := newConsulClient(*consulAddr, *consulTLSSkipVerify)
+
+	if err != nil {
+		fatalf("error creating consul client: %s", err)
+	}
+
+	if err := checkRestoreTarget(consulClient, manifest, nil, *force); err != nil {
+		fatalf("%s", err)
+	}
+
+	// The snapshot's state is read before restoring, so one that can't be read for the comparison
+	// isn't restored either.
+	var state *snapshotState
+
+	if *verify {
+		state, err = readSnapshotState(bytesSource(snapshot))
+
+		if err != nil {
+			fatalf("error reading snapshot %s to verify the restore: %s", uri, err)
+		}
+	}
+
+	log.Infof("restoring snapshot of %d bytes to %s", len(snapshot), *consulAddr)
+
+	if err := restoreSnapshot(consulClient, snapshot, *restoreTimeout); err != nil {
+		if isPermissionDenied(err) {
+			log.Warnf("restoring a snapshot requires a management token or one with acl = \"write\", the request used %s", configuredToken())
+		}
+
+		fatalf("error restoring snapshot to %s: %s", *consulAddr, err)
+	}
+
+	log.Infof("restored snapshot %s to %s", uri, *consulAddr)
+
+	if state == nil {
+		return
+	}
+
+	currentPhase = "verify"
+
+	if err := verifyRestored(consulClient, state); err != nil {
+		fatalf("error verifying the restore of %s to %s: %s", uri, *consulAddr, err)
+	}
+
+	log.Infof("verified the live kv of %s matches the snapshot, got %d keys", *consulAddr, len(state.KVs))
+}
+
+// verifyRestored compares the live KV with the KV of the snapshot just restored, as verification
+// compares a backup with the cluster. Keys written since the restore are left out, but unlike when
+// backing up, keys of the snapshot missing from the cluster mean the restore didn't take.
+func verifyRestored(client *consul.Client, state *snapshotState) error {
+	verification := &kvVerification{SnapshotIndex: state.Index}
+
+	listSnapshot := func(chunk string) (consul.KVPairs, error) {
+		return state.KVs, nil
+	}
+
+	listLive := func(chunk string) (consul.KVPairs, error) {
+		return listKVChunk(client, chunk)
+	}
+
+	if err := verification.compareChunks([]string{""}, 1, listSnapshot, listLive); err != nil {
+		return err
+	}
+
+	for _, key := range sortedStrings(verification.MissingKeys) {
+		log.Errorf("key %s is in the cluster but not the snapshot", key)
+	}
+
+	for _, key := range sortedStrings(verification.MismatchedKeys) {
+		log.Errorf("key %s has a different value in the cluster than the snapshot", key)
+	}
+
+	if verification.ModifiedSinceSnapshot > 0 {
+		log.Infof("skipped %d keys modified since the restore", verification.ModifiedSinceSnapshot)
+	}
+
+	if len(verification.MissingKeys) > 0 || len(verification.MismatchedKeys) > 0 || verification.SnapshotOnlyKeys > 0 {
+		return fmt.Errorf("the live kv doesn't match the snapshot, %d keys missing from the cluster, %d keys not in the snapshot and %d keys with different values", verification.SnapshotOnlyKeys, len(verification.MissingKeys), len(verification.MismatchedKeys))
+	}
+
+	return nil
+}
+
+// restoreKVExport imports a KV export stored with --kv-prefix into the live cluster, or only checks
+// it can be read with --dry-run. Unlike a snapshot it doesn't replace the cluster's state, only the
+// keys it holds are written.
+func restoreKVExport(uri string, export []byte, manifest *SnapshotManifest, consulAddr string, consulTLSSkipVerify bool, dryRun bool, force bool) {
+	pairs, err := parseKVExport(export)
+
+	if err != nil {
+		fatalf("error reading kv export %s: %s", uri, err)
+	}
+
+	if dryRun {
+		log.Infof("kv export %s holds %d keys, dry run so the live cluster was left untouched", uri, len(pairs))
+		return
+	}
+
+	consulClient, err := newConsulClient(consulAddr, consulTLSSkipVerify)
+
+	if err != nil {
+		fatalf("error creating consul client: %s", err)
+	}
+
+	if err := checkRestoreTarget(consulClient, manifest, pairs, force); err != nil {
+		fatalf("%s", err)
+	}
+
+	log.Infof("importing %d keys from kv export %s to %s", len(pairs), uri, consulAddr)
+
+	if err := importKVPairs(consulClient, pairs); err != nil {
+		fatalf("error importing kv export to %s: %s", consulAddr, err)
+	}
+
+	log.Infof("imported kv export %s to %s", uri, consulAddr)
+}
+
+// checkRestoreTarget refuses to restore over a cluster already in use unless forced, guarding
+// against restoring to the wrong cluster. A snapshot is only restored to a cluster without KV data
+// or services besides consul itself, and a KV export only where none of its pairs exist yet, other
+// than an --incremental export, whose keys are updates to those its full export already imported.
+// Both need the cluster to be of the datacenter their manifest records, when it records one. With
+// force, a cluster that can't be checked is restored to regardless.
+func checkRestoreTarget(client *consul.Client, manifest *SnapshotManifest, pairs consul.KVPairs, force bool) error {
+	var problems []string
+
+	checkFailed := func(what string, err error) error {
+		if force {
+			log.Warnf("error checking the %s of the cluster to restore to, restoring with --force without checking: %s", what, err)
+			return nil
+		}
+
+		return fmt.Errorf("error checking the %s of the cluster to restore to, pass --force to restore without checking: %s", what, err)
+	}
+
+	_, datacenter, err := consulClusterInfo(client)
+
+	if err != nil {
+		return checkFailed("datacenter", err)
+	}
+
+	if manifest != nil && manifest.Datacenter != "" && manifest.Datacenter != datacenter {
+		problems = append(problems, fmt.Sprintf("is datacenter %s, but the snapshot was taken from %s", datacenter, manifest.Datacenter))
+	}
+
+	incremental := pairs != nil && manifest != nil && manifest.IncrementalBase != ""
+
+	var keys []string
+
+	if !incremental {
+		keys, _, err = client.KV().Keys("", "", nil)
+
+		if err != nil {
+			return checkFailed("kv", err)
+		}
+	}
+
+	if pairs == nil {
+		if len(keys) > 0 {
+			problems = append(problems, fmt.Sprintf("holds %d kv keys", len(keys)))
+		}
+
+		services, _, err := client.Catalog().Services(nil)
+
+		if err != nil {
+			return checkFailed("services", err)
+		}
+
+		var registered []string
+
+		for name := range services {
+			if name != "consul" {
+				registered = append(registered, name)
+			}
+		}
+
+		if len(registered) > 0 {
+			problems = append(problems, fmt.Sprintf("has services registered (%s)", strings.Join(sortedStrings(registered), ", ")))
+		}
+	} else if !incremental {
+		live := make(map[string]bool, len(keys))
+
+		for _, key := range keys {
+			live[key] = true
+		}
+
+		existing := 0
+
+		for _, kv := range pairs {
+			if live[kv.Key] {
+				existing++
+			}
+		}
+
+		if existing > 0 {
+			problems = append(problems, fmt.Sprintf("already holds %d of the export's keys", existing))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if force {
+		log.Warnf("restoring with --force although the cluster %s", strings.Join(problems, " and "))
+		return nil
+	}
+
+	return fmt.Errorf("refusing to restore as the cluster %s, pass --force to restore anyway", strings.Join(problems, " and "))
+}
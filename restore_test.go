@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// fakeRestoreTarget serves the agent, kv and catalog endpoints checked before restoring, for a
+// cluster of the datacenter holding the keys and services.
+func fakeRestoreTarget(t *testing.T, datacenter string, keys string, services string) *consul.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agent/self":
+			fmt.Fprintf(w, `{"Config": {"Datacenter": "%s", "Version": "1.6.0"}}`, datacenter)
+		case "/v1/kv/":
+			fmt.Fprint(w, keys)
+		case "/v1/catalog/services":
+			fmt.Fprint(w, services)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	t.Cleanup(server.Close)
+
+	client, err := consul.NewClient(&consul.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestCheckRestoreTarget(t *testing.T) {
+	manifest := &SnapshotManifest{Datacenter: "dc1"}
+	empty := fakeRestoreTarget(t, "dc1", `[]`, `{"consul": []}`)
+
+	if err := checkRestoreTarget(empty, manifest, nil, false); err != nil {
+		t.Errorf("expected a restore to an empty cluster to be allowed, got %s", err)
+	}
+
+	inUse := fakeRestoreTarget(t, "dc2", `["a", "b"]`, `{"consul": [], "web": []}`)
+	err := checkRestoreTarget(inUse, manifest, nil, false)
+
+	if err == nil {
+		t.Fatal("expected a restore to a cluster in use to be refused")
+	}
+
+	for _, problem := range []string{"is datacenter dc2", "holds 2 kv keys", "services registered (web)"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected the refusal to say the cluster %s, got %s", problem, err)
+		}
+	}
+
+	if err := checkRestoreTarget(inUse, manifest, nil, true); err != nil {
+		t.Errorf("expected --force to restore anyway, got %s", err)
+	}
+
+	kvInUse := fakeRestoreTarget(t, "dc1", `["a", "b"]`, `{"consul": [], "web": []}`)
+
+	if err := checkRestoreTarget(kvInUse, manifest, consul.KVPairs{{Key: "c"}}, false); err != nil {
+		t.Errorf("expected a kv export of new keys to be imported, got %s", err)
+	}
+
+	if err := checkRestoreTarget(kvInUse, nil, consul.KVPairs{{Key: "a"}, {Key: "c"}}, false); err == nil || !strings.Contains(err.Error(), "1 of the export's keys") {
+		t.Errorf("expected a kv export overwriting keys to be refused, got %v", err)
+	}
+
+	// The keys of an incremental export are updates to those its full export imported.
+	incremental := &SnapshotManifest{Datacenter: "dc1", IncrementalSince: 5, IncrementalBase: "1.kv.json"}
+
+	if err := checkRestoreTarget(kvInUse, incremental, consul.KVPairs{{Key: "a"}, {Key: "c"}}, false); err != nil {
+		t.Errorf("expected an incremental kv export to be imported over its full export's keys, got %s", err)
+	}
+}
+
+func TestCheckRestoreTargetForcedWhenUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client, err := consul.NewClient(&consul.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkRestoreTarget(client, nil, nil, false); err == nil || !strings.Contains(err.Error(), "pass --force") {
+		t.Errorf("expected a cluster that can't be checked to be refused, got %v", err)
+	}
+
+	if err := checkRestoreTarget(client, nil, nil, true); err != nil {
+		t.Errorf("expected --force to restore to a cluster that can't be checked, got %s", err)
+	}
+}
+
+func TestVerifyRestored(t *testing.T) {
+	state := &snapshotState{
+		Index: 10,
+		KVs: consul.KVPairs{
+			{Key: "a", Value: []byte("1"), ModifyIndex: 5},
+			{Key: "b", Value: []byte("2"), ModifyIndex: 6},
+		},
+	}
+
+	for name, test := range map[string]struct {
+		live  consul.KVPairs
+		valid bool
+	}{
+		"restored": {consul.KVPairs{{Key: "a", Value: []byte("1"), ModifyIndex: 5}, {Key: "b", Value: []byte("2"), ModifyIndex: 6}}, true},
+		// Keys written after the restore are at a later index than the snapshot.
+		"written since": {consul.KVPairs{{Key: "a", Value: []byte("1"), ModifyIndex: 5}, {Key: "b", Value: []byte("3"), ModifyIndex: 12}, {Key: "c", Value: []byte("4"), ModifyIndex: 13}}, true},
+		"not restored":  {consul.KVPairs{{Key: "a", Value: []byte("1"), ModifyIndex: 5}}, false},
+		"different":     {consul.KVPairs{{Key: "a", Value: []byte("1"), ModifyIndex: 5}, {Key: "b", Value: []byte("3"), ModifyIndex: 6}}, false},
+		"left over":     {consul.KVPairs{{Key: "a", Value: []byte("1"), ModifyIndex: 5}, {Key: "b", Value: []byte("2"), ModifyIndex: 6}, {Key: "z", Value: []byte("0"), ModifyIndex: 2}}, false},
+	} {
+		err := verifyRestored(fakeKV(t, test.live), state)
+
+		if test.valid && err != nil {
+			t.Errorf("%s: expected the restore to verify, got %s", name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected the restore to fail verification", name)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RunResult is the machine readable summary of a run.
+type RunResult struct {
+	Status           string             `json:"status"`
+	Target           string             `json:"target"`
+	SnapshotKey      string             `json:"snapshot_key,omitempty"`
+	SnapshotBytes    int                `json:"snapshot_bytes"`
+	SnapshotSHA256   string             `json:"snapshot_sha256,omitempty"`
+	SnapshotKeys     int                `json:"snapshot_keys"`
+	ConsulVersion    string             `json:"consul_version,omitempty"`
+	Datacenter       string             `json:"datacenter,omitempty"`
+	VerifyMode       string             `json:"verify_mode,omitempty"`
+	SnapshotOnlyKeys int                `json:"snapshot_only_keys"`
+	VerifyRetries    int                `json:"verify_retries,omitempty"`
+	UploadRetries    int                `json:"upload_retries,omitempty"`
+	Durations        map[string]float64 `json:"durations_seconds"`
+	FailedPhase      string             `json:"failed_phase,omitempty"`
+	FailedTargets    []string           `json:"failed_targets,omitempty"`
+	Error            string             `json:"error,omitempty"`
+	// KVPrefixes and KVModifyIndex are the prefixes exported with --kv-prefix and the highest
+	// ModifyIndex under them, and IncrementalSince and IncrementalBase are set when --incremental
+	// only exported the keys modified after the index, on top of the full export.
+	KVPrefixes       []string `json:"kv_prefixes,omitempty"`
+	KVModifyIndex    uint64   `json:"kv_modify_index,omitempty"`
+	IncrementalSince uint64   `json:"incremental_since,omitempty"`
+	IncrementalBase  string   `json:"incremental_base,omitempty"`
+	// RetentionDeleted and RetentionDeletedBytes are the snapshots retention deleted from the
+	// targets and the bytes of them and their sidecars, and StoredSnapshots and StoredDailySnapshots
+	// are how many snapshots and daily snapshots were left on each target it was applied to.
+	RetentionDeleted      int            `json:"retention_deleted,omitempty"`
+	RetentionDeletedBytes int64          `json:"retention_deleted_bytes,omitempty"`
+	StoredSnapshots       map[string]int `json:"stored_snapshots,omitempty"`
+	StoredDailySnapshots  map[string]int `json:"stored_daily_snapshots,omitempty"`
+}
+
+var result = &RunResult{
+	Status:    "failure",
+	Durations: map[string]float64{},
+}
+
+var resultFile string
+
+// currentPhase is the phase of the run in progress, recorded as the failed phase on failure.
+var currentPhase = "setup"
+
+// resultHook is passed the result of the run once it's complete, when set.
+var resultHook func(*RunResult)
+
+var runStart = time.Now()
+
+// verificationMetadata describes the snapshot and how it was verified, for providers to store on the
+// snapshot object itself.
+func verificationMetadata() map[string]string {
+	metadata := map[string]string{
+		"verified":    strconv.FormatBool(result.VerifyMode != "none"),
+		"verify-mode": result.VerifyMode,
+		"size":        strconv.Itoa(result.SnapshotBytes),
+	}
+
+	// Streamed snapshots are only hashed once they've been uploaded.
+	if result.SnapshotSHA256 != "" {
+		metadata["sha256"] = result.SnapshotSHA256
+	}
+
+	for k, v := range compressionMetadata() {
+		metadata[k] = v
+	}
+
+	// Keys are only counted when they're compared with the live cluster.
+	if result.VerifyMode == "full" || result.VerifyMode == "inspect" || result.SnapshotKeys > 0 {
+		metadata["key-count"] = strconv.Itoa(result.SnapshotKeys)
+	}
+
+	return metadata
+}
+
+// recordDuration stores the time taken by a phase of the run, in seconds, tracing the phase when
+// tracing is enabled.
+func recordDuration(phase string, start time.Time) {
+	end := time.Now()
+	result.Durations[phase] = end.Sub(start).Seconds()
+
+	if tracer != nil && phase != "total" {
+		tracer.addSpan(phase, start, end, nil)
+	}
+}
+
+// writeResult writes the result of the run to the result file and passes it to the result hook, if
+// either is set.
+func writeResult() {
+	stopRunContext()
+
+	if resultHook != nil {
+		resultHook(result)
+	}
+
+	exportTrace(result)
+
+	if resultFile == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+
+	if err != nil {
+		log.Warnf("error encoding run result: %s", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(resultFile, data, 0644); err != nil {
+		log.Warnf("error writing run result to %s: %s", resultFile, err)
+	}
+}
+
+// fatalf logs the error, records it as the outcome of the run and exits.
+func fatalf(format string, args ...interface{}) {
+	log.Errorf(format, args...)
+
+	result.Status = "failure"
+	result.FailedPhase = currentPhase
+	result.Error = fmt.Sprintf(format, args...)
+	recordDuration("total", runStart)
+	writeResult()
+
+	os.Exit(1)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// retentionAge returns the age beyond which snapshots are deleted, given by either --retain-days
+// or --retain-age.
+func retentionAge(retainDays int, retainAge time.Duration) (time.Duration, error) {
+	if retainDays < 0 || retainAge < 0 {
+		return 0, fmt.Errorf("retention limits can't be negative")
+	}
+
+	if retainDays > 0 && retainAge > 0 {
+		return 0, fmt.Errorf("--retain-days and --retain-age can't be used together")
+	}
+
+	if retainDays > 0 {
+		return time.Duration(retainDays) * 24 * time.Hour, nil
+	}
+
+	return retainAge, nil
+}
+
+// validateRetainDaily checks --retain-daily has daily copies to apply to.
+func validateRetainDaily(retainDaily int, dailyPrefix string) error {
+	if retainDaily < 0 {
+		return fmt.Errorf("retention limits can't be negative")
+	}
+
+	if retainDaily > 0 && dailyPrefix == "" {
+		return fmt.Errorf("--retain-daily applies to the daily snapshots, so needs --daily-prefix")
+	}
+
+	return nil
+}
+
+// retentionSummary is what applying retention to a target deleted, counting the snapshots deleted
+// and the bytes of them and their sidecars, and the snapshots left on the target.
+type retentionSummary struct {
+	Deleted      int
+	DeletedBytes int64
+	Remaining    int
+}
+
+// applyRetention deletes the snapshots at the name template's depth under the prefix of the target
+// path, along with their sidecar objects, beyond the newest retain snapshots or taken longer than
+// retainAge ago. The empty prefix is the snapshots directly under the target path. A zero limit is
+// not applied. Deletion is best effort, failures are logged rather than returned.
+func applyRetention(target *Target, prefix string, retain int, retainAge time.Duration, dryRun bool) (retentionSummary, error) {
+	var summary retentionSummary
+	objects, err := providers[target.Type].Stat(target)
+
+	if err != nil {
+		return summary, err
+	}
+
+	location := target.Type
+	prefix = strings.Trim(prefix, "/")
+
+	if prefix != "" {
+		location += " " + prefix
+		prefix += "/"
+	}
+
+	var snapshots []string
+	taken := map[string]time.Time{}
+
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, prefix)
+
+		// Snapshots under another prefix, such as the daily copies, have their own retention.
+		if !strings.HasPrefix(object.Key, prefix) || !isNamedSnapshotKey(name) {
+			continue
+		}
+
+		if t, ok := snapshotTime(name); ok {
+			snapshots = append(snapshots, object.Key)
+			taken[object.Key] = t
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return taken[snapshots[i]].After(taken[snapshots[j]])
+	})
+
+	cutoff := time.Now().Add(-retainAge)
+	provider := providers[target.Type]
+	summary.Remaining = len(snapshots)
+
+	for i, snapshotKey := range snapshots {
+		if (retain == 0 || i < retain) && (retainAge == 0 || taken[snapshotKey].After(cutoff)) {
+			continue
+		}
+
+		age := time.Since(taken[snapshotKey]).Truncate(time.Second)
+
+		for _, object := range objects {
+			if object.Key != snapshotKey && !strings.HasPrefix(object.Key, snapshotKey+".") {
+				continue
+			}
+
+			if dryRun {
+				log.Infof("retention would delete %s, taken %s ago", object.Key, age)
+			} else {
+				if err := provider.Delete(target, object.Key); err != nil {
+					log.Warnf("error deleting %s for retention: %s", object.Key, err)
+					continue
+				}
+
+				log.Infof("retention deleted %s, taken %s ago", object.Key, age)
+			}
+
+			summary.DeletedBytes += object.Size
+
+			// The snapshot only counts as deleted once its own object is, whatever its sidecars.
+			if object.Key == snapshotKey {
+				summary.Deleted++
+			}
+		}
+	}
+
+	if dryRun {
+		log.Infof("retention would delete %d snapshots of %d bytes from %s, leaving %d", summary.Deleted, summary.DeletedBytes, location, summary.Remaining-summary.Deleted)
+
+		// Nothing was actually deleted.
+		return retentionSummary{Remaining: summary.Remaining}, nil
+	}
+
+	summary.Remaining -= summary.Deleted
+
+	log.Infof("retention deleted %d snapshots of %d bytes from %s, leaving %d", summary.Deleted, summary.DeletedBytes, location, summary.Remaining)
+
+	return summary, nil
+}
+
+// recordRetention adds what retention deleted from the target to the result of the run, along with
+// the snapshots left on it, or the daily snapshots left under its daily prefix when daily is set.
+func recordRetention(uri string, daily bool, summary retentionSummary) {
+	result.RetentionDeleted += summary.Deleted
+	result.RetentionDeletedBytes += summary.DeletedBytes
+
+	stored := &result.StoredSnapshots
+
+	if daily {
+		stored = &result.StoredDailySnapshots
+	}
+
+	if *stored == nil {
+		*stored = map[string]int{}
+	}
+
+	(*stored)[uri] = summary.Remaining
+}
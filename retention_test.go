@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyRetentionSummary(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, size := range map[string]int{
+		"1000.snap":        10,
+		"1000.snap.sha256": 5,
+		"2000.snap":        20,
+		"3000.snap":        30,
+		"3000.snap.sha256": 5,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target, err := parseTarget("file://" + dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := applyRetention(target, "", 1, 0, true)
+
+	if err != nil {
+		t.Fatalf("error applying retention: %s", err)
+	}
+
+	if summary != (retentionSummary{Remaining: 3}) {
+		t.Errorf("expected a dry run to delete nothing and leave 3 snapshots, got %+v", summary)
+	}
+
+	summary, err = applyRetention(target, "", 1, 0, false)
+
+	if err != nil {
+		t.Fatalf("error applying retention: %s", err)
+	}
+
+	if summary != (retentionSummary{Deleted: 2, DeletedBytes: 35, Remaining: 1}) {
+		t.Errorf("expected 2 snapshots of 35 bytes to be deleted leaving 1, got %+v", summary)
+	}
+
+	for _, name := range []string{"1000.snap", "1000.snap.sha256", "2000.snap"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be deleted", name)
+		}
+	}
+}
+
+func TestApplyRetentionToDailyPrefix(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.Mkdir(filepath.Join(dir, "daily"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"1000.snap", "2000.snap", "daily/1000.snap", "daily/1000.snap.sig", "daily/2000.snap", "daily/3000.snap"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("snapshot"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target, err := parseTarget("file://" + dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := applyRetention(target, "/daily/", 2, 0, false)
+
+	if err != nil {
+		t.Fatalf("error applying retention: %s", err)
+	}
+
+	if summary.Deleted != 1 || summary.Remaining != 2 {
+		t.Errorf("expected 1 daily snapshot to be deleted leaving 2, got %+v", summary)
+	}
+
+	for name, kept := range map[string]bool{"1000.snap": true, "2000.snap": true, "daily/1000.snap": false, "daily/1000.snap.sig": false, "daily/2000.snap": true, "daily/3000.snap": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) == kept {
+			t.Errorf("expected %s to be kept: %t", name, kept)
+		}
+	}
+}
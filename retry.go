@@ -0,0 +1,33 @@
+package main
+
+import (
+	"time"
+
+	"consul_backup_tool/pkg/target"
+	log "github.com/sirupsen/logrus"
+)
+
+// retry calls fn until it succeeds, retrying up to the given number of times with the delay in
+// between. The last error is returned when every attempt fails.
+func retry(description string, retries int, delay time.Duration, fn func() error) error {
+	err := fn()
+	attempt := 1
+
+	for ; err != nil && attempt <= retries; attempt++ {
+		log.Warnf("error %s, retrying in %s for retry %d/%d: %s", description, delay, attempt, retries, err)
+		time.Sleep(delay)
+		err = fn()
+	}
+
+	if err == nil {
+		log.Debugf("succeeded %s after %d retries", description, attempt-1)
+	}
+
+	return err
+}
+
+// retryBackoff calls fn with the upload retry policy, stopping once the run is cancelled,
+// returning how many times it retried along with the last error.
+func retryBackoff(description string, retryable func(error) bool, fn func() error) (int, error) {
+	return target.Retry(runContext, description, retryable, fn)
+}
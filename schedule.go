@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// runSchedule keeps running, taking a backup on each tick of the cron schedule until terminated,
+// when any running backup is left to finish first.
+// Each backup runs as a child process with the same arguments, less the schedule, so a failed
+// backup can't take the scheduler down with it and each gets a fresh dummy consul agent.
+// With a health address, the health checks are served on it, ready while backups succeed within
+// the max age or twice the time between backups.
+// With jitter, each backup starts a random time up to the jitter after it's due, spreading out the
+// backups of instances sharing the schedule.
+func runSchedule(schedule string, healthAddr string, readyMaxAge time.Duration, jitter time.Duration) {
+	scheduler := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+	// Seeded explicitly, as instances need to pick different delays for the jitter to spread them.
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	stopping := make(chan struct{})
+
+	var id cron.EntryID
+
+	id, err := scheduler.AddFunc(schedule, func() {
+		if jitter > 0 {
+			delay := time.Duration(random.Int63n(int64(jitter)))
+
+			log.Infof("delaying backup by %s of jitter", delay.Truncate(time.Second))
+
+			select {
+			case <-time.After(delay):
+			case <-stopping:
+				return
+			}
+		}
+
+		runScheduledBackup()
+		logNextBackup(scheduler, id)
+	})
+
+	if err != nil {
+		fatalf("invalid schedule '%s': %s", schedule, err)
+	}
+
+	next := scheduler.Entry(id).Schedule.Next(time.Now())
+	period := scheduler.Entry(id).Schedule.Next(next).Sub(next)
+
+	// A delay as long as the time between backups would skip the next one.
+	if jitter >= period {
+		fatalf("--interval-jitter of %s needs to be shorter than the %s between backups", jitter, period)
+	}
+
+	if healthAddr != "" {
+		if readyMaxAge == 0 {
+			readyMaxAge = 2 * period
+		}
+
+		startHealthServer(healthAddr, readyMaxAge)
+	}
+
+	scheduler.Start()
+
+	log.Infof("taking backups on schedule %s", schedule)
+	logNextBackup(scheduler, id)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	sig := <-signals
+
+	log.Infof("received %s, shutting down once any running backup finishes", sig)
+
+	// A backup still waiting out its jitter hasn't started, so isn't waited for.
+	close(stopping)
+
+	<-scheduler.Stop().Done()
+}
+
+// logNextBackup logs when the scheduled backup will next run.
+func logNextBackup(scheduler *cron.Cron, id cron.EntryID) {
+	next := scheduler.Entry(id).Next
+
+	log.Infof("next backup at %s, in %s", next.Format(time.RFC3339), time.Until(next).Truncate(time.Second))
+}
+
+func runScheduledBackup() {
+	executable, err := os.Executable()
+
+	if err != nil {
+		log.Errorf("error finding executable for scheduled backup: %s", err)
+		return
+	}
+
+	// The scheduler serves the metrics, the backups report their outcome to it through the result
+	// file.
+	args := withoutArgs(os.Args[1:], "schedule", "interval", "interval-jitter", "metrics-addr", "health-addr")
+
+	// Clearing them explicitly stops a config file giving them to the backup too.
+	args = append(args, "-schedule=", "-interval=0", "-interval-jitter=0", "-metrics-addr=", "-health-addr=")
+	runResultFile := resultFile
+
+	if runResultFile == "" {
+		file, err := ioutil.TempFile("", "consul-backup-result")
+
+		if err != nil {
+			log.Errorf("error creating result file for scheduled backup: %s", err)
+			return
+		}
+
+		file.Close()
+		defer os.Remove(file.Name())
+
+		runResultFile = file.Name()
+		args = append(args, "-result-file", runResultFile)
+	}
+
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		log.Errorf("scheduled backup failed: %s", err)
+	}
+
+	runResult := &RunResult{}
+	data, err := ioutil.ReadFile(runResultFile)
+
+	if err == nil {
+		err = json.Unmarshal(data, runResult)
+	}
+
+	if err != nil {
+		log.Warnf("error reading scheduled backup result: %s", err)
+		runResult = &RunResult{Status: "failure", FailedPhase: "unknown"}
+	}
+
+	observeResult(runResult)
+	health.observe(runResult)
+}
+
+// isBoolFlag reports whether the named command line flag is a bool flag.
+func isBoolFlag(name string) bool {
+	f := flag.Lookup(name)
+
+	if f == nil {
+		return false
+	}
+
+	value, ok := f.Value.(interface{ IsBoolFlag() bool })
+
+	return ok && value.IsBoolFlag()
+}
+
+// withoutArgs removes the named flags and their values from the arguments.
+func withoutArgs(args []string, names ...string) []string {
+	var filtered []string
+
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		removed := false
+
+		for _, n := range names {
+			if !strings.HasPrefix(args[i], "-") {
+				break
+			}
+
+			// The value follows as the next argument unless given as --name=value, or the flag is a
+			// bool flag, which takes no separate value.
+			if name == n {
+				if !isBoolFlag(n) {
+					i++
+				}
+
+				removed = true
+				break
+			}
+
+			if strings.HasPrefix(name, n+"=") {
+				removed = true
+				break
+			}
+		}
+
+		if !removed {
+			filtered = append(filtered, args[i])
+		}
+	}
+
+	return filtered
+}
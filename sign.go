@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+// checkSignatures makes fetching a snapshot check its {snapshot}.sig signature against
+// verifyKeyRing, refusing snapshots without one unless allowUnsigned is set. Set by restore and
+// verify.
+var (
+	checkSignatures bool
+	verifyKeyRing   openpgp.EntityList
+	allowUnsigned   bool
+)
+
+// loadSigningKey reads an armored or binary openpgp private key, decrypting it with the passphrase if required.
+func loadSigningKey(path string, passphrase string) (*openpgp.Entity, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+
+	if err != nil {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key: %s", err)
+	}
+
+	if len(entities) == 0 || entities[0].PrivateKey == nil {
+		return nil, fmt.Errorf("%s does not contain a private key", path)
+	}
+
+	entity := entities[0]
+
+	if entity.PrivateKey.Encrypted {
+		if passphrase == "" {
+			return nil, fmt.Errorf("signing key is encrypted and no passphrase was provided")
+		}
+
+		if err := entity.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("error decrypting signing key: %s", err)
+		}
+	}
+
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			if err := subkey.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return nil, fmt.Errorf("error decrypting signing subkey: %s", err)
+			}
+		}
+	}
+
+	return entity, nil
+}
+
+// signSnapshot creates a detached binary openpgp signature of the snapshot.
+func signSnapshot(entity *openpgp.Entity, snapshot []byte) ([]byte, error) {
+	var signature bytes.Buffer
+
+	if err := openpgp.DetachSign(&signature, entity, bytes.NewReader(snapshot), nil); err != nil {
+		return nil, err
+	}
+
+	return signature.Bytes(), nil
+}
+
+// setSignatureVerification checks the signatures of the snapshots fetched against the public keys
+// in the keyring at the path, armored or binary. Without a keyring, snapshots are only accepted
+// with allowUnsignedSnapshots, as their signatures can't be checked.
+func setSignatureVerification(keyRingPath string, allowUnsignedSnapshots bool) error {
+	checkSignatures = true
+	allowUnsigned = allowUnsignedSnapshots
+
+	if keyRingPath == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(keyRingPath)
+
+	if err != nil {
+		return err
+	}
+
+	keyRing, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+
+	if err != nil {
+		keyRing, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+
+	if err != nil {
+		return fmt.Errorf("error reading verify key: %s", err)
+	}
+
+	if len(keyRing) == 0 {
+		return fmt.Errorf("%s does not contain a public key", keyRingPath)
+	}
+
+	verifyKeyRing = keyRing
+
+	return nil
+}
+
+// verifySnapshotSignature checks the snapshot object, as stored, against its detached {key}.sig
+// signature when signatures are being checked. An invalid signature is always refused, while a
+// missing one, or one there's no key to check, is only accepted with --allow-unsigned.
+func verifySnapshotSignature(source *Target, snapshot []byte) error {
+	if !checkSignatures {
+		return nil
+	}
+
+	snapshotKey := path.Base(source.Path)
+	signatureKey := snapshotKey + ".sig"
+
+	parent := *source
+	parent.Path = path.Dir(source.Path)
+
+	keys, err := providers[source.Type].List(&parent, signatureKey)
+
+	if err != nil {
+		return fmt.Errorf("error looking for the signature of snapshot %s: %s", snapshotKey, err)
+	}
+
+	found := false
+
+	for _, key := range keys {
+		if key == signatureKey {
+			found = true
+		}
+	}
+
+	if !found {
+		if allowUnsigned {
+			log.Warnf("snapshot %s is unsigned, using it as --allow-unsigned was given", snapshotKey)
+			return nil
+		}
+
+		return fmt.Errorf("snapshot %s is unsigned, pass --allow-unsigned to use it anyway", snapshotKey)
+	}
+
+	if verifyKeyRing == nil {
+		if allowUnsigned {
+			log.Warnf("not checking the signature of snapshot %s without --verify-key, using it as --allow-unsigned was given", snapshotKey)
+			return nil
+		}
+
+		return fmt.Errorf("snapshot %s is signed, but there's no --verify-key to check its signature with, pass --allow-unsigned to use it anyway", snapshotKey)
+	}
+
+	signatureSource := *source
+	signatureSource.Path = path.Join(parent.Path, signatureKey)
+
+	signature, err := providers[source.Type].Get(&signatureSource)
+
+	if err != nil {
+		return fmt.Errorf("error fetching the signature of snapshot %s: %s", snapshotKey, err)
+	}
+
+	signer, err := openpgp.CheckDetachedSignature(verifyKeyRing, bytes.NewReader(snapshot), bytes.NewReader(signature))
+
+	if err != nil {
+		return fmt.Errorf("snapshot %s has an invalid signature: %s", snapshotKey, err)
+	}
+
+	log.Infof("verified the signature of snapshot %s by key %X", snapshotKey, signer.PrimaryKey.Fingerprint)
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestVerifySnapshotSignature(t *testing.T) {
+	defer func() {
+		checkSignatures, verifyKeyRing, allowUnsigned = false, nil, false
+	}()
+
+	dir, err := ioutil.TempDir("", "consul-backup-sign")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	entity, err := openpgp.NewEntity("backup", "", "backup@example.com", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := []byte("snapshot")
+	signature, err := signSnapshot(entity, snapshot)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"1.snap": snapshot, "1.snap.sig": signature, "2.snap": snapshot} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signed, _ := parseTarget("file://" + dir + "/1.snap")
+	unsigned, _ := parseTarget("file://" + dir + "/2.snap")
+
+	if err := verifySnapshotSignature(unsigned, snapshot); err != nil {
+		t.Errorf("expected signatures to go unchecked outside restore and verify, got %s", err)
+	}
+
+	checkSignatures, verifyKeyRing = true, openpgp.EntityList{entity}
+
+	if err := verifySnapshotSignature(signed, snapshot); err != nil {
+		t.Errorf("expected a valid signature to verify, got %s", err)
+	}
+
+	if err := verifySnapshotSignature(signed, []byte("tampered")); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("expected a tampered snapshot to be refused, got %v", err)
+	}
+
+	if err := verifySnapshotSignature(unsigned, snapshot); err == nil || !strings.Contains(err.Error(), "unsigned") {
+		t.Errorf("expected an unsigned snapshot to be refused, got %v", err)
+	}
+
+	allowUnsigned = true
+
+	if err := verifySnapshotSignature(unsigned, snapshot); err != nil {
+		t.Errorf("expected an unsigned snapshot to be allowed with --allow-unsigned, got %s", err)
+	}
+
+	verifyKeyRing = openpgp.EntityList{other}
+
+	if err := verifySnapshotSignature(signed, snapshot); err == nil {
+		t.Error("expected a signature by another key to be refused, even with --allow-unsigned")
+	}
+}
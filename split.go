@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// splitSize is the largest object to upload in one piece, larger snapshots are split into parts.
+// 0 means never split.
+var splitSize int64
+
+// splitManifest is stored under the snapshot key in place of a snapshot that was split into parts,
+// the parts being stored alongside it as {key}.part0001 and so on.
+type splitManifest struct {
+	Parts  []string `json:"parts"`
+	Size   int      `json:"size"`
+	SHA256 string   `json:"sha256"`
+}
+
+// sendSnapshotObject uploads a snapshot under the key, splitting it into parts with a manifest when
+// it's larger than the split size.
+func sendSnapshotObject(target *Target, key string, snapshot []byte) error {
+	if splitSize <= 0 || int64(len(snapshot)) <= splitSize {
+		return sendObject(target, key, snapshot)
+	}
+
+	manifest := splitManifest{
+		Size:   len(snapshot),
+		SHA256: sha256Hex(snapshot),
+	}
+
+	for offset := int64(0); offset < int64(len(snapshot)); offset += splitSize {
+		end := offset + splitSize
+
+		if end > int64(len(snapshot)) {
+			end = int64(len(snapshot))
+		}
+
+		partKey := fmt.Sprintf("%s.part%04d", key, len(manifest.Parts)+1)
+
+		if err := sendObject(target, partKey, snapshot[offset:end]); err != nil {
+			return err
+		}
+
+		manifest.Parts = append(manifest.Parts, path.Base(partKey))
+	}
+
+	log.Infof("split snapshot %s into %d parts", key, len(manifest.Parts))
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return sendObject(target, key, data)
+}
+
+// fetchSnapshot downloads a stored snapshot, reassembling it from its parts when it was split,
+// decrypting it when it was encrypted and decompressing it when it was compressed.
+func fetchSnapshot(source *Target) ([]byte, error) {
+	source, err := resolveSnapshotPointer(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := fetchSnapshotObject(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySnapshotChecksum(source, snapshot); err != nil {
+		return nil, err
+	}
+
+	if err := verifySnapshotSignature(source, snapshot); err != nil {
+		return nil, err
+	}
+
+	key := source.Path
+
+	if strings.HasSuffix(key, ".enc") {
+		snapshot, err = decryptStoredSnapshot(snapshot)
+
+		if err != nil {
+			return nil, err
+		}
+
+		key = strings.TrimSuffix(key, ".enc")
+	}
+
+	// Snapshots recompressed with gzip are still snapshots consul can restore as they are.
+	if strings.HasSuffix(key, ".zst") {
+		return decompressSnapshot(snapshot)
+	}
+
+	return snapshot, nil
+}
+
+// fetchSnapshotObject downloads a stored snapshot object, reassembling it from its parts when it
+// was split.
+func fetchSnapshotObject(source *Target) ([]byte, error) {
+	provider := providers[source.Type]
+
+	data, err := provider.Get(source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots are gzip archives, so anything starting as a JSON object can only be a manifest.
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return data, nil
+	}
+
+	var manifest splitManifest
+
+	if err := json.Unmarshal(data, &manifest); err != nil || len(manifest.Parts) == 0 {
+		return data, nil
+	}
+
+	snapshot := make([]byte, 0, manifest.Size)
+
+	for _, part := range manifest.Parts {
+		partSource := *source
+		partSource.Path = path.Join(path.Dir(source.Path), part)
+
+		data, err := provider.Get(&partSource)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch snapshot part %s: %s", part, err)
+		}
+
+		snapshot = append(snapshot, data...)
+	}
+
+	if len(snapshot) != manifest.Size || sha256Hex(snapshot) != manifest.SHA256 {
+		return nil, fmt.Errorf("reassembled snapshot does not match its manifest")
+	}
+
+	log.Infof("reassembled snapshot from %d parts", len(manifest.Parts))
+
+	return snapshot, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// spoolSnapshot writes the snapshot read from the reader to a temporary file in the directory, only
+// readable by the current user, returning the file's path along with the snapshot's size and
+// sha256 digest.
+func spoolSnapshot(dir string, data io.Reader) (string, int64, string, error) {
+	file, err := ioutil.TempFile(dir, "consul-snapshot-")
+
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), data)
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return "", 0, "", err
+	}
+
+	return file.Name(), size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// restoreSpooledSnapshot restores the snapshot spooled to the file, as with restoreSnapshot.
+func restoreSpooledSnapshot(client *consul.Client, path string, timeout time.Duration) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return restoreSnapshotStream(client, file, timeout)
+}
+
+// sendSpooledSnapshot uploads the snapshot spooled to the file to a target that supports it, along
+// with its checksum and any sidecars, as sendSnapshot does for one held in memory.
+func sendSpooledSnapshot(target *Target, snapshotKey string, path string, sidecars map[string][]byte) error {
+	skip, err := checkCollision(target, snapshotKey)
+
+	if err != nil {
+		return err
+	}
+
+	if !skip {
+		if err := providers[target.Type].(StreamProvider).PutFile(target, snapshotKey, path); err != nil {
+			return fmt.Errorf("error uploading to %s: %s", target.Type, err)
+		}
+	}
+
+	if err := sendSnapshotChecksum(target, snapshotKey, result.SnapshotSHA256, result.SnapshotBytes); err != nil {
+		return err
+	}
+
+	return sendSidecars(target, snapshotKey, sidecars)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// statusVerifiedLookback bounds how many of the newest snapshots are checked for the last verified
+// one, as each check reads the snapshot's metadata.
+const statusVerifiedLookback = 20
+
+// backupStatus summarises the snapshots stored directly under a target path.
+type backupStatus struct {
+	Snapshots    int
+	Bytes        int64
+	Newest       string
+	NewestTime   time.Time
+	Oldest       string
+	OldestTime   time.Time
+	Verified     string
+	VerifiedTime time.Time
+	// VerifiedKnown is false when the target doesn't store the verification result of snapshots.
+	VerifiedKnown bool
+}
+
+// runStatus prints a summary of the backups stored in a target, refreshing it periodically with
+// --watch.
+func runStatus(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	watch := flags.Duration("watch", 0, "Keep refreshing the summary at this interval, eg 30s, until interrupted.")
+	nameTemplateText := flags.String("name-template", defaultNameTemplate, "The --name-template the snapshots were stored with, for finding them under the target.")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s status [options] {target_uri}\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	target, err := parseTarget(flags.Arg(0))
+
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	if _, ok := providers[target.Type]; !ok {
+		fatalf("target type of %s is not supported, expected one of: %s", target.Type, strings.Join(supportedTargetTypes(), ", "))
+	}
+
+	if err := parseNameTemplate(*nameTemplateText); err != nil {
+		fatalf("%s", err)
+	}
+
+	for {
+		status, err := readBackupStatus(target)
+
+		if err != nil {
+			if *watch == 0 {
+				fatalf("error reading backup status of %s: %s", flags.Arg(0), err)
+			}
+
+			log.Warnf("error reading backup status of %s: %s", flags.Arg(0), err)
+		} else {
+			if *watch > 0 {
+				// Clear the terminal so the summary refreshes in place.
+				fmt.Print("\033[H\033[2J")
+			}
+
+			os.Stdout.Write(formatBackupStatus(flags.Arg(0), status, time.Now()))
+		}
+
+		if *watch == 0 {
+			return
+		}
+
+		time.Sleep(*watch)
+	}
+}
+
+// readBackupStatus summarises the snapshots at the name template's depth under the target path,
+// counting the bytes of their sidecars and parts along with them. Snapshots under a prefix, such as
+// daily copies, aren't included.
+func readBackupStatus(target *Target) (*backupStatus, error) {
+	objects, err := providers[target.Type].Stat(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []string
+	taken := map[string]time.Time{}
+
+	for _, object := range objects {
+		if !isNamedSnapshotKey(object.Key) {
+			continue
+		}
+
+		if t, ok := snapshotTime(object.Key); ok {
+			snapshots = append(snapshots, object.Key)
+			taken[object.Key] = t
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return taken[snapshots[i]].After(taken[snapshots[j]])
+	})
+
+	status := &backupStatus{
+		Snapshots: len(snapshots),
+	}
+
+	for _, object := range objects {
+		for _, snapshotKey := range snapshots {
+			if object.Key == snapshotKey || strings.HasPrefix(object.Key, snapshotKey+".") {
+				status.Bytes += object.Size
+				break
+			}
+		}
+	}
+
+	if len(snapshots) == 0 {
+		return status, nil
+	}
+
+	status.Newest = snapshots[0]
+	status.NewestTime = taken[snapshots[0]]
+	status.Oldest = snapshots[len(snapshots)-1]
+	status.OldestTime = taken[status.Oldest]
+
+	metadata, ok := providers[target.Type].(MetadataProvider)
+
+	if !ok {
+		return status, nil
+	}
+
+	status.VerifiedKnown = true
+
+	for i, snapshotKey := range snapshots {
+		if i == statusVerifiedLookback {
+			break
+		}
+
+		values, err := metadata.Metadata(target, snapshotKey)
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading metadata of %s: %s", snapshotKey, err)
+		}
+
+		if values["verified"] == "true" {
+			status.Verified = snapshotKey
+			status.VerifiedTime = taken[snapshotKey]
+			break
+		}
+	}
+
+	return status, nil
+}
+
+// formatBackupStatus formats the status as a table, with the age of each snapshot as of now.
+func formatBackupStatus(uri string, status *backupStatus, now time.Time) []byte {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 8, 8, 6, ' ', 0)
+
+	snapshotLine := func(key string, taken time.Time) string {
+		return fmt.Sprintf("%s\t%s (%s ago)", key, taken.UTC().Format("2006-01-02 15:04:05 MST"), now.Sub(taken).Truncate(time.Second))
+	}
+
+	fmt.Fprintf(w, " Target\t%s\n", uri)
+	fmt.Fprintf(w, " Snapshots\t%d\n", status.Snapshots)
+	fmt.Fprintf(w, " Total size\t%s\n", formatByteSize(status.Bytes))
+
+	if status.Snapshots > 0 {
+		fmt.Fprintf(w, " Newest\t%s\n", snapshotLine(status.Newest, status.NewestTime))
+		fmt.Fprintf(w, " Oldest\t%s\n", snapshotLine(status.Oldest, status.OldestTime))
+	}
+
+	switch {
+	case status.Snapshots == 0:
+	case !status.VerifiedKnown:
+		fmt.Fprintf(w, " Last verified\tunknown, not recorded by %s targets\n", strings.SplitN(uri, ":", 2)[0])
+	case status.Verified == "":
+		fmt.Fprintf(w, " Last verified\tnone of the newest %d snapshots\n", statusVerifiedLookback)
+	default:
+		fmt.Fprintf(w, " Last verified\t%s\n", snapshotLine(status.Verified, status.VerifiedTime))
+	}
+
+	w.Flush()
+
+	return buf.Bytes()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	consulSnapshot "github.com/hashicorp/consul/snapshot"
+	log "github.com/sirupsen/logrus"
+)
+
+// streamSnapshot uploads the snapshot to the key of an s3 target as it's read from consul, verifying
+// the archive checksums in the same pass rather than restoring it to the dummy agent. An upload that
+// fails verification is removed again. The collision policy is applied before anything is read.
+func streamSnapshot(target *Target, snapshotKey string, data io.Reader) error {
+	skip, err := checkCollision(target, snapshotKey)
+
+	if err != nil || skip {
+		return err
+	}
+
+	verifyReader, verifyWriter := io.Pipe()
+	hash := sha256.New()
+	snapshot := &countingReader{r: io.TeeReader(io.TeeReader(data, verifyWriter), hash)}
+	verified := make(chan error, 1)
+
+	go func() {
+		_, err := consulSnapshot.Verify(verifyReader)
+
+		// Keep reading whatever verification leaves unread so the upload isn't blocked on the pipe.
+		io.Copy(ioutil.Discard, verifyReader)
+
+		verified <- err
+	}()
+
+	uploadErr := streamToS3(target, snapshotKey, snapshot, map[string]string{})
+	verifyWriter.CloseWithError(uploadErr)
+	verifyErr := <-verified
+
+	result.SnapshotBytes = int(snapshot.n)
+
+	if uploadErr != nil {
+		return fmt.Errorf("error uploading to %s: %s", target.Type, uploadErr)
+	}
+
+	if verifyErr != nil {
+		if err := providers[target.Type].Delete(target, snapshotKey); err != nil {
+			log.Warnf("error removing unverified snapshot %s: %s", snapshotKey, err)
+		}
+
+		return fmt.Errorf("snapshot failed verification: %s", verifyErr)
+	}
+
+	log.Infof("verified snapshot checksums, got snapshot of %d bytes", snapshot.n)
+
+	result.SnapshotSHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	return sendSnapshotChecksum(target, snapshotKey, result.SnapshotSHA256, result.SnapshotBytes)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+
+	"consul_backup_tool/pkg/target"
+)
+
+// Targets and the providers storing to them live in pkg/target. The aliases keep the names used
+// throughout this package, where target is the usual name of a *Target variable rather than the
+// package.
+type Target = target.Target
+type objectInfo = target.ObjectInfo
+type uploadSource = target.Source
+type MetadataProvider = target.MetadataProvider
+type StreamProvider = target.StreamProvider
+
+var providers = target.Providers
+
+func bytesSource(data []byte) uploadSource {
+	return target.BytesSource(data)
+}
+
+func fileSource(path string) uploadSource {
+	return target.FileSource(path)
+}
+
+func parseTarget(uri string) (*Target, error) {
+	return target.Parse(uri)
+}
+
+func validateTarget(t *Target) error {
+	return target.Validate(t)
+}
+
+func validateS3Upload() error {
+	return target.ValidateS3Upload()
+}
+
+func setUploadBandwidthLimit(value string) error {
+	return target.SetBandwidthLimit(value)
+}
+
+func streamToS3(t *Target, key string, data io.Reader, metadata map[string]string) error {
+	return target.StreamToS3(t, key, data, metadata)
+}
+
+func supportedTargetTypes() []string {
+	return target.Types()
+}
+
+func init() {
+	target.ContentType = contentType
+	target.ObjectMetadata = snapshotMetadata
+
+	target.OnRetry = func(retries int) {
+		result.UploadRetries += retries
+	}
+}
+
+// snapshotMetadata returns the metadata providers store on the object under the key. The snapshot
+// itself carries its verification result so the target can be queried for it, rather than its
+// signature and other sidecars.
+func snapshotMetadata(key string) map[string]string {
+	if !isSnapshotKey(key) {
+		return nil
+	}
+
+	return verificationMetadata()
+}
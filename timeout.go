@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"consul_backup_tool/pkg/target"
+	log "github.com/sirupsen/logrus"
+)
+
+// runContext is cancelled when the run times out or is interrupted, stopping the requests to consul
+// and the targets in flight so the run fails and cleans up after itself.
+var runContext = context.Background()
+
+// cancelGracePeriod is how long a cancelled run is given to stop and clean up before exiting
+// regardless, for anything still blocked that doesn't take a context.
+var cancelGracePeriod = time.Second * 30
+
+// stopWatchingRun stops the watch startRunContext keeps on the run, when it's been started.
+var stopWatchingRun = func() {}
+
+// startRunContext sets and returns runContext, cancelling it after the timeout when set or on
+// SIGINT or SIGTERM. A run still going the grace period after being cancelled fails straight away.
+func startRunContext(timeout time.Duration) context.Context {
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	runContext = ctx
+	target.Context = ctx
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	done := make(chan struct{})
+	var once sync.Once
+
+	stopWatchingRun = func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+	}
+
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warnf("received %s, cancelling the backup", sig)
+			cancel()
+		case <-ctx.Done():
+			log.Warnf("backup timed out after %s, cancelling it", timeout)
+		case <-done:
+			return
+		}
+
+		select {
+		case <-time.After(cancelGracePeriod):
+			fatalf("backup did not stop within %s of being cancelled", cancelGracePeriod)
+		case <-done:
+		}
+	}()
+
+	return ctx
+}
+
+// stopRunContext stops the timeout and signals cancelling the run once it's complete, so they
+// can't fail a run that's already finished, eg while it lingers to serve metrics. Signals are
+// handled as usual again, so they stop the process straight away.
+func stopRunContext() {
+	stopWatchingRun()
+}
+
+// phaseContext returns a context for a phase of the run, bounded to the timeout when set.
+func phaseContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(runContext, timeout)
+	}
+
+	return context.WithCancel(runContext)
+}
+
+// runCancelled returns an error when the run has been cancelled, for stopping between phases.
+func runCancelled() error {
+	if err := runContext.Err(); err != nil {
+		return fmt.Errorf("backup cancelled: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"consul_backup_tool/pkg/target"
+)
+
+func TestStopRunContextAfterRunCompletes(t *testing.T) {
+	defaultGracePeriod := cancelGracePeriod
+	cancelGracePeriod = 50 * time.Millisecond
+
+	defer func() {
+		cancelGracePeriod = defaultGracePeriod
+		runContext = context.Background()
+		target.Context = context.Background()
+	}()
+
+	startRunContext(10 * time.Millisecond)
+	stopRunContext()
+
+	// Still watching, the timeout and grace period would have failed the run by now, exiting the
+	// test binary.
+	time.Sleep(200 * time.Millisecond)
+
+	// Stopping again is harmless, as fatalf and the end of the run can both stop it.
+	stopRunContext()
+}
+
+func TestRunCancelledAfterTimeout(t *testing.T) {
+	defaultGracePeriod := cancelGracePeriod
+	cancelGracePeriod = time.Hour
+
+	defer func() {
+		cancelGracePeriod = defaultGracePeriod
+		runContext = context.Background()
+		target.Context = context.Background()
+	}()
+
+	startRunContext(10 * time.Millisecond)
+	defer stopRunContext()
+
+	if err := runCancelled(); err != nil {
+		t.Fatalf("expected the run not to be cancelled yet, got %s", err)
+	}
+
+	<-runContext.Done()
+
+	if err := runCancelled(); err == nil {
+		t.Errorf("expected the run to be cancelled once it timed out")
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runTracer collects the spans of the run's phases, exporting them as one trace to an otlp
+// collector over http with json once the run completes.
+type runTracer struct {
+	mu         sync.Mutex
+	endpoint   string
+	headers    map[string]string
+	timeout    time.Duration
+	resource   map[string]string
+	traceID    string
+	rootID     string
+	rootParent string
+	spans      []traceSpan
+	exported   bool
+}
+
+// traceSpan is a finished span of the run.
+type traceSpan struct {
+	ID         string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+// tracer traces the run when an otlp endpoint is configured, nil otherwise.
+var tracer *runTracer
+
+// configureTracing enables tracing of the run from the standard OTEL_* environment variables,
+// when OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. Spans are sent as
+// json over http, the otlp protocol available without a grpc client, and join the trace of the
+// W3C TRACEPARENT environment variable when it's set.
+func configureTracing() error {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil
+	}
+
+	if exporter := otelEnv("TRACES_EXPORTER"); exporter != "" && exporter != "otlp" {
+		return nil
+	}
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+
+	if endpoint == "" {
+		return nil
+	}
+
+	if protocol := otelExporterEnv("PROTOCOL"); protocol != "" && protocol != "http/json" {
+		return fmt.Errorf("unsupported otlp protocol '%s', traces can only be exported with http/json", protocol)
+	}
+
+	headers, err := parseOTELPairs(otelExporterEnv("HEADERS"))
+
+	if err != nil {
+		return fmt.Errorf("invalid otlp headers: %s", err)
+	}
+
+	resource, err := parseOTELPairs(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"))
+
+	if err != nil {
+		return fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %s", err)
+	}
+
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		resource["service.name"] = name
+	}
+
+	if resource["service.name"] == "" {
+		resource["service.name"] = "consul-backup"
+	}
+
+	timeout := time.Second * 10
+
+	if value := otelExporterEnv("TIMEOUT"); value != "" {
+		ms, err := strconv.Atoi(value)
+
+		if err != nil || ms <= 0 {
+			return fmt.Errorf("invalid otlp timeout '%s', expected a number of milliseconds", value)
+		}
+
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	t := &runTracer{
+		endpoint: endpoint,
+		headers:  headers,
+		timeout:  timeout,
+		resource: resource,
+		traceID:  randomHex(16),
+		rootID:   randomHex(8),
+	}
+
+	// traceparent is version-traceid-parentid-flags, eg 00-{32 hex}-{16 hex}-01.
+	if parts := strings.Split(os.Getenv("TRACEPARENT"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		t.traceID = parts[1]
+		t.rootParent = parts[2]
+	}
+
+	tracer = t
+
+	log.Infof("tracing the backup to %s", endpoint)
+
+	return nil
+}
+
+// otelEnv returns the OTEL_ environment variable with the name.
+func otelEnv(name string) string {
+	return strings.TrimSpace(os.Getenv("OTEL_" + name))
+}
+
+// otelExporterEnv returns the otlp exporter setting with the name, preferring the traces specific
+// variable over the general one.
+func otelExporterEnv(name string) string {
+	if value := otelEnv("EXPORTER_OTLP_TRACES_" + name); value != "" {
+		return value
+	}
+
+	return otelEnv("EXPORTER_OTLP_" + name)
+}
+
+// parseOTELPairs parses the comma separated key=value pairs of the OTEL_ environment variables,
+// where the values are url encoded.
+func parseOTELPairs(value string) (map[string]string, error) {
+	pairs := map[string]string{}
+
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("'%s' is not a key=value pair", pair)
+		}
+
+		decoded, err := url.QueryUnescape(strings.TrimSpace(parts[1]))
+
+		if err != nil {
+			return nil, fmt.Errorf("'%s' has an invalid value: %s", pair, err)
+		}
+
+		pairs[strings.TrimSpace(parts[0])] = decoded
+	}
+
+	return pairs, nil
+}
+
+// randomHex returns n random bytes hex encoded, for trace and span ids.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// startSpan starts a span of the run, with the attributes given as key value pairs, returning the
+// function ending it with the error it failed with, if any. It does nothing when not tracing.
+func startSpan(name string, attributes ...string) func(error) {
+	if tracer == nil {
+		return func(error) {}
+	}
+
+	start := time.Now()
+
+	return func(err error) {
+		tracer.addSpan(name, start, time.Now(), err, attributes...)
+	}
+}
+
+// addSpan records a finished span of the run.
+func (t *runTracer) addSpan(name string, start time.Time, end time.Time, err error, attributes ...string) {
+	span := traceSpan{
+		ID:         randomHex(8),
+		Name:       name,
+		Start:      start,
+		End:        end,
+		Attributes: map[string]string{},
+	}
+
+	for i := 0; i+1 < len(attributes); i += 2 {
+		span.Attributes[attributes[i]] = attributes[i+1]
+	}
+
+	if err != nil {
+		span.Error = err.Error()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.spans = append(t.spans, span)
+}
+
+// exportTrace sends the spans of the run to the collector under a span of the whole run, with the
+// outcome of the run. Failing to export is logged rather than changing the outcome of the run.
+func exportTrace(r *RunResult) {
+	if tracer == nil {
+		return
+	}
+
+	tracer.mu.Lock()
+
+	// fatalf can end the run while it's being exported.
+	if tracer.exported {
+		tracer.mu.Unlock()
+		return
+	}
+
+	tracer.exported = true
+	spans := append([]traceSpan{}, tracer.spans...)
+	tracer.mu.Unlock()
+
+	root := traceSpan{
+		ID:    tracer.rootID,
+		Name:  "backup",
+		Start: runStart,
+		End:   time.Now(),
+		Attributes: map[string]string{
+			"consul_backup.status": r.Status,
+			"consul_backup.target": r.Target,
+		},
+	}
+
+	for k, v := range map[string]string{
+		"consul_backup.snapshot_key":  r.SnapshotKey,
+		"consul_backup.datacenter":    r.Datacenter,
+		"consul_backup.failed_phase":  r.FailedPhase,
+		"consul_backup.verify_mode":   r.VerifyMode,
+		"consul_backup.snapshot_size": strconv.Itoa(r.SnapshotBytes),
+	} {
+		if v != "" {
+			root.Attributes[k] = v
+		}
+	}
+
+	if r.Status != "success" && r.Status != "skipped" {
+		root.Error = r.Error
+
+		// The phase the run failed in only finishes here, so it's ended along with the run, from
+		// when the last phase before it ended.
+		if r.FailedPhase != "" && r.FailedPhase != "setup" {
+			start := runStart
+
+			for _, span := range spans {
+				if span.End.After(start) {
+					start = span.End
+				}
+			}
+
+			spans = append(spans, traceSpan{
+				ID:         randomHex(8),
+				Name:       r.FailedPhase,
+				Start:      start,
+				End:        root.End,
+				Attributes: map[string]string{},
+				Error:      r.Error,
+			})
+		}
+	}
+
+	data, err := json.Marshal(tracer.payload(root, spans))
+
+	if err != nil {
+		log.Warnf("error encoding trace: %s", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, tracer.endpoint, bytes.NewReader(data))
+
+	if err != nil {
+		log.Warnf("error exporting trace to %s: %s", tracer.endpoint, err)
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for k, v := range tracer.headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: tracer.timeout}
+	resp, err := client.Do(req)
+
+	if err == nil {
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("unexpected response code %d", resp.StatusCode)
+		}
+	}
+
+	if err != nil {
+		log.Warnf("error exporting trace to %s: %s", tracer.endpoint, err)
+		return
+	}
+
+	log.Infof("exported trace %s of %d spans", tracer.traceID, len(spans)+1)
+}
+
+// otlpValue is an otlp attribute value.
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpAttribute is an otlp attribute.
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpStatus is the status of an otlp span, where code 1 is ok and 2 is an error.
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpSpan is a span in the otlp json encoding.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// otlpAttributes converts the attributes to otlp attributes, in a stable order.
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	var keys []string
+
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+
+	var converted []otlpAttribute
+
+	for _, k := range sortedStrings(keys) {
+		converted = append(converted, otlpAttribute{Key: k, Value: otlpValue{StringValue: attributes[k]}})
+	}
+
+	return converted
+}
+
+// payload builds the otlp export request of the run's spans, as children of the root span.
+func (t *runTracer) payload(root traceSpan, spans []traceSpan) map[string]interface{} {
+	convert := func(span traceSpan, parent string) otlpSpan {
+		status := otlpStatus{Code: 1}
+
+		if span.Error != "" {
+			status = otlpStatus{Code: 2, Message: span.Error}
+		}
+
+		return otlpSpan{
+			TraceID:      t.traceID,
+			SpanID:       span.ID,
+			ParentSpanID: parent,
+			Name:         span.Name,
+			// 1 is an internal span, as the phases aren't requests to or from the collector.
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+			Status:            status,
+		}
+	}
+
+	converted := []otlpSpan{convert(root, t.rootParent)}
+
+	for _, span := range spans {
+		converted = append(converted, convert(span, t.rootID))
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(t.resource),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "consul-backup"},
+						"spans": converted,
+					},
+				},
+			},
+		},
+	}
+}
+
+// traceParent returns the W3C traceparent of the run's span, for the backups of child processes to
+// join the run's trace, or an empty string when not tracing.
+func traceParent() string {
+	if tracer == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("00-%s-%s-01", tracer.traceID, tracer.rootID)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// withTracingEnv sets the environment variables for the test, clearing the tracer afterwards.
+func withTracingEnv(t *testing.T, env map[string]string) {
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+
+	t.Cleanup(func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+
+		tracer = nil
+	})
+}
+
+func TestConfigureTracingDisabledWithoutEndpoint(t *testing.T) {
+	withTracingEnv(t, map[string]string{})
+
+	if err := configureTracing(); err != nil {
+		t.Fatalf("error configuring tracing: %s", err)
+	}
+
+	if tracer != nil {
+		t.Errorf("expected tracing to be disabled without an otlp endpoint")
+	}
+
+	// Spans do nothing when not tracing.
+	startSpan("compress")(nil)
+}
+
+func TestConfigureTracingRejectsGRPC(t *testing.T) {
+	withTracingEnv(t, map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317",
+		"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc",
+	})
+
+	if err := configureTracing(); err == nil {
+		t.Errorf("expected the grpc protocol to be rejected")
+	}
+}
+
+func TestConfigureTracingTraceParent(t *testing.T) {
+	withTracingEnv(t, map[string]string{
+		"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://collector:4318/custom",
+		"TRACEPARENT":                        "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	})
+
+	if err := configureTracing(); err != nil {
+		t.Fatalf("error configuring tracing: %s", err)
+	}
+
+	if tracer.endpoint != "http://collector:4318/custom" {
+		t.Errorf("expected the traces endpoint to be used as given, got %s", tracer.endpoint)
+	}
+
+	if tracer.traceID != "0af7651916cd43dd8448eb211c80319c" || tracer.rootParent != "b7ad6b7169203331" {
+		t.Errorf("expected the run to join the trace of TRACEPARENT, got trace %s parent %s", tracer.traceID, tracer.rootParent)
+	}
+}
+
+func TestParseOTELPairs(t *testing.T) {
+	pairs, err := parseOTELPairs("api-key=a%20b, tenant=ops")
+
+	if err != nil {
+		t.Fatalf("error parsing pairs: %s", err)
+	}
+
+	if pairs["api-key"] != "a b" || pairs["tenant"] != "ops" {
+		t.Errorf("expected decoded pairs, got %v", pairs)
+	}
+
+	if _, err := parseOTELPairs("novalue"); err == nil {
+		t.Errorf("expected a pair without a value to fail")
+	}
+}
+
+func TestExportTrace(t *testing.T) {
+	var body []byte
+	var header http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		header = r.Header
+	}))
+	defer server.Close()
+
+	withTracingEnv(t, map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": server.URL,
+		"OTEL_EXPORTER_OTLP_HEADERS":  "x-api-key=secret",
+		"OTEL_SERVICE_NAME":           "backups",
+	})
+
+	if err := configureTracing(); err != nil {
+		t.Fatalf("error configuring tracing: %s", err)
+	}
+
+	tracer.addSpan("snapshot", time.Now().Add(-time.Second), time.Now(), nil)
+	startSpan("store", "consul_backup.target", "s3://bucket")(errors.New("access denied"))
+
+	exportTrace(&RunResult{Status: "failure", FailedPhase: "upload", Error: "error storing snapshot"})
+
+	if header.Get("X-Api-Key") != "secret" || header.Get("Content-Type") != "application/json" {
+		t.Errorf("expected json with the configured headers, got %v", header)
+	}
+
+	var payload struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("error decoding export: %s", err)
+	}
+
+	spans := payload.ResourceSpans[0].ScopeSpans[0].Spans
+	names := map[string]otlpSpan{}
+
+	for _, span := range spans {
+		names[span.Name] = span
+	}
+
+	root := names["backup"]
+
+	if root.ParentSpanID != "" || root.Status.Code != 2 {
+		t.Errorf("expected a failed root span, got %+v", root)
+	}
+
+	for _, name := range []string{"snapshot", "store", "upload"} {
+		span, ok := names[name]
+
+		if !ok {
+			t.Errorf("expected a %s span", name)
+			continue
+		}
+
+		if span.ParentSpanID != root.SpanID || span.TraceID != root.TraceID {
+			t.Errorf("expected the %s span to be a child of the run", name)
+		}
+	}
+
+	// The failed phase is ended along with the run.
+	if names["upload"].Status.Code != 2 || names["store"].Status.Message != "access denied" {
+		t.Errorf("expected the failed upload and store to be errors")
+	}
+
+	if attribute := payload.ResourceSpans[0].Resource.Attributes; len(attribute) != 1 || attribute[0].Value.StringValue != "backups" {
+		t.Errorf("expected the service name as the resource, got %v", attribute)
+	}
+
+	// A second export, such as fatalf during the first, sends nothing more.
+	body = nil
+	exportTrace(&RunResult{Status: "failure"})
+
+	if body != nil {
+		t.Errorf("expected the trace to only be exported once")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"consul_backup_tool/pkg/target"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+// runUpload verifies an existing local snapshot by restoring it to the dummy agent, then uploads it
+// to the target as if it had just been taken.
+func runUpload(args []string) {
+	flags := flag.NewFlagSet("upload", flag.ExitOnError)
+	file := flags.String("file", "", "Path to the local snapshot to upload, as saved by `consul snapshot save`.")
+	targetURI := flags.String("target", "", "The target to send the backup to. Format: {provider}://{path_on_provider} (eg, s3://my-bucket/consul-snapshots")
+	restoreTimeout := flags.Duration("restore-timeout", 0, "Maximum time to allow for restoring the snapshot to the dummy consul agent during verification. 0 means no limit.")
+	encryptionKeyValue := flags.String("encryption-key", "", "Base64 encoded 32 byte key to encrypt snapshots with (AES-256-GCM) before upload, stored as {snapshot}.enc. Defaults to ENCRYPTION_KEY.")
+	encrypt := flags.String("encrypt", "", "Encrypt snapshots before upload, stored as {snapshot}.enc, either to age recipients with age:{recipient}[,{recipient}] or with AES-256-GCM using a key file with aes256:{keyfile}. An alternative to --encryption-key.")
+	compressDictPath := flags.String("compress-dict", "", "Path to a zstd dictionary, trained with zstd --train on uncompressed snapshots, to compress snapshots with before upload, stored as {snapshot}.zst. Consecutive snapshots are similar, so this greatly improves on the gzip compression consul uses.")
+	compress := flags.String("compress", "", "Compress snapshots before upload, either zstd (level 3), stored as {snapshot}.zst, gzip (best level), stored as {snapshot}.gz, or none, the default. Snapshots are already gzip archives, so zstd replaces their gzip layer and gzip leaves a snapshot consul restores as it is.")
+	signKeyPath := flags.String("sign-key", "", "Path to an openpgp private key used to upload a detached {snapshot}.sig signature alongside the snapshot. An encrypted key is unlocked with SIGN_KEY_PASSPHRASE.")
+	nameTemplateText := flags.String("name-template", defaultNameTemplate, "Template of the keys snapshots are stored under, eg {{.Datacenter}}/{{.Timestamp.Format \"2006/01/02\"}}/{{.Timestamp.Unix}}.snap, with .Timestamp, .Datacenter, .Namespace, .Partition and .Hostname. The name needs to end in {{.Timestamp.Unix}}.snap. Compression and encryption extensions are added to it.")
+	dailyPrefix := flags.String("daily-prefix", "", "Also store the first snapshot of each day (UTC) under this prefix of the target, eg daily, for tiered retention.")
+	s3MaxConcurrency := flags.Int("s3-max-concurrency", 0, "Maximum number of s3 api calls to have in flight at once, shared across all s3 operations. 0 means no limit.")
+	flags.BoolVar(&target.S3CreateBucket, "create-bucket", false, "Create the s3 target bucket in the configured region if it doesn't exist.")
+	flags.Int64Var(&target.S3PartSize, "upload-part-size", target.S3PartSize, "Size in bytes of the parts s3 uploads larger than it are split into, at least 5MiB.")
+	flags.IntVar(&target.S3UploadConcurrency, "upload-concurrency", target.S3UploadConcurrency, "How many parts of an s3 upload to send at once.")
+	flags.StringVar(&target.S3StorageClass, "s3-storage-class", "", "Storage class to upload to s3 targets with, eg STANDARD_IA or GLACIER, when not given by their storage-class option.")
+	flags.StringVar(&target.S3SSE, "s3-sse", "", "Server side encryption to upload to s3 targets with, either AES256 or aws:kms, when not given by their sse option.")
+	flags.StringVar(&target.S3KMSKeyID, "s3-kms-key-id", "", "KMS key to encrypt uploads to s3 targets with when using aws:kms, when not given by their kms-key-id option.")
+	flags.DurationVar(&dummyAgentConfig.ReadyTimeout, "agent-ready-timeout", time.Second*30, "Maximum time to wait for the dummy consul agent used for verification to become ready.")
+	flags.BoolVar(&dummyAgentConfig.EphemeralPorts, "verify-ephemeral-ports", dummyAgentConfig.EphemeralPorts, "Bind the dummy consul agent used for verification to free loopback ports instead of the consul defaults, avoiding conflicts with services on the host. Pass --verify-ephemeral-ports=false for the defaults.")
+	flags.BoolVar(&dummyAgentConfig.ACLs, "verify-acls", false, "Enable ACLs on the dummy consul agent used for verification, bootstrapped with a random token, so restoring the snapshot exercises its ACL state.")
+	flags.StringVar(&dummyAgentConfig.Addr, "verify-addr", "", "Address for the http api of the dummy consul agent used for verification, eg 127.0.0.1:18500, rather than a free loopback port.")
+	flags.DurationVar(&target.S3TTL, "ttl", 0, "Tag uploaded s3 objects with an expires-at time this far in the future (and set the Expires header), for lifecycle rules to expire them by.")
+	retain := flags.Int("retain", 0, "After uploading, delete all but this many of the newest snapshots directly under the target path, along with their sidecars. 0 means no limit.")
+	flags.IntVar(retain, "retain-count", 0, "Alias of --retain.")
+	retainDays := flags.Int("retain-days", 0, "After uploading, delete snapshots directly under the target path older than this many days, along with their sidecars. 0 means no limit.")
+	retainAge := flags.Duration("retain-age", 0, "After uploading, delete snapshots directly under the target path taken longer ago than this, eg 720h, along with their sidecars. An alternative to --retain-days. 0 means no limit.")
+	retainDaily := flags.Int("retain-daily", 0, "After uploading, delete all but this many of the newest daily snapshots under --daily-prefix, along with their sidecars. 0 means no limit.")
+	retentionDryRun := flags.Bool("retention-dry-run", false, "Only log what --retain, --retain-days, --retain-age and --retain-daily would delete.")
+	flags.Int64Var(&splitSize, "split-size", 0, "Split snapshots larger than this many bytes into {snapshot}.partNNNN objects, storing a manifest under the snapshot key. 0 means never split.")
+	flags.StringVar(&snapshotContentType, "content-type", "application/octet-stream", "Content type to upload snapshots with, for targets that store one.")
+	flags.StringVar(&target.SFTPKeyPath, "sftp-key", "", "Private key to authenticate to sftp targets with. Defaults to SFTP_KEY_PATH, with SFTP_KEY_PASSPHRASE unlocking an encrypted key.")
+	flags.StringVar(&target.SFTPKnownHosts, "sftp-known-hosts", "", "known_hosts file to verify the host keys of sftp targets against. Defaults to SFTP_KNOWN_HOSTS, then ~/.ssh/known_hosts.")
+	flags.DurationVar(&target.Timeout, "target-timeout", 0, "Maximum time to allow for each upload to the target. 0 means no limit.")
+	flags.IntVar(&target.Retries, "upload-retries", 3, "How many times to retry a failed upload to the target. Errors retrying can't fix, such as access denied or a missing bucket, fail straight away.")
+	flags.DurationVar(&target.Backoff, "upload-backoff", time.Second*5, "How long to wait before the first upload retry, doubling for each retry after it, with jitter.")
+	flags.DurationVar(&target.RetryMaxWait, "upload-retry-max-wait", time.Minute, "Longest to wait between upload retries, capping the doubling of --upload-backoff. 0 means no limit.")
+	uploadBandwidthLimit := flags.String("upload-bandwidth-limit", "", "Limit the rate uploads are sent at, shared across all the targets, eg 10MiB/s, 500KB/s or a number of bytes per second, so backups don't saturate the link. Empty means no limit.")
+	flags.StringVar(&onCollision, "on-collision", "overwrite", "What to do when a key being uploaded already exists in the target, either overwrite, skip or fail.")
+	flags.StringVar(&resultFile, "result-file", "", "Write a JSON summary of the run to this path on completion, including on failure.")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s upload --file {snapshot_file} --target {target_uri} [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	target.SetS3MaxConcurrency(*s3MaxConcurrency)
+
+	if *targetURI == "" {
+		envTargetURI := os.Getenv("TARGET_URI")
+		targetURI = &envTargetURI
+	}
+
+	if *file == "" || *targetURI == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	result.Target = *targetURI
+
+	target, err := parseTarget(*targetURI)
+
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := validateTarget(target); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := parseNameTemplate(*nameTemplateText); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := validateCollisionPolicy(); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := validateS3Upload(); err != nil {
+		fatalf("%s", err)
+	}
+
+	retainAgeLimit, err := retentionAge(*retainDays, *retainAge)
+
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := validateRetainDaily(*retainDaily, *dailyPrefix); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setEncryptionKey(*encryptionKeyValue); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setEncryption(*encrypt); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setCompressionDict(*compressDictPath); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setCompression(*compress); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setUploadBandwidthLimit(*uploadBandwidthLimit); err != nil {
+		fatalf("%s", err)
+	}
+
+	var signingKey *openpgp.Entity
+
+	if *signKeyPath != "" {
+		signingKey, err = loadSigningKey(*signKeyPath, os.Getenv("SIGN_KEY_PASSPHRASE"))
+
+		if err != nil {
+			fatalf("error loading signing key: %s", err)
+		}
+	}
+
+	snapshot, err := ioutil.ReadFile(*file)
+
+	if err != nil {
+		fatalf("error reading snapshot file: %s", err)
+	}
+
+	log.Infof("read snapshot of %d bytes from %s", len(snapshot), *file)
+
+	result.SnapshotBytes = len(snapshot)
+	result.VerifyMode = "restore-only"
+
+	verifyStart := time.Now()
+	currentPhase = "verify"
+
+	log.Info("verifying snapshot by restoring to dummy consul server")
+
+	_, dummyConsulClient, err := startDummyAgent(dummyAgentConfig)
+
+	if err != nil {
+		fatalf("error starting dummy consul agent to test snapshot: %s", err)
+	}
+
+	if err := restoreSnapshot(dummyConsulClient, snapshot, *restoreTimeout); err != nil {
+		fatalf("error restoring snapshot to dummy consul agent: %s", err)
+	}
+
+	snapshotKvs, err := listKVChunk(dummyConsulClient, "/")
+
+	if err != nil {
+		fatalf("error listing keys restored to dummy consul agent: %s", err)
+	}
+
+	log.Infof("verified snapshot restores, got %d keys", len(snapshotKvs))
+
+	result.SnapshotKeys = len(snapshotKvs)
+
+	recordDuration("verify", verifyStart)
+
+	uploadStart := time.Now()
+	currentPhase = "upload"
+
+	log.Infof("uploading snapshot to %s", target.Type)
+
+	if err := storeSnapshot(target, snapshot, signingKey, nil, *dailyPrefix); err != nil {
+		fatalf("%s", err)
+	}
+
+	recordDuration("upload", uploadStart)
+
+	if *retain > 0 || retainAgeLimit > 0 {
+		summary, err := applyRetention(target, "", *retain, retainAgeLimit, *retentionDryRun)
+
+		if err != nil {
+			log.Warnf("error applying retention to %s: %s", target.Type, err)
+		} else {
+			recordRetention(*targetURI, false, summary)
+		}
+	}
+
+	if *retainDaily > 0 {
+		summary, err := applyRetention(target, *dailyPrefix, *retainDaily, 0, *retentionDryRun)
+
+		if err != nil {
+			log.Warnf("error applying retention to the daily snapshots of %s: %s", target.Type, err)
+		} else {
+			recordRetention(*targetURI, true, summary)
+		}
+	}
+	recordDuration("total", runStart)
+
+	result.Status = "success"
+	writeResult()
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// kvVerification accumulates the comparison of the live KV against the KV restored from a snapshot.
+type kvVerification struct {
+	SnapshotIndex         uint64
+	SnapshotKeys          int
+	LiveKeys              int
+	ModifiedSinceSnapshot int
+	SnapshotOnlyKeys      int
+	MissingKeys           []string
+	MismatchedKeys        []string
+
+	// SamplePercent limits the comparison to this percentage of keys when above 0, chosen by
+	// SampleSeed so the same seed always checks the same keys.
+	SamplePercent float64
+	SampleSeed    int64
+	SampledKeys   int
+
+	// SkipPrefixes are left out of the comparison, for keys known to churn while backing up.
+	SkipPrefixes []string
+	SkippedKeys  int
+
+	// mu guards the results, as chunks of the KV are compared at once.
+	mu sync.Mutex
+}
+
+// skipped reports whether the key is under one of the prefixes left out of the comparison.
+func (v *kvVerification) skipped(key string) bool {
+	for _, prefix := range v.SkipPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sampled reports whether the key is part of the spot check. Keys are chosen by a hash of the seed
+// and the key rather than their position, so a seed picks the same keys however the KV changes.
+func (v *kvVerification) sampled(key string) bool {
+	if v.SamplePercent <= 0 || v.SamplePercent >= 100 {
+		return true
+	}
+
+	hash := fnv.New64a()
+	binary.Write(hash, binary.LittleEndian, v.SampleSeed)
+	hash.Write([]byte(key))
+
+	return float64(hash.Sum64()%10000) < v.SamplePercent*100
+}
+
+// compare checks each live key is present in the snapshot with the same value, comparing the
+// sha256 of the values so only a digest of each is held at once. It can be called repeatedly, and
+// at once, with disjoint sets of keys, accumulating the results across calls.
+func (v *kvVerification) compare(snapshotKvs consul.KVPairs, liveKvs consul.KVPairs) {
+	snapshotValues := make(map[string][sha256.Size]byte, len(snapshotKvs))
+	snapshotIndexes := make(map[string]uint64, len(snapshotKvs))
+	snapshotSizes := make(map[string]int, len(snapshotKvs))
+	liveKeys := make(map[string]bool, len(liveKvs))
+	skipped := 0
+
+	for _, kv := range snapshotKvs {
+		if v.sampled(kv.Key) && !v.skipped(kv.Key) {
+			snapshotValues[kv.Key] = sha256.Sum256(kv.Value)
+			snapshotIndexes[kv.Key] = kv.ModifyIndex
+			snapshotSizes[kv.Key] = len(kv.Value)
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, kv := range liveKvs {
+		if !v.sampled(kv.Key) {
+			continue
+		}
+
+		if v.skipped(kv.Key) {
+			log.Debugf("key %s skipped, under a --verify-skip-prefix", kv.Key)
+			skipped++
+			continue
+		}
+
+		liveKeys[kv.Key] = true
+		v.SampledKeys++
+
+		// Keys written after the snapshot index can't be expected to match the snapshot, leaving
+		// them out keeps the comparison pinned to the point in time the snapshot was taken at.
+		if kv.ModifyIndex > v.SnapshotIndex {
+			log.Debugf("key %s skipped, modified at index %d after the snapshot", kv.Key, kv.ModifyIndex)
+			v.ModifiedSinceSnapshot++
+			continue
+		}
+
+		digest, ok := snapshotValues[kv.Key]
+
+		// Values are left out of the logs as they may hold secrets.
+		if !ok {
+			log.Debugf("key %s missing from the snapshot, live value of %d bytes modified at index %d", kv.Key, len(kv.Value), kv.ModifyIndex)
+			v.MissingKeys = append(v.MissingKeys, kv.Key)
+		} else if digest != sha256.Sum256(kv.Value) {
+			log.Debugf("key %s differs, snapshot value of %d bytes modified at index %d, live value of %d bytes modified at index %d", kv.Key, snapshotSizes[kv.Key], snapshotIndexes[kv.Key], len(kv.Value), kv.ModifyIndex)
+			v.MismatchedKeys = append(v.MismatchedKeys, kv.Key)
+		}
+	}
+
+	v.SkippedKeys += skipped
+
+	// Keys only present in the snapshot have been deleted since it was taken, expected churn
+	// that's worth reporting but not failing on.
+	for key := range snapshotValues {
+		if !liveKeys[key] {
+			log.Debugf("key %s only in the snapshot, deleted since", key)
+			v.SnapshotOnlyKeys++
+		}
+	}
+
+	v.SnapshotKeys += len(snapshotKvs)
+	v.LiveKeys += len(liveKvs)
+}
+
+// compareChunks compares the chunks of the KV, listing up to concurrency of them at once from the
+// snapshot and the live cluster, returning the first error listing them.
+func (v *kvVerification) compareChunks(chunks []string, concurrency int, listSnapshot func(chunk string) (consul.KVPairs, error), listLive func(chunk string) (consul.KVPairs, error)) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	work := make(chan string)
+	errs := make(chan error, len(chunks))
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency && i < len(chunks); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for chunk := range work {
+				snapshotKvs, err := listSnapshot(chunk)
+
+				if err != nil {
+					errs <- fmt.Errorf("error listing keys restored to dummy consul agent: %s", err)
+					continue
+				}
+
+				liveKvs, err := listLive(chunk)
+
+				if err != nil {
+					errs <- fmt.Errorf("error listing live consul keys: %s", err)
+					continue
+				}
+
+				v.compare(snapshotKvs, liveKvs)
+			}
+		}()
+	}
+
+	for _, chunk := range chunks {
+		// Once a chunk has failed the rest aren't worth listing.
+		if len(errs) > 0 {
+			break
+		}
+
+		work <- chunk
+	}
+
+	close(work)
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// listKVChunks returns the top level KV prefixes (ending in /) and keys of all the given clients,
+// so the KV can be compared one chunk at a time rather than all at once.
+func listKVChunks(clients ...*consul.Client) ([]string, error) {
+	seen := map[string]bool{}
+
+	for _, client := range clients {
+		var keys []string
+
+		_, err := retryBackoff("listing top level keys", isRetryableConsulError, func() error {
+			var err error
+			keys, _, err = client.KV().Keys("", "/", nil)
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			seen[key] = true
+		}
+	}
+
+	chunks := make([]string, 0, len(seen))
+
+	for key := range seen {
+		chunks = append(chunks, key)
+	}
+
+	sort.Strings(chunks)
+
+	return chunks, nil
+}
+
+// listKVChunk lists every pair under a prefix ending in /, or the whole KV for the empty prefix, or
+// the single pair of a top level key.
+func listKVChunk(client *consul.Client, chunk string) (consul.KVPairs, error) {
+	var pairs consul.KVPairs
+
+	description := fmt.Sprintf("listing keys of %s", chunk)
+
+	if chunk == "" {
+		description = "listing all keys"
+	}
+
+	_, err := retryBackoff(description, isRetryableConsulError, func() error {
+		if chunk == "" || strings.HasSuffix(chunk, "/") {
+			var err error
+			pairs, _, err = client.KV().List(chunk, nil)
+			return err
+		}
+
+		pair, _, err := client.KV().Get(chunk, nil)
+
+		pairs = nil
+
+		if pair != nil {
+			pairs = consul.KVPairs{pair}
+		}
+
+		return err
+	})
+
+	return pairs, err
+}
+
+// countSessionsAndQueries counts the sessions created at or before the index and the prepared
+// queries, which the api doesn't expose the index of so are always all counted.
+func countSessionsAndQueries(client *consul.Client, index uint64) (int, int, error) {
+	var sessions []*consul.SessionEntry
+	var queries []*consul.PreparedQueryDefinition
+
+	_, err := retryBackoff("listing sessions", isRetryableConsulError, func() error {
+		var err error
+		sessions, _, err = client.Session().List(nil)
+		return err
+	})
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list sessions: %s", err)
+	}
+
+	_, err = retryBackoff("listing prepared queries", isRetryableConsulError, func() error {
+		var err error
+		queries, _, err = client.PreparedQuery().List(nil)
+		return err
+	})
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list prepared queries: %s", err)
+	}
+
+	sessionCount := 0
+
+	for _, session := range sessions {
+		if session.CreateIndex <= index {
+			sessionCount++
+		}
+	}
+
+	return sessionCount, len(queries), nil
+}
+
+// missingKeyPrefixes returns the prefixes no key exists under.
+func missingKeyPrefixes(client *consul.Client, prefixes []string) ([]string, error) {
+	var missing []string
+
+	for _, prefix := range prefixes {
+		keys, _, err := client.KV().Keys(prefix, "", nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(keys) == 0 {
+			missing = append(missing, prefix)
+		}
+	}
+
+	return missing, nil
+}
+
+// runVerify checks a stored snapshot is still restorable without taking a new backup. After its
+// checksum it's restored to the dummy consul agent, or its archive read with --verify-mode inspect,
+// and the keys found are compared with the count its manifest recorded when it was taken.
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	from := flags.String("from", "", "The snapshot to verify, eg s3://my-bucket/consul-snapshots/1568000000.snap, instead of giving it as an argument. A pointer written with --current-pointer-key is followed to its snapshot.")
+	verifyMode := flags.String("verify-mode", "full", "How to verify the snapshot, full restores it to the dummy consul agent and inspect reads its archive without one.")
+	restoreTimeout := flags.Duration("restore-timeout", 0, "Maximum time to allow for restoring the snapshot to the dummy consul agent. 0 means no limit.")
+	encryptionKeyValue := flags.String("encryption-key", "", "Base64 encoded 32 byte key to decrypt .enc snapshots with. Defaults to ENCRYPTION_KEY.")
+	ageIdentity := flags.String("age-identity", "", "Path of an age identity file to decrypt snapshots encrypted with --encrypt age:{recipient}. Defaults to AGE_IDENTITY_FILE.")
+	compressDictPath := flags.String("compress-dict", "", "Path to the zstd dictionary to decompress .zst snapshots compressed with --compress-dict.")
+	verifyKeyPath := flags.String("verify-key", "", "Path to the openpgp public key, armored or binary, to check the detached {snapshot}.sig signature written with --sign-key against. Snapshots with an invalid signature are always refused.")
+	allowUnsignedFlag := flags.Bool("allow-unsigned", false, "Use snapshots without a signature, or whose signature can't be checked without --verify-key, rather than refusing them.")
+	flags.DurationVar(&dummyAgentConfig.ReadyTimeout, "agent-ready-timeout", time.Second*30, "Maximum time to wait for the dummy consul agent to become ready.")
+	flags.BoolVar(&dummyAgentConfig.EphemeralPorts, "verify-ephemeral-ports", dummyAgentConfig.EphemeralPorts, "Bind the dummy consul agent to free loopback ports instead of the consul defaults, avoiding conflicts with services on the host. Pass --verify-ephemeral-ports=false for the defaults.")
+	flags.BoolVar(&dummyAgentConfig.ACLs, "verify-acls", false, "Enable ACLs on the dummy consul agent, bootstrapped with a random token, so restoring the snapshot exercises its ACL state.")
+	flags.StringVar(&dummyAgentConfig.Addr, "verify-addr", "", "Address for the http api of the dummy consul agent, eg 127.0.0.1:18500, rather than a free loopback port.")
+
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s verify [options] {snapshot_uri}\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.Parse(args)
+
+	uri := *from
+
+	if uri == "" && flags.NArg() == 1 {
+		uri = flags.Arg(0)
+	}
+
+	if uri == "" || flags.NArg() > 1 || (*from != "" && flags.NArg() > 0) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *verifyMode != "full" && *verifyMode != "inspect" {
+		fatalf("invalid verify mode '%s', expected full or inspect", *verifyMode)
+	}
+
+	if err := setEncryptionKey(*encryptionKeyValue); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setAgeIdentities(*ageIdentity); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setCompressionDict(*compressDictPath); err != nil {
+		fatalf("%s", err)
+	}
+
+	if err := setSignatureVerification(*verifyKeyPath, *allowUnsignedFlag); err != nil {
+		fatalf("%s", err)
+	}
+
+	source, err := parseTarget(uri)
+
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	if _, ok := providers[source.Type]; !ok {
+		fatalf("target type of %s is not supported, expected one of: %s", source.Type, strings.Join(supportedTargetTypes(), ", "))
+	}
+
+	currentPhase = "verify"
+
+	source, err = resolveSnapshotPointer(source)
+
+	if err != nil {
+		fatalf("error resolving %s: %s", uri, err)
+	}
+
+	log.Infof("downloading snapshot %s", uri)
+
+	snapshot, err := fetchSnapshot(source)
+
+	if err != nil {
+		fatalf("error downloading snapshot %s: %s", uri, err)
+	}
+
+	manifest, err := fetchSnapshotManifest(source)
+
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	// The keys were counted in the namespace and partition the snapshot was taken with.
+	if manifest != nil {
+		consulNamespace, consulPartition = manifest.Namespace, manifest.Partition
+	}
+
+	var keys int
+
+	switch {
+	case isKVExport(snapshot):
+		pairs, err := parseKVExport(snapshot)
+
+		if err != nil {
+			fatalf("error reading kv export %s: %s", uri, err)
+		}
+
+		keys = len(pairs)
+	case *verifyMode == "inspect":
+		state, err := readSnapshotState(bytesSource(snapshot))
+
+		if err != nil {
+			fatalf("error reading snapshot %s: %s", uri, err)
+		}
+
+		keys = len(state.KVs)
+	default:
+		if consulNamespace != "" || consulPartition != "" {
+			fatalf("snapshot %s was verified in a consul enterprise namespace or partition, so needs --verify-mode inspect", uri)
+		}
+
+		_, dummyConsulClient, err := startDummyAgent(dummyAgentConfig)
+
+		if err != nil {
+			fatalf("error starting dummy consul agent: %s", err)
+		}
+
+		log.Infof("restoring snapshot of %d bytes to the dummy consul agent", len(snapshot))
+
+		if err := restoreSnapshot(dummyConsulClient, snapshot, *restoreTimeout); err != nil {
+			fatalf("error restoring snapshot %s to dummy consul agent: %s", uri, err)
+		}
+
+		pairs, err := listKVChunk(dummyConsulClient, "")
+
+		if err != nil {
+			fatalf("error listing keys of snapshot %s: %s", uri, err)
+		}
+
+		keys = len(pairs)
+	}
+
+	if manifest == nil || manifest.KeyCount == nil {
+		log.Infof("snapshot %s holds %d keys, its manifest doesn't record how many it was taken with", uri, keys)
+	} else if keys != *manifest.KeyCount {
+		fatalf("snapshot %s holds %d keys, but its manifest records %d", uri, keys, *manifest.KeyCount)
+	}
+
+	log.Infof("verified snapshot %s with %d keys", uri, keys)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func TestCompareSkipsPrefixes(t *testing.T) {
+	v := &kvVerification{SnapshotIndex: 10, SkipPrefixes: []string{"locks/"}}
+
+	v.compare(consul.KVPairs{
+		{Key: "a", Value: []byte("1"), ModifyIndex: 5},
+		{Key: "b", Value: []byte("2"), ModifyIndex: 5},
+		{Key: "locks/x", Value: []byte("held"), ModifyIndex: 5},
+	}, consul.KVPairs{
+		{Key: "a", Value: []byte("1"), ModifyIndex: 5},
+		{Key: "b", Value: []byte("changed"), ModifyIndex: 5},
+		{Key: "c", Value: []byte("3"), ModifyIndex: 6},
+		{Key: "locks/x", Value: []byte("released"), ModifyIndex: 6},
+		{Key: "locks/y", Value: []byte("held"), ModifyIndex: 6},
+	})
+
+	if strings.Join(v.MismatchedKeys, ",") != "b" || strings.Join(v.MissingKeys, ",") != "c" {
+		t.Errorf("expected b to differ and c to be missing, got %v and %v", v.MismatchedKeys, v.MissingKeys)
+	}
+
+	if v.SkippedKeys != 2 {
+		t.Errorf("expected the 2 live keys under locks/ to be skipped, got %d", v.SkippedKeys)
+	}
+}
+
+func TestCompareChunksAtOnce(t *testing.T) {
+	var chunks []string
+	snapshot := map[string]consul.KVPairs{}
+	live := map[string]consul.KVPairs{}
+
+	for i := 0; i < 20; i++ {
+		chunk := fmt.Sprintf("p%d/", i)
+		chunks = append(chunks, chunk)
+		snapshot[chunk] = consul.KVPairs{{Key: chunk + "k", Value: []byte("v")}}
+		live[chunk] = consul.KVPairs{{Key: chunk + "k", Value: []byte("v")}}
+	}
+
+	live["p3/"] = consul.KVPairs{{Key: "p3/k", Value: []byte("other")}}
+
+	v := &kvVerification{SnapshotIndex: 10}
+
+	err := v.compareChunks(chunks, 4, func(chunk string) (consul.KVPairs, error) {
+		return snapshot[chunk], nil
+	}, func(chunk string) (consul.KVPairs, error) {
+		return live[chunk], nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.SnapshotKeys != 20 || v.LiveKeys != 20 {
+		t.Errorf("expected every chunk to be compared, got %d snapshot and %d live keys", v.SnapshotKeys, v.LiveKeys)
+	}
+
+	if !sort.StringsAreSorted(v.MismatchedKeys) || strings.Join(v.MismatchedKeys, ",") != "p3/k" {
+		t.Errorf("expected only p3/k to differ, got %v", v.MismatchedKeys)
+	}
+
+	err = (&kvVerification{}).compareChunks(chunks, 4, func(chunk string) (consul.KVPairs, error) {
+		if chunk == "p7/" {
+			return nil, fmt.Errorf("unavailable")
+		}
+
+		return snapshot[chunk], nil
+	}, func(chunk string) (consul.KVPairs, error) {
+		return live[chunk], nil
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Errorf("expected the error listing a chunk, got %v", err)
+	}
+}
+
+// fakeKV serves the kv endpoints listKVChunks and listKVChunk use from the pairs, the way consul
+// does for keys listed with a separator, recursive lists and single keys.
+func fakeKV(t *testing.T, pairs consul.KVPairs) *consul.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		query := r.URL.Query()
+		separator := query.Get("separator")
+
+		var found consul.KVPairs
+		keys := map[string]bool{}
+
+		for _, kv := range pairs {
+			switch {
+			case query.Has("keys"):
+				if strings.HasPrefix(kv.Key, prefix) {
+					key := kv.Key
+
+					if i := strings.Index(key[len(prefix):], separator); separator != "" && i >= 0 {
+						key = key[:len(prefix)+i+1]
+					}
+
+					keys[key] = true
+				}
+			case query.Has("recurse"):
+				if strings.HasPrefix(kv.Key, prefix) {
+					found = append(found, kv)
+				}
+			case kv.Key == prefix:
+				found = append(found, kv)
+			}
+		}
+
+		if query.Has("keys") {
+			listed := []string{}
+
+			for key := range keys {
+				listed = append(listed, key)
+			}
+
+			json.NewEncoder(w).Encode(listed)
+			return
+		}
+
+		if len(found) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode(found)
+	}))
+
+	t.Cleanup(server.Close)
+
+	client, err := consul.NewClient(&consul.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+// Top level keys are compared along with the prefixes they share a name with, eg foo and foo/bar.
+func TestCompareChunksCoversRootKeys(t *testing.T) {
+	snapshot := fakeKV(t, consul.KVPairs{
+		{Key: "foo", Value: []byte("1"), ModifyIndex: 5},
+		{Key: "foo/bar", Value: []byte("2"), ModifyIndex: 5},
+		{Key: "foo/baz/qux", Value: []byte("3"), ModifyIndex: 5},
+		{Key: "top", Value: []byte("4"), ModifyIndex: 5},
+	})
+
+	live := fakeKV(t, consul.KVPairs{
+		{Key: "foo", Value: []byte("changed"), ModifyIndex: 5},
+		{Key: "foo/bar", Value: []byte("changed"), ModifyIndex: 5},
+		{Key: "foo/baz/qux", Value: []byte("3"), ModifyIndex: 5},
+		{Key: "top", Value: []byte("4"), ModifyIndex: 5},
+		{Key: "zed", Value: []byte("5"), ModifyIndex: 5},
+	})
+
+	chunks, err := listKVChunks(snapshot, live)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(chunks, ",") != "foo,foo/,top,zed" {
+		t.Fatalf("expected the foo key and foo/ prefix as separate chunks, got %v", chunks)
+	}
+
+	v := &kvVerification{SnapshotIndex: 10}
+
+	err = v.compareChunks(chunks, 2, func(chunk string) (consul.KVPairs, error) {
+		return listKVChunk(snapshot, chunk)
+	}, func(chunk string) (consul.KVPairs, error) {
+		return listKVChunk(live, chunk)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.SnapshotKeys != 4 || v.LiveKeys != 5 {
+		t.Errorf("expected every key to be compared once, got %d snapshot and %d live keys", v.SnapshotKeys, v.LiveKeys)
+	}
+
+	if strings.Join(v.MismatchedKeys, ",") != "foo,foo/bar" || strings.Join(v.MissingKeys, ",") != "zed" {
+		t.Errorf("expected foo and foo/bar to differ and zed to be missing, got %v and %v", v.MismatchedKeys, v.MissingKeys)
+	}
+}
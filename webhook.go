@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// webhookPayload is the summary of a run posted to the webhook.
+type webhookPayload struct {
+	Status          string  `json:"status"`
+	Target          string  `json:"target"`
+	SnapshotKey     string  `json:"snapshot_key,omitempty"`
+	SnapshotBytes   int     `json:"snapshot_bytes"`
+	FailedPhase     string  `json:"failed_phase,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// pagerDutyEventsURL is the pagerduty events api v2 endpoint alerts are sent to.
+var pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// slackPayload is a slack incoming webhook message.
+type slackPayload struct {
+	Text string `json:"text"`
+}
+
+// pagerDutyEvent is a pagerduty events api v2 event.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Component     string            `json:"component"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+// notifyWebhook posts the outcome of the run to the webhook url. Failing to notify is logged
+// rather than changing the outcome of the run, and the timeout stops a hanging webhook from
+// holding up the exit.
+func notifyWebhook(url string, timeout time.Duration, r *RunResult) {
+	notify("webhook", url, timeout, r.Status, webhookPayload{
+		Status:          r.Status,
+		Target:          r.Target,
+		SnapshotKey:     r.SnapshotKey,
+		SnapshotBytes:   r.SnapshotBytes,
+		FailedPhase:     r.FailedPhase,
+		Error:           r.Error,
+		DurationSeconds: r.Durations["total"],
+	})
+}
+
+// notifySlack posts a message describing the outcome of the run to a slack incoming webhook.
+func notifySlack(url string, timeout time.Duration, r *RunResult) {
+	notify("slack", url, timeout, r.Status, slackPayload{Text: runSummary(r)})
+}
+
+// notifyPagerDuty triggers a pagerduty alert when the run failed, and resolves it once a run
+// succeeds. Alerts are deduplicated by target, so repeated failures update the same alert.
+func notifyPagerDuty(routingKey string, timeout time.Duration, r *RunResult) {
+	event := pagerDutyEvent{
+		RoutingKey:  routingKey,
+		EventAction: "resolve",
+		DedupKey:    "consul-backup-" + r.Target,
+	}
+
+	if r.Status != "success" {
+		host, _ := os.Hostname()
+
+		event.EventAction = "trigger"
+		event.Payload = &pagerDutyPayload{
+			Summary:   runSummary(r),
+			Source:    host,
+			Severity:  "error",
+			Component: "consul-backup",
+			CustomDetails: map[string]string{
+				"target":       r.Target,
+				"failed_phase": r.FailedPhase,
+				"error":        r.Error,
+			},
+		}
+	}
+
+	notify("pagerduty", pagerDutyEventsURL, timeout, r.Status, event)
+}
+
+// runSummary describes the outcome of the run in a sentence.
+func runSummary(r *RunResult) string {
+	if r.Status != "success" {
+		return fmt.Sprintf("Consul backup to %s failed in the %s phase: %s", r.Target, r.FailedPhase, r.Error)
+	}
+
+	return fmt.Sprintf("Consul backup to %s succeeded, storing %s (%s) in %s", r.Target, r.SnapshotKey, formatByteSize(int64(r.SnapshotBytes)), time.Duration(r.Durations["total"]*float64(time.Second)).Round(time.Millisecond))
+}
+
+// notify posts the payload as json to the url of the named notifier, logging rather than returning
+// a failure.
+func notify(name string, url string, timeout time.Duration, status string, payload interface{}) {
+	var err error
+
+	endSpan := startSpan("notify", "consul_backup.notifier", name)
+	defer func() { endSpan(err) }()
+
+	data, err := json.Marshal(payload)
+
+	if err != nil {
+		log.Warnf("error encoding %s payload: %s", name, err)
+		return
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+
+	if err == nil {
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("unexpected response code %d", resp.StatusCode)
+		}
+	}
+
+	if err != nil {
+		log.Warnf("error notifying %s of %s: %s", name, status, err)
+		return
+	}
+
+	log.Infof("notified %s of %s", name, status)
+}